@@ -0,0 +1,228 @@
+// Package client polls the hot keys the aggregator publishes to memcached, so that applications learn which of their keys are hot
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	log "github.com/golang/glog"
+	"github.com/inexplicable/mc_hotkeys/model"
+)
+
+const (
+	// DefaultKey is the key the aggregator publishes the hot keys at by default
+	DefaultKey = "MEMCACHED_HOT_KEYS"
+	// DefaultInterval is how often the published hot keys are polled
+	DefaultInterval = time.Second
+	// DefaultJitter is the part of the interval every poll is randomly moved by, so that the clients don't poll at once
+	DefaultJitter = 0.2
+)
+
+// ErrIncompatibleView is an error of a published view of another schema version
+var ErrIncompatibleView = errors.New("incompatible hot keys view")
+
+// Options tunes what a `HotKeysClient` polls and how often
+type Options struct {
+	// Key is where the hot keys are published, the `memcached_key` of the aggregator, or a scoped key of it, see `model.ScopeKey`
+	Key string
+	// Interval is how often the hot keys are polled
+	Interval time.Duration
+	// Jitter is the part of the interval every poll is randomly moved by, from 0 to 1
+	Jitter float64
+}
+
+// HotKeysClient polls the published hot keys, it reads the cheap generation first, follows a single generation by its diff,
+// and reads the whole view only when it's further behind, or the aggregator publishes no generation
+type HotKeysClient struct {
+	memcachedClient *memcache.Client
+	options         Options
+	random          *rand.Rand
+	m               sync.RWMutex
+	view            *model.AggregatedHotKeys
+	hot             map[string]*model.HotKeyEntry
+	observers       []func(diff *model.HotKeysDiff)
+}
+
+// NewHotKeysClient initializes a `HotKeysClient` reading by the `memcachedClient`, it knows no hot key till it polls,
+// the zero options take the defaults
+func NewHotKeysClient(memcachedClient *memcache.Client, options Options) *HotKeysClient {
+	if options.Key == "" {
+		options.Key = DefaultKey
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.Jitter <= 0 || options.Jitter > 1 {
+		options.Jitter = DefaultJitter
+	}
+	return &HotKeysClient{
+		memcachedClient: memcachedClient,
+		options:         options,
+		random:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		m:               sync.RWMutex{},
+		hot:             map[string]*model.HotKeyEntry{},
+	}
+}
+
+// Start polls right away, and then every jittered interval till the `ctx` is done
+func (hotKeysClient *HotKeysClient) Start(ctx context.Context) {
+	go func() {
+		for {
+			if err := hotKeysClient.Poll(); err != nil {
+				log.Warningf("<hot keys client> cannot poll %s:%v\n", hotKeysClient.options.Key, err)
+			}
+			timer := time.NewTimer(hotKeysClient.jittered())
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+}
+
+// jittered is the interval moved by up to the jitter either way
+func (hotKeysClient *HotKeysClient) jittered() time.Duration {
+	jitter := hotKeysClient.options.Jitter * (2*hotKeysClient.random.Float64() - 1)
+	return time.Duration(float64(hotKeysClient.options.Interval) * (1 + jitter))
+}
+
+// OnChange subscribes the `observer` to every change of the hot keys, it's told the keys added or rescored and the keys removed,
+// from the poll which found the change
+func (hotKeysClient *HotKeysClient) OnChange(observer func(diff *model.HotKeysDiff)) {
+	hotKeysClient.m.Lock()
+	defer hotKeysClient.m.Unlock()
+	hotKeysClient.observers = append(hotKeysClient.observers, observer)
+}
+
+// IsHot tells if the `key` is one of the hot keys last polled
+func (hotKeysClient *HotKeysClient) IsHot(key string) bool {
+	hotKeysClient.m.RLock()
+	defer hotKeysClient.m.RUnlock()
+	_, ok := hotKeysClient.hot[key]
+	return ok
+}
+
+// Entry gives the hot key entry of the `key`, its score and attribution, when it's hot
+func (hotKeysClient *HotKeysClient) Entry(key string) (*model.HotKeyEntry, bool) {
+	hotKeysClient.m.RLock()
+	defer hotKeysClient.m.RUnlock()
+	entry, ok := hotKeysClient.hot[key]
+	return entry, ok
+}
+
+// Snapshot gives the view last polled, nil before the first successful poll, it's readonly
+func (hotKeysClient *HotKeysClient) Snapshot() *model.AggregatedHotKeys {
+	hotKeysClient.m.RLock()
+	defer hotKeysClient.m.RUnlock()
+	return hotKeysClient.view
+}
+
+// Poll reads the published hot keys once, a failed poll keeps the hot keys of the last successful one
+func (hotKeysClient *HotKeysClient) Poll() error {
+	key := hotKeysClient.options.Key
+	current := hotKeysClient.Snapshot()
+	item, err := hotKeysClient.memcachedClient.Get(model.GenerationKey(key))
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	if err == nil {
+		generation, err := model.ParseGeneration(item.Value)
+		if err != nil {
+			return err
+		}
+		if current != nil && current.Generation == generation {
+			return nil
+		}
+		if current != nil && current.Generation+1 == generation {
+			if view, err := hotKeysClient.followDiff(current, generation); err == nil {
+				hotKeysClient.update(view)
+				return nil
+			}
+			// the diff was overwritten by a newer generation, or it's unreadable, the whole view tells anyway
+		}
+	}
+
+	aggregated := &model.AggregatedHotKeys{}
+	if err := hotKeysClient.read(key, aggregated); err != nil {
+		return err
+	}
+	if aggregated.Version != model.ReportSchemaVersion {
+		return ErrIncompatibleView
+	}
+	if current != nil && current.Generation == aggregated.Generation && current.Timestamp == aggregated.Timestamp {
+		return nil
+	}
+	hotKeysClient.update(aggregated)
+	return nil
+}
+
+// followDiff applies the diff from the `current` view to the next `generation`
+func (hotKeysClient *HotKeysClient) followDiff(current *model.AggregatedHotKeys, generation uint64) (*model.AggregatedHotKeys, error) {
+	diff := &model.HotKeysDiff{}
+	if err := hotKeysClient.read(model.DiffKey(hotKeysClient.options.Key), diff); err != nil {
+		return nil, err
+	}
+	if diff.Version != model.ReportSchemaVersion || diff.From != current.Generation || diff.To != generation {
+		return nil, ErrIncompatibleView
+	}
+	return &model.AggregatedHotKeys{
+		Version:    current.Version,
+		Timestamp:  diff.Timestamp,
+		HotKeys:    diff.Apply(current.HotKeys),
+		Reporters:  current.Reporters,
+		Exact:      current.Exact,
+		Generation: generation,
+	}, nil
+}
+
+// read decodes the value published at the `key`, compressed or chunked, into the json `value`
+func (hotKeysClient *HotKeysClient) read(key string, value interface{}) error {
+	item, err := hotKeysClient.memcachedClient.Get(key)
+	if err != nil {
+		return err
+	}
+	rawBytes, err := model.DecodeValue(item, hotKeysClient.memcachedClient.GetMulti)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rawBytes, value)
+}
+
+// update replaces the view, and tells the observers the change of its hot keys, if any
+func (hotKeysClient *HotKeysClient) update(view *model.AggregatedHotKeys) {
+	hotKeysClient.m.Lock()
+	previous := model.HotKeyEntries{}
+	from := uint64(0)
+	if hotKeysClient.view != nil {
+		previous, from = hotKeysClient.view.HotKeys, hotKeysClient.view.Generation
+	}
+	hot := make(map[string]*model.HotKeyEntry, len(view.HotKeys))
+	for _, entry := range view.HotKeys {
+		hot[entry.Key] = entry
+	}
+	hotKeysClient.view, hotKeysClient.hot = view, hot
+	observers := hotKeysClient.observers
+	hotKeysClient.m.Unlock()
+
+	upserts, removes := model.DiffHotKeys(previous, view.HotKeys)
+	if len(upserts) == 0 && len(removes) == 0 {
+		return
+	}
+	diff := &model.HotKeysDiff{
+		Version: model.ReportSchemaVersion,
+		From:    from,
+		To:      view.Generation,
+		Upserts: upserts,
+		Removes: removes,
+	}
+	for _, observer := range observers {
+		observer(diff)
+	}
+}
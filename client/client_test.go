@@ -0,0 +1,204 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/inexplicable/mc_hotkeys/internal/memcachedtest"
+	"github.com/inexplicable/mc_hotkeys/model"
+)
+
+func publish(memcachedClient *memcache.Client, codec *model.ValueCodec, key string, value interface{}) {
+	rawBytes, _ := json.Marshal(value)
+	items, err := codec.Encode(key, rawBytes, 0)
+	if err != nil {
+		panic("cannot encode the published value")
+	}
+	for _, item := range items {
+		if memcachedClient.Set(item) != nil {
+			panic("cannot publish")
+		}
+	}
+}
+
+func TestHotKeysClient(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	publisher := memcache.New(fake.Addr())
+	// a tiny chunk size makes the view compressed and chunked
+	codec := model.NewValueCodec(model.GzipCompression, 16)
+	hotKeysClient := NewHotKeysClient(memcache.New(fake.Addr()), Options{Key: "hot"})
+	diffs := []*model.HotKeysDiff{}
+	hotKeysClient.OnChange(func(diff *model.HotKeysDiff) {
+		diffs = append(diffs, diff)
+	})
+
+	if err := hotKeysClient.Poll(); err != memcache.ErrCacheMiss || hotKeysClient.Snapshot() != nil || hotKeysClient.IsHot("a") {
+		panic("nothing should be hot before anything's published")
+	}
+
+	// an aggregator publishing no generation is read in whole every time
+	publish(publisher, codec, "hot", &model.AggregatedHotKeys{
+		Version:   model.ReportSchemaVersion,
+		Timestamp: 1,
+		HotKeys:   model.HotKeyEntries{{Key: "a", Score: 10}, {Key: "b", Score: 5}},
+	})
+	if err := hotKeysClient.Poll(); err != nil || !hotKeysClient.IsHot("a") || !hotKeysClient.IsHot("b") || hotKeysClient.IsHot("c") {
+		panic("the published hot keys should be polled")
+	}
+	if len(diffs) != 1 || len(diffs[0].Upserts) != 2 || len(diffs[0].Removes) != 0 {
+		panic("the observers should be told the new hot keys")
+	}
+	hotKeysClient.Poll()
+	if len(diffs) != 1 {
+		panic("an unchanged view shouldn't be told")
+	}
+
+	publish(publisher, codec, "hot", &model.AggregatedHotKeys{
+		Version:    model.ReportSchemaVersion,
+		Timestamp:  2,
+		HotKeys:    model.HotKeyEntries{{Key: "a", Score: 10}, {Key: "c", Score: 7}},
+		Generation: 7,
+	})
+	publisher.Set(&memcache.Item{Key: model.GenerationKey("hot"), Value: []byte("7")})
+	if err := hotKeysClient.Poll(); err != nil || hotKeysClient.Snapshot().Generation != 7 || hotKeysClient.IsHot("b") || !hotKeysClient.IsHot("c") {
+		panic("a client far behind should read the whole view")
+	}
+	if len(diffs) != 2 || !reflect.DeepEqual(diffs[1].Removes, []string{"b"}) || len(diffs[1].Upserts) != 1 || diffs[1].Upserts[0].Key != "c" {
+		panic("the observers should be told the keys added and removed")
+	}
+
+	// the next generation is followed by its diff, without reading the view again
+	reads := fake.Reads("hot")
+	publish(publisher, codec, model.DiffKey("hot"), &model.HotKeysDiff{
+		Version:   model.ReportSchemaVersion,
+		From:      7,
+		To:        8,
+		Timestamp: 3,
+		Upserts:   model.HotKeyEntries{{Key: "d", Score: 20}},
+		Removes:   []string{"a"},
+	})
+	publisher.Set(&memcache.Item{Key: model.GenerationKey("hot"), Value: []byte("8")})
+	if err := hotKeysClient.Poll(); err != nil || fake.Reads("hot") != reads {
+		panic("a single generation should be followed by its diff")
+	}
+	snapshot := hotKeysClient.Snapshot()
+	if snapshot.Generation != 8 || len(snapshot.HotKeys) != 2 || snapshot.HotKeys[0].Key != "d" || hotKeysClient.IsHot("a") {
+		panic("the diff should be applied to the hot keys")
+	}
+	if snapshot.Timestamp != 3 {
+		panic("the view followed by a diff should be as of the published view")
+	}
+	if entry, ok := hotKeysClient.Entry("d"); !ok || entry.Score != 20 {
+		panic("the entry of a hot key should be given")
+	}
+	hotKeysClient.Poll()
+	if fake.Reads(model.DiffKey("hot")) != 1 || len(diffs) != 3 {
+		panic("an unchanged generation shouldn't be read any further")
+	}
+
+	// a diff of another generation falls back to the view
+	publisher.Set(&memcache.Item{Key: model.GenerationKey("hot"), Value: []byte("9")})
+	if err := hotKeysClient.Poll(); err != nil || hotKeysClient.Snapshot().Generation != 7 || fake.Reads("hot") != reads+1 {
+		panic("a mismatched diff should fall back to the view")
+	}
+
+	publish(publisher, codec, "hot", map[string]interface{}{"version": model.ReportSchemaVersion + 1, "hot_keys": []interface{}{}})
+	publisher.Set(&memcache.Item{Key: model.GenerationKey("hot"), Value: []byte("10")})
+	if err := hotKeysClient.Poll(); err != ErrIncompatibleView || !hotKeysClient.IsHot("a") {
+		panic("an incompatible view should keep the last hot keys")
+	}
+}
+
+func TestHotKeysClientOfGossip(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	publisher, err := model.NewResilientPublisher(&memcache.ServerList{}, time.Hour, fake.Addr())
+	if err != nil {
+		panic("publisher should be initialized with fallback")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gossip, err := model.NewGossipAggregator(ctx, "host1:11211", "hot", "127.0.0.1:0", func(member model.Member) string {
+		return ""
+	}, model.GossipOptions{TopN: 2, Interval: 10 * time.Millisecond, Staleness: time.Minute, Publish: true},
+		publisher.Selector(), model.NewStaticDiscovery(), model.NewValueCodec(model.GzipCompression, 16), publisher)
+	if err != nil {
+		panic("gossip aggregator should listen")
+	}
+	published := func(generation string) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if value, ok := fake.Value(model.GenerationKey("hot")); ok && string(value) == generation {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		panic("the gossiped view should be published with its generation")
+	}
+	hotKeysClient := NewHotKeysClient(memcache.New(fake.Addr()), Options{Key: "hot"})
+
+	gossip.Report(map[string]uint64{"a": 10}, model.WindowsMetadata{Width: 10, TopN: 2})
+	published("1")
+	if err := hotKeysClient.Poll(); err != nil || hotKeysClient.Snapshot().Generation != 1 || !hotKeysClient.IsHot("a") {
+		panic("the gossiped view should be polled")
+	}
+
+	gossip.Report(map[string]uint64{"b": 10}, model.WindowsMetadata{Width: 10, TopN: 2})
+	published("2")
+	// the gossip instance reads the view it follows too, it must be done before the reads are counted
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	reads := fake.Reads("hot")
+	if err := hotKeysClient.Poll(); err != nil || fake.Reads("hot") != reads || fake.Reads(model.DiffKey("hot")) != 1 {
+		panic("the next gossiped generation should be followed by its diff")
+	}
+	if snapshot := hotKeysClient.Snapshot(); snapshot.Generation != 2 || hotKeysClient.IsHot("a") || !hotKeysClient.IsHot("b") {
+		panic("the gossiped diff should be applied to the hot keys")
+	}
+}
+
+func TestHotKeysClientStart(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	publisher := memcache.New(fake.Addr())
+	codec := model.NewValueCodec(model.NoCompression, 0)
+	hotKeysClient := NewHotKeysClient(memcache.New(fake.Addr()), Options{Key: "hot", Interval: 10 * time.Millisecond, Jitter: 0.5})
+	for i := 0; i < 100; i++ {
+		if interval := hotKeysClient.jittered(); interval < 5*time.Millisecond || interval > 15*time.Millisecond {
+			panic("the interval should be jittered within bounds")
+		}
+	}
+
+	changed := make(chan *model.HotKeysDiff, 10)
+	hotKeysClient.OnChange(func(diff *model.HotKeysDiff) {
+		changed <- diff
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hotKeysClient.Start(ctx)
+	for generation := 1; generation <= 2; generation++ {
+		publish(publisher, codec, "hot", &model.AggregatedHotKeys{
+			Version:    model.ReportSchemaVersion,
+			HotKeys:    model.HotKeyEntries{{Key: "k" + strconv.Itoa(generation), Score: 1}},
+			Generation: uint64(generation),
+		})
+		publisher.Set(&memcache.Item{Key: model.GenerationKey("hot"), Value: []byte(strconv.Itoa(generation))})
+		select {
+		case diff := <-changed:
+			if diff.To != uint64(generation) {
+				panic("the change should be of the published generation")
+			}
+		case <-time.After(time.Second):
+			panic("the published change should be polled")
+		}
+	}
+}
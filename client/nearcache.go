@@ -0,0 +1,261 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/inexplicable/mc_hotkeys/model"
+)
+
+const (
+	// DefaultNearCacheTTL is how long a hot key is served from the near cache, which is how stale it may be
+	DefaultNearCacheTTL = time.Second
+	// DefaultNearCacheBytes caps the memory of the near cache
+	DefaultNearCacheBytes = 16 << 20
+)
+
+// NearCacheOptions tunes how stale and how large the near cache gets
+type NearCacheOptions struct {
+	// TTL is how long a hot key is served from the near cache without reading memcached
+	TTL time.Duration
+	// MaxBytes caps the memory of the cached keys and values, the least recently used are evicted beyond it
+	MaxBytes int
+}
+
+// NearCacheStats counts the reads the near cache served, and what happened to its entries
+type NearCacheStats struct {
+	// Hits are the reads of hot keys served in-process
+	Hits uint64 `json:"hits"`
+	// Misses are the reads of hot keys which went to memcached
+	Misses uint64 `json:"misses"`
+	// Bypassed are the reads of keys which aren't hot, never cached
+	Bypassed uint64 `json:"bypassed"`
+	model.CacheStats
+}
+
+// HitRate is the part of the hot keys' reads served in-process
+func (stats NearCacheStats) HitRate() float64 {
+	if reads := stats.Hits + stats.Misses; reads > 0 {
+		return float64(stats.Hits) / float64(reads)
+	}
+	return 0
+}
+
+// NearCache is a drop-in `*memcache.Client` which serves the keys the `HotKeysClient` tells hot from memory for a short while,
+// the writes through it invalidate the cached keys, the writes of others are seen once the cached keys expire
+type NearCache struct {
+	*memcache.Client
+	hotKeys *HotKeysClient
+	options NearCacheOptions
+	m       sync.Mutex
+	cache   *model.BoundedCache
+	stats   NearCacheStats
+}
+
+// NewNearCache wraps the `memcachedClient` with a near cache of the keys the `hotKeys` client tells hot,
+// the zero options take the defaults
+func NewNearCache(memcachedClient *memcache.Client, hotKeys *HotKeysClient, options NearCacheOptions) *NearCache {
+	if options.TTL <= 0 {
+		options.TTL = DefaultNearCacheTTL
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultNearCacheBytes
+	}
+	nearCache := &NearCache{
+		Client:  memcachedClient,
+		hotKeys: hotKeys,
+		options: options,
+		m:       sync.Mutex{},
+		cache:   model.NewBoundedCache(options.MaxBytes),
+	}
+	hotKeys.OnChange(nearCache.cooldown)
+	return nearCache
+}
+
+// cooldown drops the keys no longer hot
+func (nearCache *NearCache) cooldown(diff *model.HotKeysDiff) {
+	nearCache.m.Lock()
+	defer nearCache.m.Unlock()
+
+	removed := make(map[string]bool, len(diff.Removes))
+	for _, key := range diff.Removes {
+		removed[key] = true
+	}
+	nearCache.cache.Retain(func(key string) bool { return !removed[key] })
+}
+
+// lookup gives a copy of the cached item of the `key`, or the sequence to `fill` it with
+func (nearCache *NearCache) lookup(key string) (*memcache.Item, uint64) {
+	nearCache.m.Lock()
+	defer nearCache.m.Unlock()
+
+	if value, ok := nearCache.cache.Get(key, time.Now()); ok {
+		nearCache.stats.Hits++
+		item := *value.(*memcache.Item)
+		item.Value = append([]byte(nil), item.Value...)
+		return &item, 0
+	}
+	nearCache.stats.Misses++
+	return nil, nearCache.cache.Sequence()
+}
+
+// fill caches a copy of the `item` read since the `sequence`, unless its key was invalidated or cooled down meanwhile
+func (nearCache *NearCache) fill(item *memcache.Item, sequence uint64) {
+	if !nearCache.hotKeys.IsHot(item.Key) {
+		return
+	}
+	nearCache.m.Lock()
+	defer nearCache.m.Unlock()
+
+	cached := *item
+	cached.Value = append([]byte(nil), item.Value...)
+	nearCache.cache.Fill(item.Key, &cached, len(cached.Key)+len(cached.Value), nearCache.options.TTL, sequence)
+}
+
+// invalidate drops the cached `key` once it's written, and keeps the reads from before the write from filling it,
+// hot or not, as the key may turn hot before they're answered
+func (nearCache *NearCache) invalidate(key string) {
+	nearCache.m.Lock()
+	defer nearCache.m.Unlock()
+
+	nearCache.cache.Invalidate(key)
+}
+
+// flush drops every cached key
+func (nearCache *NearCache) flush() {
+	nearCache.m.Lock()
+	defer nearCache.m.Unlock()
+
+	nearCache.cache.Flush()
+}
+
+// Stats gives the counters, and the keys and bytes cached
+func (nearCache *NearCache) Stats() NearCacheStats {
+	nearCache.m.Lock()
+	defer nearCache.m.Unlock()
+
+	stats := nearCache.stats
+	stats.CacheStats = nearCache.cache.Stats()
+	return stats
+}
+
+// Get serves a hot key from the near cache, or reads memcached and caches it, the other keys are read from memcached as they are
+func (nearCache *NearCache) Get(key string) (*memcache.Item, error) {
+	if !nearCache.hotKeys.IsHot(key) {
+		nearCache.m.Lock()
+		nearCache.stats.Bypassed++
+		nearCache.m.Unlock()
+		return nearCache.Client.Get(key)
+	}
+	item, sequence := nearCache.lookup(key)
+	if item != nil {
+		return item, nil
+	}
+	item, err := nearCache.Client.Get(key)
+	if err == nil {
+		nearCache.fill(item, sequence)
+	}
+	return item, err
+}
+
+// GetMulti serves the hot keys from the near cache, and reads the rest from memcached at once
+func (nearCache *NearCache) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	items := make(map[string]*memcache.Item, len(keys))
+	sequences := map[string]uint64{}
+	remaining := make([]string, 0, len(keys))
+	bypassed := uint64(0)
+	for _, key := range keys {
+		if !nearCache.hotKeys.IsHot(key) {
+			bypassed++
+			remaining = append(remaining, key)
+			continue
+		}
+		if item, sequence := nearCache.lookup(key); item != nil {
+			items[key] = item
+		} else {
+			sequences[key] = sequence
+			remaining = append(remaining, key)
+		}
+	}
+	nearCache.m.Lock()
+	nearCache.stats.Bypassed += bypassed
+	nearCache.m.Unlock()
+	if len(remaining) == 0 {
+		return items, nil
+	}
+	read, err := nearCache.Client.GetMulti(remaining)
+	for key, item := range read {
+		if sequence, ok := sequences[key]; ok {
+			nearCache.fill(item, sequence)
+		}
+		items[key] = item
+	}
+	return items, err
+}
+
+// Set writes the item and invalidates its key
+func (nearCache *NearCache) Set(item *memcache.Item) error {
+	defer nearCache.invalidate(item.Key)
+	return nearCache.Client.Set(item)
+}
+
+// Add writes the item and invalidates its key
+func (nearCache *NearCache) Add(item *memcache.Item) error {
+	defer nearCache.invalidate(item.Key)
+	return nearCache.Client.Add(item)
+}
+
+// Replace writes the item and invalidates its key
+func (nearCache *NearCache) Replace(item *memcache.Item) error {
+	defer nearCache.invalidate(item.Key)
+	return nearCache.Client.Replace(item)
+}
+
+// Append writes the item and invalidates its key
+func (nearCache *NearCache) Append(item *memcache.Item) error {
+	defer nearCache.invalidate(item.Key)
+	return nearCache.Client.Append(item)
+}
+
+// Prepend writes the item and invalidates its key
+func (nearCache *NearCache) Prepend(item *memcache.Item) error {
+	defer nearCache.invalidate(item.Key)
+	return nearCache.Client.Prepend(item)
+}
+
+// CompareAndSwap writes the item and invalidates its key
+func (nearCache *NearCache) CompareAndSwap(item *memcache.Item) error {
+	defer nearCache.invalidate(item.Key)
+	return nearCache.Client.CompareAndSwap(item)
+}
+
+// Delete deletes the key and invalidates it
+func (nearCache *NearCache) Delete(key string) error {
+	defer nearCache.invalidate(key)
+	return nearCache.Client.Delete(key)
+}
+
+// Increment increments the key and invalidates it
+func (nearCache *NearCache) Increment(key string, delta uint64) (uint64, error) {
+	defer nearCache.invalidate(key)
+	return nearCache.Client.Increment(key, delta)
+}
+
+// Decrement decrements the key and invalidates it
+func (nearCache *NearCache) Decrement(key string, delta uint64) (uint64, error) {
+	defer nearCache.invalidate(key)
+	return nearCache.Client.Decrement(key, delta)
+}
+
+// DeleteAll deletes every key and flushes the near cache
+func (nearCache *NearCache) DeleteAll() error {
+	defer nearCache.flush()
+	return nearCache.Client.DeleteAll()
+}
+
+// FlushAll flushes every server and the near cache
+func (nearCache *NearCache) FlushAll() error {
+	defer nearCache.flush()
+	return nearCache.Client.FlushAll()
+}
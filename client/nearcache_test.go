@@ -0,0 +1,112 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/inexplicable/mc_hotkeys/internal/memcachedtest"
+	"github.com/inexplicable/mc_hotkeys/model"
+)
+
+func TestNearCache(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	direct := memcache.New(fake.Addr())
+	codec := model.NewValueCodec(model.NoCompression, 0)
+	hotKeys := NewHotKeysClient(memcache.New(fake.Addr()), Options{Key: "hot"})
+	publish(direct, codec, "hot", &model.AggregatedHotKeys{
+		Version:   model.ReportSchemaVersion,
+		Timestamp: 1,
+		HotKeys:   model.HotKeyEntries{{Key: "hot_a", Score: 10}, {Key: "hot_b", Score: 5}, {Key: "hot_c", Score: 1}},
+	})
+	if hotKeys.Poll() != nil {
+		panic("the hot keys should be polled")
+	}
+	nearCache := NewNearCache(memcache.New(fake.Addr()), hotKeys, NearCacheOptions{
+		TTL:      time.Hour,
+		MaxBytes: 2 * (len("hot_a") + len("value") + model.CacheEntryOverhead),
+	})
+
+	nearCache.Set(&memcache.Item{Key: "hot_a", Value: []byte("value")})
+	nearCache.Set(&memcache.Item{Key: "cold", Value: []byte("value")})
+	for i := 0; i < 3; i++ {
+		if item, err := nearCache.Get("hot_a"); err != nil || string(item.Value) != "value" {
+			panic("a hot key should be read")
+		}
+		nearCache.Get("cold")
+	}
+	if fake.Reads("hot_a") != 1 || fake.Reads("cold") != 3 {
+		panic("only the hot keys should be served in-process")
+	}
+	item, _ := nearCache.Get("hot_a")
+	item.Value[0] = 'X'
+	if item, _ := nearCache.Get("hot_a"); string(item.Value) != "value" {
+		panic("the cached value shouldn't be changed by its readers")
+	}
+
+	// the writes of others are hidden till the cached key expires, the writes through the near cache never are
+	direct.Set(&memcache.Item{Key: "hot_a", Value: []byte("other")})
+	if item, _ := nearCache.Get("hot_a"); string(item.Value) != "value" {
+		panic("a hot key should be served from the near cache")
+	}
+	nearCache.Set(&memcache.Item{Key: "hot_a", Value: []byte("mine")})
+	if item, _ := nearCache.Get("hot_a"); string(item.Value) != "mine" {
+		panic("a write through the near cache should invalidate the key")
+	}
+	nearCache.Delete("hot_a")
+	if _, err := nearCache.Get("hot_a"); err != memcache.ErrCacheMiss {
+		panic("a delete through the near cache should invalidate the key")
+	}
+
+	// a read from before a write doesn't fill the cache with the value it overwrote
+	_, sequence := nearCache.lookup("hot_b")
+	nearCache.invalidate("hot_b")
+	nearCache.fill(&memcache.Item{Key: "hot_b", Value: []byte("old")}, sequence)
+	if item, _ := nearCache.lookup("hot_b"); item != nil {
+		panic("a read older than the invalidation shouldn't fill the cache")
+	}
+
+	// a key written while it's cold is invalidated as well, as it may be hot by the time the reads from before the write are answered
+	sequence = nearCache.cache.Sequence()
+	nearCache.invalidate("cold")
+	if nearCache.cache.Sequence() == sequence {
+		panic("a write of a cold key should be invalidated")
+	}
+
+	direct.Set(&memcache.Item{Key: "hot_a", Value: []byte("value")})
+	direct.Set(&memcache.Item{Key: "hot_b", Value: []byte("value")})
+	direct.Set(&memcache.Item{Key: "hot_c", Value: []byte("value")})
+	if items, err := nearCache.GetMulti([]string{"hot_a", "hot_b", "cold"}); err != nil || len(items) != 3 {
+		panic("the hot and cold keys should be read at once")
+	}
+	nearCache.Get("hot_a")
+	nearCache.Get("hot_c")
+	stats := nearCache.Stats()
+	if stats.Keys != 2 || stats.Evictions != 1 || stats.Bytes > 2*(len("hot_a")+len("value")+model.CacheEntryOverhead) {
+		panic("the near cache should stay within its memory cap")
+	}
+	if items, _ := nearCache.GetMulti([]string{"hot_a", "hot_c"}); len(items) != 2 || nearCache.Stats().Hits != stats.Hits+2 {
+		panic("the least recently used key should be evicted")
+	}
+
+	publish(direct, codec, "hot", &model.AggregatedHotKeys{
+		Version:   model.ReportSchemaVersion,
+		Timestamp: 2,
+		HotKeys:   model.HotKeyEntries{{Key: "hot_c", Score: 1}},
+	})
+	hotKeys.Poll()
+	stats = nearCache.Stats()
+	if stats.Keys != 1 || stats.Bypassed != 4 || stats.HitRate() != 0.5 {
+		panic("the keys no longer hot should be dropped")
+	}
+
+	brief := NewNearCache(memcache.New(fake.Addr()), hotKeys, NearCacheOptions{TTL: time.Millisecond})
+	brief.Get("hot_c")
+	time.Sleep(5 * time.Millisecond)
+	brief.Get("hot_c")
+	if stats := brief.Stats(); stats.Hits != 0 || stats.Expirations != 1 {
+		panic("a key should be served no longer than the ttl")
+	}
+}
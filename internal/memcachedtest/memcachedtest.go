@@ -0,0 +1,206 @@
+// Package memcachedtest is an in-process memcached for the tests of the packages reading and publishing through gomemcache
+package memcachedtest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type item struct {
+	value   []byte
+	flags   uint32
+	exptime time.Time
+	cas     uint64
+}
+
+// Server speaks just enough text protocol for gomemcache, `get(s)`, `set`, `add`, `replace`, `cas`, `delete`, `touch` and `version`,
+// and counts the reads of every key
+type Server struct {
+	m        sync.Mutex
+	listener net.Listener
+	items    map[string]*item
+	reads    map[string]int
+	conns    []net.Conn
+	cas      uint64
+}
+
+// NewServer starts a `Server` at a random local port
+func NewServer() *Server {
+	return NewServerAt("127.0.0.1:0")
+}
+
+// NewServerAt starts a `Server` at `addr`, e.g. where a closed one was
+func NewServerAt(addr string) *Server {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic("cannot start fake memcached")
+	}
+	server := &Server{listener: l, items: map[string]*item{}, reads: map[string]int{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server.m.Lock()
+			server.conns = append(server.conns, conn)
+			server.m.Unlock()
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+// Addr is the address the server listens at
+func (server *Server) Addr() string {
+	return server.listener.Addr().String()
+}
+
+// Close stops listening and drops every connection, as a memcached gone down
+func (server *Server) Close() {
+	server.listener.Close()
+	server.m.Lock()
+	defer server.m.Unlock()
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+}
+
+func (server *Server) get(key string) (*item, bool) {
+	stored, ok := server.items[key]
+	if ok && !stored.exptime.IsZero() && !time.Now().Before(stored.exptime) {
+		delete(server.items, key)
+		return nil, false
+	}
+	return stored, ok
+}
+
+// Value gives the value of `key` unless it's missing or expired
+func (server *Server) Value(key string) ([]byte, bool) {
+	server.m.Lock()
+	defer server.m.Unlock()
+	if stored, ok := server.get(key); ok {
+		return stored.value, true
+	}
+	return nil, false
+}
+
+// Delete deletes `key` behind the clients' back, e.g. as if it was evicted
+func (server *Server) Delete(key string) {
+	server.m.Lock()
+	defer server.m.Unlock()
+	delete(server.items, key)
+}
+
+// Expirations gives when every stored key expires, the zero time for never
+func (server *Server) Expirations() map[string]time.Time {
+	server.m.Lock()
+	defer server.m.Unlock()
+	expirations := make(map[string]time.Time, len(server.items))
+	for key, stored := range server.items {
+		expirations[key] = stored.exptime
+	}
+	return expirations
+}
+
+// Reads is the number of times `key` was fetched, hit or missed
+func (server *Server) Reads(key string) int {
+	server.m.Lock()
+	defer server.m.Unlock()
+	return server.reads[key]
+}
+
+func expiration(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+func (server *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "get", "gets":
+			server.m.Lock()
+			for _, key := range args[1:] {
+				server.reads[key]++
+				if stored, ok := server.get(key); ok {
+					if args[0] == "gets" {
+						fmt.Fprintf(rw, "VALUE %s %d %d %d\r\n", key, stored.flags, len(stored.value), stored.cas)
+					} else {
+						fmt.Fprintf(rw, "VALUE %s %d %d\r\n", key, stored.flags, len(stored.value))
+					}
+					rw.Write(stored.value)
+					rw.WriteString("\r\n")
+				}
+			}
+			server.m.Unlock()
+			rw.WriteString("END\r\n")
+		case "set", "add", "replace", "cas":
+			flags, _ := strconv.ParseUint(args[2], 10, 32)
+			exptime, _ := strconv.ParseInt(args[3], 10, 64)
+			size, _ := strconv.Atoi(args[4])
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(rw, value); err != nil {
+				return
+			}
+			server.m.Lock()
+			existing, exists := server.get(args[1])
+			switch {
+			case args[0] == "add" && exists, args[0] == "replace" && !exists:
+				rw.WriteString("NOT_STORED\r\n")
+			case args[0] == "cas" && !exists:
+				rw.WriteString("NOT_FOUND\r\n")
+			case args[0] == "cas" && strconv.FormatUint(existing.cas, 10) != args[5]:
+				rw.WriteString("EXISTS\r\n")
+			default:
+				server.cas++
+				server.items[args[1]] = &item{value: value[:size], flags: uint32(flags), exptime: expiration(exptime), cas: server.cas}
+				rw.WriteString("STORED\r\n")
+			}
+			server.m.Unlock()
+		case "delete":
+			server.m.Lock()
+			if _, ok := server.get(args[1]); ok {
+				delete(server.items, args[1])
+				rw.WriteString("DELETED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+			server.m.Unlock()
+		case "touch":
+			exptime, _ := strconv.ParseInt(args[2], 10, 64)
+			server.m.Lock()
+			if stored, ok := server.get(args[1]); ok {
+				stored.exptime = expiration(exptime)
+				rw.WriteString("TOUCHED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+			server.m.Unlock()
+		case "version":
+			rw.WriteString("VERSION fake\r\n")
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		if rw.Flush() != nil {
+			return
+		}
+	}
+}
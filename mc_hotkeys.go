@@ -1,42 +1,324 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/bradfitz/gomemcache/memcache"
 	log "github.com/golang/glog"
 	"github.com/inexplicable/mc_hotkeys/mcrouter"
+	"github.com/inexplicable/mc_hotkeys/mcrouter/hashing"
 	"github.com/inexplicable/mc_hotkeys/model"
 )
 
 var (
-	host         = flag.String("host", "", "listing host name for incoming memcached text connection")
-	port         = flag.Int("port", 11211, "listening port for incoming memcached text connections")
-	rollingWidth = flag.Int("rolling_width", 10, "number of rolling windows (each is 1s), default 10s")
-	topN         = flag.Int("top_n", 10, "number of top hot keys to be reported")
-	threshold    = flag.Uint64("threshold", 100, "mininal number of requests in the aggregate windows")
-	minSlabBytes = flag.Uint64("min_slab_bytes", 96, "chunk size(bytes) of the smallest slab")
-	mcrouterPort = flag.Int("mcrouter_port", 8989, "known mcrouter port")
-	memcachedKey = flag.String("memcached_key", "MEMCACHED_HOT_KEYS", "memcached key of the hot keys")
-	serviceName  = flag.String("service_name", "mc_hotkeys", "consul service name")
-	secretsPath  = flag.String("secrets_path", "/etc/consul/mc_hotkeys.json", "vault secrets path")
+	host              = flag.String("host", "", "listing host name for incoming memcached text connection")
+	port              = flag.Int("port", 11211, "listening port for incoming memcached text connections")
+	rollingWidth      = flag.Int("rolling_width", 10, "number of rolling windows (each is 1s), default 10s")
+	reportInterval    = flag.Duration("report_interval", model.DefaultReportInterval, "interval of reporting the hot keys to memcached")
+	aggregateInterval = flag.Duration("aggregate_interval", 0, "interval of aggregating the reports, default rolling_width seconds")
+	logReport         = flag.Bool("log_report", false, "also reports the hot keys to the log")
+	topN              = flag.Int("top_n", 10, "number of top hot keys to be reported")
+	threshold         = flag.Uint64("threshold", 100, "mininal number of requests in the aggregate windows")
+	minSlabBytes      = flag.Uint64("min_slab_bytes", 96, "chunk size(bytes) of the smallest slab")
+	mcrouterPort      = flag.Int("mcrouter_port", 8989, "known mcrouter port")
+	mcrouterCIDRs     = flag.String("mcrouter_cidrs", "", "semicolon separated rules of the mcrouter ports by network, e.g. 10.0.0.0/8=5000,5001")
+	mcrouterMapping   = flag.String("mcrouter_mapping", "", "file mapping the remote ips to their mcrouter addresses, one `<ip> <address>[,<address>...]` per line")
+	mcrouterAdmin     = flag.String("mcrouter_admin_ports", "", "comma separated ports the mcrouters answer the admin commands at, to ask for their listening ports")
+	probeInterval     = flag.Duration("probe_interval", model.DefaultProbeInterval, "interval of probing the registered mcrouters")
+	probeFailures     = flag.Int("probe_failures", model.DefaultProbeFailures, "consecutive failed probes which evict a mcrouter")
+	memcachedKey      = flag.String("memcached_key", "MEMCACHED_HOT_KEYS", "memcached key of the hot keys")
+	serviceName       = flag.String("service_name", "mc_hotkeys", "consul service name")
+	secretsPath       = flag.String("secrets_path", "/etc/consul/mc_hotkeys.json", "vault secrets path")
+	mergeMode         = flag.String("merge", "sum", "merge of the same key's scores across reporters: sum, max or normalized")
+	summaryCapacity   = flag.Int("summary_capacity", 0, "number of keys summarized in each report beyond the topN for an accurate global topN, 0 disables summaries")
+	mergeSummaries    = flag.Bool("merge_summaries", false, "aggregates the reports' summaries instead of their topN")
+	exact             = flag.Bool("exact", false, "reporters answer and the aggregator runs the exact rounds for the exact global topN, which only merge by sum")
+	exactTimeout      = flag.Duration("exact_timeout", 0, "how long each exact round waits for the reporters, default 3 report intervals")
+	compression       = flag.String("compression", "none", "compression of the reports: none, gzip or snappy")
+	chunkBytes        = flag.Int("chunk_bytes", model.DefaultChunkBytes, "reports beyond this size are written in chunks")
+	fallbackServers   = flag.String("fallback_servers", "", "comma separated memcached/mcrouter servers to publish to when no mcrouter is known")
+	publishPools      = flag.String("publish_pools", "", "semicolon separated memcached pools to publish to directly instead of through mcrouter, each comma separated servers in the order of the mcrouter config")
+	poolsConfig       = flag.String("pools_config", "", "json file of the memcached pools and their hashes, to attribute the hot keys to their servers")
+	publishHash       = flag.String("publish_hash", "ch3", "hash of the publish pools as mcrouter's hash_func: ch3 (furc)")
+	discovery         = flag.String("discovery", "consul", "discovery of the reporters: consul, static, file, dns or memcached")
+	discoveryTarget   = flag.String("discovery_target", "", "comma separated identities for static, a file path for file, an SRV name for dns")
+	election          = flag.String("election", "consul", "election of the aggregating leader: consul, memcached or standalone")
+	region            = flag.String("region", "", "region of this reporter, with the zone it aggregates by zone, region and then globally")
+	zone              = flag.String("zone", "", "availability zone of this reporter in its region")
+	gossipPort        = flag.Int("gossip_port", 0, "listening port of the leaderless gossip aggregation, 0 aggregates by an elected leader")
+	gossipFanout      = flag.Int("gossip_fanout", model.DefaultGossipFanout, "number of peers to gossip with every aggregate interval")
+	gossipPublish     = flag.Bool("gossip_publish", false, "every gossiping instance also publishes its view to memcached")
+	httpPort          = flag.Int("http_port", 8990, "listening port of the http health check")
+	proxyUpstream     = flag.String("proxy_upstream", "", "memcached or mcrouter address the commands are forwarded to, which sees the real hits, misses and latency, empty eavesdrops instead")
+	proxyTimeout      = flag.Duration("proxy_timeout", mcrouter.DefaultUpstreamTimeout, "timeout of every command forwarded to the proxy upstream")
+	shieldBytes       = flag.Int("shield_bytes", 0, "memory cap of the proxy's cache of the hot keys, 0 disables the cache")
+	shieldTTL         = flag.Duration("shield_ttl", mcrouter.DefaultShieldTTL, "how long the proxy serves a hot key from its cache")
+	shieldStaleness   = flag.String("shield_staleness", "", "semicolon separated max staleness of the cached keys by prefix, e.g. user:=100ms;config:=5s, 0 never caches them")
 )
 
-func newEavesdropper() (model.RollingWindows, mcrouter.Eavesdropper) {
+// the mitigation of the keys which stay hot by the aggregating leader
+var (
+	mitigationStore    = flag.String("mitigation_store", "", "consul kv key the leader writes the route fragment of the mitigated keys to, which every mcrouter renders, e.g. consul:mcrouter/hotkeys, empty disables mitigation")
+	mitigationPools    = flag.String("mitigation_pools", "", "comma separated replicated pools the mitigated keys are routed to")
+	mitigationRouting  = flag.String("mitigation_routing", "", "json routing description of the mcrouter config, as `routing generate` takes, every key not mitigated is routed by it and a mitigated key is still written to its pool")
+	mitigationRounds   = flag.Int("mitigation_rounds", model.DefaultMitigationRounds, "aggregations in a row a key must be hot in to be mitigated")
+	mitigationMinScore = flag.Uint64("mitigation_min_score", 0, "least score of a key to count as hot for mitigation")
+	mitigationMaxKeys  = flag.Int("mitigation_max_keys", model.DefaultMitigationMaxKeys, "cap of the mitigated keys")
+	mitigationCooldown = flag.Duration("mitigation_cooldown", model.DefaultMitigationCooldown, "how long a key stays mitigated after it was last hot")
+	mitigationInterval = flag.Duration("mitigation_interval", model.DefaultMitigationInterval, "least time between two writes of the route fragment")
+)
+
+func newEavesdropper() (model.RollingWindows, *mcrouter.RollingWindowsMcrouterEavesdropper) {
 	buckets := (1 + runtime.NumCPU()) * 4 // at least 4 buckets
 	scorer := model.NewBucketKeyScorer(buckets, *minSlabBytes, time.Duration(*rollingWidth)*time.Minute)
 	rollingWindows := model.NewSimpleRollingWindows(scorer, func() model.GetKeyCounter {
 		return model.NewBucketGetKeyCounter(buckets)
 	}, *rollingWidth, *topN, *threshold)
+	if *summaryCapacity > 0 {
+		rollingWindows.EnableSummary(*summaryCapacity)
+	}
+	if *exact {
+		rollingWindows.EnableScores()
+	}
 	return rollingWindows, mcrouter.NewRollingWindowsMcrouterEavesdropper(rollingWindows, scorer)
 }
 
+func splitServers(servers string) []string {
+	split := []string{}
+	for _, server := range strings.Split(servers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			split = append(split, server)
+		}
+	}
+	return split
+}
+
+// newPublisher gives the publisher through the mcrouters of the `registry`, or directly to every memcached pool of `publish_pools`,
+// and the selector of the servers the reports are read from, the registry or its fallback, or the first pool
+func newPublisher(registry model.McrouterRegistry) (model.Publisher, memcache.ServerSelector, error) {
+	if *publishPools == "" {
+		publisher, err := model.NewResilientPublisher(registry, *reportInterval, splitServers(*fallbackServers)...)
+		if err != nil {
+			return nil, nil, err
+		}
+		// the items published to the fallback servers are read from there too
+		return publisher, publisher.Selector(), nil
+	}
+	hash, err := hashing.ParseHashFunc(*publishHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	publishers := model.FanoutPublisher{}
+	var first memcache.ServerSelector
+	for _, pool := range strings.Split(*publishPools, ";") {
+		servers := splitServers(pool)
+		if len(servers) == 0 {
+			continue
+		}
+		selector, err := hashing.NewPoolSelector(hash, servers...)
+		if err != nil {
+			return nil, nil, err
+		}
+		publisher, err := model.NewResilientPublisher(selector, *reportInterval)
+		if err != nil {
+			return nil, nil, err
+		}
+		if first == nil {
+			first = selector
+		}
+		publishers = append(publishers, publisher)
+	}
+	if first == nil {
+		return nil, nil, model.ErrNoRoute
+	}
+	return publishers, first, nil
+}
+
+// newMitigation gives the mitigation controller of `mitigation_store`, or nil when mitigation is disabled
+func newMitigation() (*model.MitigationController, error) {
+	if *mitigationStore == "" {
+		return nil, nil
+	}
+	// a local file would only reach the mcrouters of the leader's host, and outlive its leadership
+	parts := strings.SplitN(*mitigationStore, ":", 2)
+	if len(parts) != 2 || parts[0] != "consul" || parts[1] == "" {
+		return nil, fmt.Errorf("mitigation needs the shared consul store, not %s", *mitigationStore)
+	}
+	store := model.NewConsulFragmentStore(parts[1], model.NewConsulClient)
+	if *mitigationPools == "" || *mitigationRouting == "" {
+		return nil, fmt.Errorf("mitigation needs both the replicated pools and the routing description")
+	}
+	b, err := ioutil.ReadFile(*mitigationRouting)
+	if err != nil {
+		return nil, err
+	}
+	routing := mcrouter.RoutingDescription{}
+	if err = json.Unmarshal(b, &routing); err != nil {
+		return nil, err
+	}
+	// the fragment replaces the whole routing, its wildcard routes every other key as the generated config does
+	wildcard, err := routing.Route()
+	if err != nil {
+		return nil, err
+	}
+	pools := splitServers(*mitigationPools)
+	return model.NewMitigationController(model.MitigationOptions{
+		Target: func(key string) interface{} {
+			return model.ReplicatedTarget(routing.KeyRoute(key), pools...)
+		},
+		Wildcard: wildcard,
+		Rounds:   *mitigationRounds,
+		MinScore: *mitigationMinScore,
+		MaxKeys:  *mitigationMaxKeys,
+		Cooldown: *mitigationCooldown,
+		Interval: *mitigationInterval,
+	}, store), nil
+}
+
+// scopeMitigation gives the `mitigation` to the aggregator of every key only, the flat or the global tier
+func scopeMitigation(scope model.Scope, mitigation *model.MitigationController) *model.MitigationController {
+	if scope.Tier == model.FlatTier || scope.Tier == model.GlobalTier {
+		return mitigation
+	}
+	return nil
+}
+
+// newMcrouterResolver chains the configured mapping file, cidr rules and admin ports before the known `mcrouter_port`
+func newMcrouterResolver() (model.McrouterResolver, error) {
+	chain := model.ResolverChain{}
+	if *mcrouterMapping != "" {
+		resolver, err := model.NewFileResolver(*mcrouterMapping)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, resolver)
+	}
+	if *mcrouterCIDRs != "" {
+		rules, err := model.ParseCIDRRules(*mcrouterCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, model.NewCIDRResolver(rules))
+	}
+	if *mcrouterAdmin != "" {
+		ports := []int{}
+		for _, port := range splitServers(*mcrouterAdmin) {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, err
+			}
+			ports = append(ports, p)
+		}
+		chain = append(chain, model.NewAdminResolver(ports, time.Second))
+	}
+	return append(chain, model.NewPortResolver(*mcrouterPort)), nil
+}
+
+// newDiscovery gives the discovery of the reporters, it also registers or announces this reporter `member` to be discovered,
+// and gives how it leaves on termination, so that it's no longer discovered
+func newDiscovery(member model.Member, client *memcache.Client) (model.ReporterDiscovery, func(), error) {
+	leave := func() {}
+	switch *discovery {
+	case "consul":
+		consulClient, err := model.NewConsulClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		host, _, _ := net.SplitHostPort(member.Identity)
+		healthURL := fmt.Sprintf("http://%s:%d/health", host, *httpPort)
+		if serviceID, err := model.RegisterConsulService(consulClient, *serviceName, member, healthURL, 10*time.Second); err != nil {
+			// the reporter keeps reporting, only the leader won't find it
+			log.Warningf("cannot register %v in consul due to:%v\n", member, err)
+		} else {
+			leave = func() {
+				if err := model.DeregisterConsulService(consulClient, serviceID); err != nil {
+					log.Warningf("cannot deregister %s from consul due to:%v\n", serviceID, err)
+				}
+			}
+		}
+		return model.NewConsulDiscovery(*serviceName, consulClient), leave, nil
+	case "static":
+		return model.NewStaticDiscovery(splitServers(*discoveryTarget)...), leave, nil
+	case "file":
+		fileDiscovery, err := model.NewFileDiscovery(*discoveryTarget, 10*time.Second)
+		return fileDiscovery, leave, err
+	case "dns":
+		return model.NewDNSDiscovery(*discoveryTarget), leave, nil
+	case "memcached":
+		// members announce every 5 report intervals, and survive 2 missed announcements
+		membership := model.NewMemcachedMembership(model.MembershipKey(*memcachedKey), 15**reportInterval, client)
+		membership.StartAnnouncing(member, 5**reportInterval)
+		return membership, leave, nil
+	}
+	return nil, nil, fmt.Errorf("unknown discovery %s", *discovery)
+}
+
+// newElector gives the elector of the aggregating leader of the `scope`, a memcached lease is held as this reporter's `identity`,
+// a consul lock is rebuilt on every token rotation on `rotation`
+func newElector(scope model.Scope, identity string, client *memcache.Client, rotation <-chan struct{}) (model.Elector, error) {
+	leaderKey := model.LeaderKey(*serviceName, model.ScopeKey(*memcachedKey, scope))
+	switch *election {
+	case "consul":
+		return model.NewConsulElector(leaderKey, model.NewConsulClient, rotation)
+	case "memcached":
+		// a lost leader is replaced within 3 report intervals
+		return model.NewMemcachedLeaseElector(leaderKey, identity, 3**reportInterval, client), nil
+	case "standalone":
+		return model.NewStandaloneElector(), nil
+	}
+	return nil, fmt.Errorf("unknown election %s", *election)
+}
+
+// tokenRotations fans every consul token rotation out to `n` receivers
+func tokenRotations(n int) []<-chan struct{} {
+	rotations := make([]chan struct{}, n)
+	receivers := make([]<-chan struct{}, n)
+	for i := range rotations {
+		rotations[i] = make(chan struct{}, 1)
+		receivers[i] = rotations[i]
+	}
+	go func() {
+		for range model.ConsulTokenC {
+			for _, rotation := range rotations {
+				select {
+				case rotation <- struct{}{}:
+				default:
+					// a pending rotation already rebuilds with the latest token
+				}
+			}
+		}
+	}()
+	return receivers
+}
+
+// aggregatedScopes are the scopes this instance campaigns to aggregate, either the flat tier, or every tier it's in
+func aggregatedScopes() []model.Scope {
+	if *region == "" || *zone == "" {
+		return []model.Scope{{Tier: model.FlatTier}}
+	}
+	return []model.Scope{model.ZoneScope(*region, *zone), model.RegionScope(*region), model.GlobalScope}
+}
+
 func main() {
+	// `mc_hotkeys routing ...` generates or validates the mcrouter config, instead of eavesdropping
+	if len(os.Args) > 1 && os.Args[1] == "routing" {
+		os.Exit(routingCommand(os.Args[2:]))
+	}
 	// parse the flags
 	flag.Parse()
 
@@ -49,14 +331,192 @@ func main() {
 	// Close the listener when the application closes.
 	defer l.Close()
 	log.Infof("eavesdropper starts on %s:%d, rolling width:%d, topN:%d, threshold:%d\n", *host, *port, *rollingWidth, *topN, *threshold)
+	if *proxyUpstream != "" && *fallbackServers == "" {
+		// the proxy's clients aren't mcrouters to publish through, the upstream is
+		*fallbackServers = *proxyUpstream
+	}
+
+	go func() {
+		log.Errorf("health check stops due to:%v", http.ListenAndServe(fmt.Sprintf("%s:%d", *host, *httpPort), nil))
+	}()
 
 	notFound := model.ReadEvery(*secretsPath, 10*time.Minute)
 	rollingWindows, eavesdropper := newEavesdropper()
-	mcrouterRegistry := model.NewMcrouterRegistry(*mcrouterPort)
-	model.NewMemcachedHotKeyReporter(rollingWindows, model.ReporterIdentity(*host, *port), *memcachedKey, *topN, mcrouterRegistry)
-	if notFound == nil {
-		model.NewMemcachedHotKeyAggregator(*serviceName, *memcachedKey, *topN, *rollingWidth, mcrouterRegistry)
+	var proxy *mcrouter.Proxy
+	var shield *mcrouter.ShieldCache
+	if *proxyUpstream != "" {
+		proxy = mcrouter.NewProxy(*proxyUpstream, *proxyTimeout, eavesdropper)
+		log.Infof("proxies to %s\n", *proxyUpstream)
+		if *shieldBytes > 0 {
+			staleness, err := mcrouter.ParseStalenessRules(*shieldStaleness)
+			if err != nil {
+				log.Errorf("cannot parse the shield staleness %s due to:%v", *shieldStaleness, err)
+				os.Exit(1)
+			}
+			shield = mcrouter.NewShieldCache(mcrouter.ShieldOptions{TTL: *shieldTTL, MaxBytes: *shieldBytes, Staleness: staleness})
+			proxy.EnableShield(shield)
+			http.HandleFunc("/shield", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(shield.Stats())
+			})
+		}
+	}
+	mcrouterResolver, err := newMcrouterResolver()
+	if err != nil {
+		log.Errorf("cannot resolve mcrouters due to:%v", err)
+		os.Exit(1)
+	}
+	mcrouterRegistry := model.NewResolvedMcrouterRegistry(mcrouterResolver)
+	mcrouterRegistry.StartProbing(*probeInterval, *probeFailures)
+	http.HandleFunc("/mcrouters", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"members":    mcrouterRegistry.Members(),
+			"rejections": mcrouterRegistry.Rejections(),
+		})
+	})
+	publisher, selector, err := newPublisher(mcrouterRegistry)
+	if err != nil {
+		log.Errorf("cannot publish due to:%v", err)
+		os.Exit(1)
+	}
+	reportCompression, err := model.ParseCompression(*compression)
+	if err != nil {
+		log.Errorf("cannot compress reports with %s due to:%v", *compression, err)
+		os.Exit(1)
+	}
+	codec := model.NewValueCodec(reportCompression, *chunkBytes)
+	scheduler := model.NewRollScheduler(rollingWindows, model.RollInterval)
+	identity := model.ReporterIdentity(*host, *port)
+	reporter := model.NewMemcachedHotKeyReporter(identity, *memcachedKey, *topN, *reportInterval, codec, publisher)
+	if *region != "" && *zone != "" {
+		reporter.Label(*region, *zone)
+	}
+	if *exact {
+		reporter.EnableExact(memcache.NewFromSelector(selector), model.DefaultScoresHistory)
 	}
+	// healthy as long as the reports are published, and till it's terminated
+	leaving := int32(0)
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case atomic.LoadInt32(&leaving) != 0:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "leaving")
+		case !reporter.Healthy():
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "reports not published")
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+	reporterDiscovery, leave, err := newDiscovery(model.Member{Identity: identity, Region: *region, Zone: *zone}, memcache.NewFromSelector(selector))
+	if err != nil {
+		log.Errorf("cannot discover reporters by %s due to:%v", *discovery, err)
+		os.Exit(1)
+	}
+	scheduler.Subscribe(reporter, *reportInterval)
+	if shield != nil {
+		// the shield follows the hot keys of every roll
+		scheduler.Subscribe(shield, model.RollInterval)
+	}
+	if *logReport {
+		scheduler.Subscribe(model.NewLoggingHotKeyReporter(), *reportInterval)
+	}
+	if *aggregateInterval <= 0 {
+		*aggregateInterval = time.Duration(*rollingWidth) * model.RollInterval
+	}
+	if *exactTimeout <= 0 {
+		*exactTimeout = 3 * *reportInterval
+	}
+	merge, err := model.ParseMergeMode(*mergeMode)
+	if err != nil {
+		log.Errorf("cannot merge reports by %s due to:%v", *mergeMode, err)
+		os.Exit(1)
+	}
+	if *gossipPort > 0 {
+		// peers gossip at the same host as their reporters, on the same gossip port
+		gossip, err := model.NewGossipAggregator(context.Background(), identity, *memcachedKey, fmt.Sprintf("%s:%d", *host, *gossipPort), func(member model.Member) string {
+			host, _, _ := net.SplitHostPort(member.Identity)
+			return fmt.Sprintf("%s:%d", host, *gossipPort)
+		}, model.GossipOptions{
+			TopN:           *topN,
+			MergeMode:      merge,
+			MergeSummaries: *mergeSummaries,
+			Interval:       *aggregateInterval,
+			Fanout:         *gossipFanout,
+			// a report spreads over a few rounds, it's only stale once it missed 2 of them
+			Staleness: time.Duration(model.ReportTTL(*aggregateInterval)) * time.Second,
+			Publish:   *gossipPublish,
+		}, selector, reporterDiscovery, codec, publisher)
+		if err != nil {
+			log.Errorf("cannot gossip on port %d due to:%v", *gossipPort, err)
+			os.Exit(1)
+		}
+		scheduler.Subscribe(gossip, *reportInterval)
+		http.Handle("/hotkeys", gossip)
+	}
+	scheduler.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	aggregators := []*model.MemcachedHotKeyAggregator{}
+	scopes := aggregatedScopes()
+	// the rotations are drained even without an elector to rebuild, the secrets reload blocks on every undrained rotation
+	rotations := tokenRotations(len(scopes))
+	// only the consul discovery and election depend on the secrets, and gossiping needs no election
+	if *gossipPort == 0 && (notFound == nil || (*discovery != "consul" && *election != "consul")) {
+		var shards model.ShardAttributor
+		if *poolsConfig != "" {
+			loaded, err := hashing.LoadShards(*poolsConfig)
+			if err != nil {
+				log.Errorf("cannot load the pools of %s due to:%v", *poolsConfig, err)
+				os.Exit(1)
+			}
+			shards = loaded
+		}
+		mitigation, err := newMitigation()
+		if err != nil {
+			log.Errorf("cannot mitigate due to:%v", err)
+			os.Exit(1)
+		}
+		for i, scope := range scopes {
+			elector, err := newElector(scope, identity, memcache.NewFromSelector(selector), rotations[i])
+			if err != nil {
+				log.Errorf("cannot elect the leader by %s due to:%v", *election, err)
+				os.Exit(1)
+			}
+			aggregator, err := model.NewMemcachedHotKeyAggregator(ctx, *serviceName, *memcachedKey, model.AggregatorOptions{
+				TopN:           *topN,
+				MergeMode:      merge,
+				MergeSummaries: *mergeSummaries,
+				Interval:       *aggregateInterval,
+				ReportInterval: *reportInterval,
+				Exact:          *exact,
+				ExactTimeout:   *exactTimeout,
+				Scope:          scope,
+				Shards:         shards,
+				Mitigation:     scopeMitigation(scope, mitigation),
+			}, selector, reporterDiscovery, elector, codec, publisher)
+			if err != nil {
+				log.Errorf("cannot aggregate by %s due to:%v", *mergeMode, err)
+				os.Exit(1)
+			}
+			aggregators = append(aggregators, aggregator)
+		}
+	}
+
+	// leaves the discovery, and steps down on termination, so that another aggregator takes over without waiting for the lock to expire
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Infof("stops on signal:%v\n", <-signals)
+		atomic.StoreInt32(&leaving, 1)
+		leave()
+		cancel()
+		for _, aggregator := range aggregators {
+			<-aggregator.Done()
+		}
+		log.Flush()
+		os.Exit(0)
+	}()
 
 	for {
 		// Listen for an incoming connection.
@@ -66,6 +526,10 @@ func main() {
 		} else {
 			remoteAddr := conn.RemoteAddr()
 			log.Infof("accepted connection from:%v\n", remoteAddr)
+			if proxy != nil {
+				go mcrouter.ServeProxy(conn, proxy)
+				continue
+			}
 			mcrouterRegistry.Register(remoteAddr.String())
 			// Handle connections in a new goroutine.
 			go func() {
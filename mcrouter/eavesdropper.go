@@ -102,6 +102,20 @@ func (eavesdropper *RollingWindowsMcrouterEavesdropper) OnDelete(key string) {
 	eavesdropper.keyScorer.DelScore(key)
 }
 
+// OnFetched records the outcome of a fetch a `Proxy` relayed, a hit scores the key by the size of its value without waiting for a `SET`,
+// unless its size is unknown, e.g. a meta `mg` answered `HD` without the value or its size, which is a negative `bytes`
+func (eavesdropper *RollingWindowsMcrouterEavesdropper) OnFetched(key string, hit bool, bytes int, latency time.Duration) {
+	if bytes < 0 {
+		eavesdropper.rollingWindows.Observe(key, hit, 0, latency)
+		return
+	}
+	eavesdropper.rollingWindows.Observe(key, hit, bytes, latency)
+	if hit {
+		// a `GET` doesn't tell the expiration, the size scores the key for a while, or till a `SET` or `DELETE` tells better
+		eavesdropper.keyScorer.SetScore(key, uint64(bytes), time.Now().Add(FetchedScoreTTL).Unix())
+	}
+}
+
 // NewRollingWindowsMcrouterEavesdropper initializes a `RollingWindowsMcrouterEavesdropper`
 func NewRollingWindowsMcrouterEavesdropper(rollingWindows model.RollingWindows, keyScorer model.KeyScorer) *RollingWindowsMcrouterEavesdropper {
 
@@ -126,7 +140,7 @@ func NewRollingWindowsMcrouterEavesdropper(rollingWindows model.RollingWindows,
 }
 
 // Eavesdropping on mcrouter `GET|GETS|SET|ADD|CAS|REPLACE|DELETE` commands by using `mcrouter` routing
-// the routing policy looks like this:
+// the routing policy looks like this, `GenerateRouting` generates it and `ValidateRouting` checks an existing config against it:
 /*
 {
   "macros": {
@@ -185,6 +199,29 @@ func skipN(scanner *bufio.Scanner, n int) error {
 	return ErrParse
 }
 
+// parseMetaStore parses `ms <key> <datalen> <flags>*`, whose `T<ttl>` flag is the exptime
+func parseMetaStore(args []string) (string, int, int64, error) {
+	if len(args) < 2 {
+		return "", 0, 0, ErrParse
+	}
+	bytes, err := strconv.Atoi(args[1])
+	if err != nil || bytes < 0 {
+		return "", 0, 0, ErrParse
+	}
+	exptime := int64(0)
+	for _, flag := range args[2:] {
+		if strings.HasPrefix(flag, "T") {
+			if exptime, err = strconv.ParseInt(flag[1:], 10, 64); err != nil {
+				return "", 0, 0, ErrParse
+			}
+		}
+	}
+	if exptime > 0 && exptime <= MAX_EXPIRE_SECONDS {
+		exptime = time.Now().Unix() + exptime
+	}
+	return args[0], bytes, exptime, nil
+}
+
 func parseStore(args []string) (string, int, int64, error) {
 	if len(args) < 4 {
 		return "", 0, 0, ErrParse
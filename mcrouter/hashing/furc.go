@@ -0,0 +1,95 @@
+package hashing
+
+import "encoding/binary"
+
+const (
+	murmurMultiplier = 0xc6a4a7935bd1e995
+	murmurShift      = 47
+	// murmurSeed is mcrouter's `MURMUR_SEED`, which seeds the key's hash and every rehash of furc
+	murmurSeed = 4193360111
+	// furcShift is the distance between the bits furc draws from the key's hashes
+	furcShift = 23
+	// furcMaxTries bounds the tries of furc before it gives up on a key and gives 0
+	furcMaxTries = 32
+	// FurcMaxPoolSize is the largest pool furc distributes the keys of evenly
+	FurcMaxPoolSize = 1 << furcShift
+)
+
+// murmur64A is MurmurHash64A, little endian as mcrouter computes it on x86
+func murmur64A(key []byte, seed uint64) uint64 {
+	h := seed ^ (uint64(len(key)) * murmurMultiplier)
+	for ; len(key) >= 8; key = key[8:] {
+		k := binary.LittleEndian.Uint64(key)
+		k *= murmurMultiplier
+		k ^= k >> murmurShift
+		k *= murmurMultiplier
+		h ^= k
+		h *= murmurMultiplier
+	}
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * uint(i))
+		}
+		h *= murmurMultiplier
+	}
+	h ^= h >> murmurShift
+	h *= murmurMultiplier
+	h ^= h >> murmurShift
+	return h
+}
+
+// murmurRehash64A is `murmur64A` of the 8 bytes of `k`, seeded as furc seeds it
+func murmurRehash64A(k uint64) uint64 {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, k)
+	return murmur64A(b, murmurSeed)
+}
+
+// furcBits draws the bits of a key from a chain of its hashes, each hash gives 64 bits, and is computed only once needed
+type furcBits struct {
+	key    []byte
+	hashes []uint64
+}
+
+func (bits *furcBits) bit(index uint32) uint32 {
+	ord := int(index >> 6)
+	for n := len(bits.hashes); n <= ord; n++ {
+		if n == 0 {
+			bits.hashes = append(bits.hashes, murmur64A(bits.key, murmurSeed))
+		} else {
+			bits.hashes = append(bits.hashes, murmurRehash64A(bits.hashes[n-1]))
+		}
+	}
+	return uint32(bits.hashes[ord]>>(index&0x3f)) & 0x1
+}
+
+// Furc is mcrouter's `furc_hash`, the consistent hash of `key` among `m` servers,
+// growing the pool from m to m+1 servers moves only about 1/(m+1) of the keys, and all to the new server
+func Furc(key []byte, m uint32) uint32 {
+	if m <= 1 {
+		return 0
+	}
+	var d uint32
+	for d = 0; uint64(m) > uint64(1)<<d; d++ {
+	}
+	bits := &furcBits{key: key}
+	a := d
+	for try := 0; try < furcMaxTries; try++ {
+		for bits.bit(a) == 0 {
+			if d--; d == 0 {
+				return 0
+			}
+			a = d
+		}
+		a += furcShift
+		num := uint32(1)
+		for i := uint32(0); i < d-1; i++ {
+			num = (num << 1) | bits.bit(a)
+			a += furcShift
+		}
+		if num < m {
+			return num
+		}
+	}
+	return 0
+}
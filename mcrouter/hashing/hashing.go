@@ -0,0 +1,166 @@
+package hashing
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// ErrUnknownHash is an error when a hash function isn't one mcrouter knows
+var ErrUnknownHash = errors.New("unknown hash function")
+
+const (
+	// HashStop ends the part of a key mcrouter hashes, e.g. `user:1|#|profile` lands where `user:1` does
+	HashStop = "|#|"
+	// WeightedCh3Tries bounds the rehashes of a key by `WeightedCh3`
+	WeightedCh3Tries = 32
+	// weightedCh3Seed is the seed of the spooky hash `WeightedCh3` weighs the keys by
+	weightedCh3Seed = 0xface2014
+)
+
+// HashFunc picks the index of the server of `key` in a pool of `n` servers, the same as the mcrouter hash of the same name
+type HashFunc func(key string, n int) int
+
+// Ch3 is mcrouter's `Ch3` hash, which is `furc_hash` of the whole key
+func Ch3(key string, n int) int {
+	return int(Furc([]byte(key), uint32(n)))
+}
+
+// Crc32 is mcrouter's `Crc32` hash, the upper 15 bits of the crc32 of the key modulo the pool size
+func Crc32(key string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	return int((crc32.ChecksumIEEE([]byte(key))>>16)&0x7fff) % n
+}
+
+// WeightedCh3 is mcrouter's `WeightedCh3` hash of a pool whose servers take `weights` in [0, 1] of their ch3 share,
+// a key landing on a server beyond its weight is salted and rehashed, up to `WeightedCh3Tries` times
+func WeightedCh3(weights []float64) HashFunc {
+	return func(key string, n int) int {
+		if n <= 1 || len(weights) < n {
+			return Ch3(key, n)
+		}
+		index, hashed, salt := 0, []byte(key), 0
+		for try := 0; try < WeightedCh3Tries; try++ {
+			index = int(Furc(hashed, uint32(n)))
+			// the 32 bits hash and the weight are compared as 64 bits integers as mcrouter does
+			p := uint64(SpookyHash32(hashed, weightedCh3Seed))
+			if w := uint64(weights[index] * math.MaxUint32); p < w {
+				return index
+			}
+			// the salt's decimal digits are appended from the least significant one
+			hashed = []byte(key)
+			for s := salt; ; s /= 10 {
+				hashed = append(hashed, byte('0'+s%10))
+				if s < 10 {
+					break
+				}
+			}
+			salt++
+		}
+		return index
+	}
+}
+
+// NewHashFunc gives the hash function of a mcrouter pool's `hash_func`, `ch3` (or `furc`), `crc32`, or `wch3` (`WeightedCh3`) of the `weights`
+func NewHashFunc(name string, weights []float64) (HashFunc, error) {
+	switch strings.ToLower(name) {
+	case "ch3", "furc":
+		return Ch3, nil
+	case "crc32":
+		return Crc32, nil
+	case "wch3", "weightedch3":
+		return WeightedCh3(weights), nil
+	}
+	return nil, ErrUnknownHash
+}
+
+// ParseHashFunc gives the unweighted hash function of a mcrouter pool's `hash_func`, see `NewHashFunc`
+func ParseHashFunc(name string) (HashFunc, error) {
+	return NewHashFunc(name, nil)
+}
+
+// HashedKey is the part of `key` mcrouter hashes, everything before the first `HashStop`
+func HashedKey(key string) string {
+	if stop := strings.Index(key, HashStop); stop >= 0 {
+		return key[:stop]
+	}
+	return key
+}
+
+// PoolSelector picks the memcached server of a key as a mcrouter pool of the same servers in the same order and the same hash does,
+// so that what's written directly lands where mcrouter reads it
+type PoolSelector struct {
+	m       sync.RWMutex
+	hash    HashFunc
+	servers []net.Addr
+}
+
+// SetServers replaces the servers of the pool, in the order the mcrouter config lists them
+func (poolSelector *PoolSelector) SetServers(servers ...string) error {
+	addrs := make([]net.Addr, 0, len(servers))
+	for _, server := range servers {
+		if strings.Contains(server, "/") {
+			addr, err := net.ResolveUnixAddr("unix", server)
+			if err != nil {
+				return err
+			}
+			addrs = append(addrs, addr)
+			continue
+		}
+		addr, err := net.ResolveTCPAddr("tcp", server)
+		if err != nil {
+			return fmt.Errorf("cannot resolve %s: %v", server, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	poolSelector.m.Lock()
+	defer poolSelector.m.Unlock()
+	poolSelector.servers = addrs
+	return nil
+}
+
+// Index gives the index of the server of `key` in the pool
+func (poolSelector *PoolSelector) Index(key string) (int, error) {
+	poolSelector.m.RLock()
+	defer poolSelector.m.RUnlock()
+	if len(poolSelector.servers) == 0 {
+		return 0, memcache.ErrNoServers
+	}
+	return poolSelector.hash(HashedKey(key), len(poolSelector.servers)), nil
+}
+
+// PickServer picks the server of `key`
+func (poolSelector *PoolSelector) PickServer(key string) (net.Addr, error) {
+	poolSelector.m.RLock()
+	defer poolSelector.m.RUnlock()
+	if len(poolSelector.servers) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	return poolSelector.servers[poolSelector.hash(HashedKey(key), len(poolSelector.servers))], nil
+}
+
+// Each iterates every server of the pool
+func (poolSelector *PoolSelector) Each(f func(net.Addr) error) error {
+	poolSelector.m.RLock()
+	defer poolSelector.m.RUnlock()
+	for _, addr := range poolSelector.servers {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewPoolSelector initializes a `PoolSelector` of the `servers` hashed by `hash`
+func NewPoolSelector(hash HashFunc, servers ...string) (*PoolSelector, error) {
+	poolSelector := &PoolSelector{m: sync.RWMutex{}, hash: hash}
+	return poolSelector, poolSelector.SetServers(servers...)
+}
@@ -0,0 +1,184 @@
+package hashing
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFurcConsistency(t *testing.T) {
+
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+	for _, key := range keys {
+		if Ch3(key, 1) != 0 || Ch3(key, 0) != 0 {
+			panic("a single server pool should take every key")
+		}
+	}
+	for n := 2; n <= 20; n++ {
+		counts := make([]int, n+1)
+		moved := 0
+		for _, key := range keys {
+			before, after := Ch3(key, n), Ch3(key, n+1)
+			if before < 0 || before >= n || before != Ch3(key, n) {
+				panic("furc should be deterministic and within the pool")
+			}
+			if before != after {
+				if after != n {
+					panic("growing the pool should move keys only to the new server")
+				}
+				moved++
+			}
+			counts[after]++
+		}
+		if expected := len(keys) / (n + 1); moved < expected/2 || moved > expected*2 {
+			panic(fmt.Sprintf("growing %d servers should move about 1/%d of the keys, moved:%d", n, n+1, moved))
+		}
+		for _, count := range counts {
+			if expected := len(keys) / (n + 1); count < expected/2 || count > expected*2 {
+				panic("furc should spread the keys evenly")
+			}
+		}
+	}
+}
+
+func TestFurcKnownAnswers(t *testing.T) {
+
+	// the indexes mcrouter's `furc_hash` gives the keys in the pools of the sizes
+	sizes := []int{2, 3, 5, 10, 17, 100, 1000, FurcMaxPoolSize}
+	expected := map[string][]int{
+		"":                           {1, 1, 1, 8, 12, 72, 72, 6173600},
+		"a":                          {1, 1, 4, 4, 13, 34, 900, 7695180},
+		"foo":                        {1, 1, 1, 1, 1, 1, 478, 7448656},
+		"hello":                      {0, 0, 0, 9, 9, 96, 575, 4189030},
+		"user:1":                     {0, 0, 0, 0, 0, 41, 471, 870740},
+		"MEMCACHED_HOT_KEYS":         {1, 2, 2, 2, 15, 21, 898, 5694950},
+		"key:12345":                  {1, 2, 3, 3, 3, 21, 234, 5075508},
+		"abcdefgh":                   {0, 2, 2, 8, 8, 28, 257, 6241930},
+		"abcdefghijklmnopqrstuvwxyz": {0, 0, 0, 9, 9, 27, 113, 7051136},
+	}
+	if murmur64A([]byte("foo"), murmurSeed) != 0x649c5afd3a8f4a03 || murmurRehash64A(1) != 0x3650aac745960306 {
+		panic("murmur should be seeded with mcrouter's seed")
+	}
+	for key, indexes := range expected {
+		for i, n := range sizes {
+			if index := Ch3(key, n); index != indexes[i] {
+				panic(fmt.Sprintf("furc of %q among %d servers should be %d, not %d", key, n, indexes[i], index))
+			}
+		}
+	}
+}
+
+func TestPoolSelector(t *testing.T) {
+
+	if _, err := ParseHashFunc("md5"); err != ErrUnknownHash {
+		panic("only mcrouter's hash functions should be known")
+	}
+	selector, err := NewPoolSelector(Ch3, "127.0.0.1:11211", "127.0.0.1:11212", "127.0.0.1:11213")
+	if err != nil {
+		panic("pool selector should resolve its servers")
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("MEMCACHED_HOT_KEYS:%d", i)
+		hashed, _ := selector.PickServer(key)
+		stopped, _ := selector.PickServer(key + HashStop + "suffix")
+		if hashed.String() != stopped.String() {
+			panic("only the part of a key before the hash stop should be hashed")
+		}
+		if index, _ := selector.Index(key); hashed.String() != fmt.Sprintf("127.0.0.1:%d", 11211+index) {
+			panic("the server picked should be the one at the hashed index")
+		}
+	}
+}
+
+func TestSpookyHash32(t *testing.T) {
+
+	// the first results of SpookyHash V2's own test, of the bytes 128, 129, ... of every length
+	expected := []uint32{0x6bf50919, 0x70de1d26, 0xa2b37298, 0x35bc5fbf, 0x8223b279, 0x5bcb315e, 0x53fe88a1, 0xf9f1a233, 0xee193982, 0x54f86f29}
+	message := make([]byte, 256)
+	for i := range message {
+		message[i] = byte(i + 128)
+	}
+	for length, hash := range expected {
+		if SpookyHash32(message[:length], 0) != hash {
+			panic(fmt.Sprintf("spooky hash of %d bytes should be %#x", length, hash))
+		}
+	}
+	if SpookyHash32(message[:200], 0) == SpookyHash32(message[:201], 0) {
+		panic("long messages should hash differently")
+	}
+}
+
+func TestCrc32AndWeightedCh3(t *testing.T) {
+
+	// crc32 of 123456789 is 0xcbf43926
+	if Crc32("123456789", 1<<16) != 0x4bf4 {
+		panic("crc32 should hash by the upper 15 bits of the crc")
+	}
+	weighted := WeightedCh3([]float64{1, 0, 1, 1})
+	unweighted := WeightedCh3([]float64{1, 1, 1, 1})
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if weighted(key, 4) == 1 {
+			panic("a server weighing 0 shouldn't take any key")
+		}
+		if unweighted(key, 4) != Ch3(key, 4) {
+			panic("full weights should hash as ch3")
+		}
+	}
+	if _, err := NewHashFunc("WeightedCh3", []float64{1}); err != nil {
+		panic("mcrouter's hash names should be known")
+	}
+}
+
+func TestCrc32AndWeightedCh3KnownAnswers(t *testing.T) {
+
+	// the indexes mcrouter's `Crc32HashFunc` gives the keys among 7 servers, and its `WeightedCh3HashFunc` among 5 servers of the weights
+	weights := []float64{1, 0.5, 0.1, 0.9, 0}
+	expected := map[string][2]int{
+		"":                           {0, 1},
+		"a":                          {4, 3},
+		"foo":                        {2, 0},
+		"hello":                      {1, 0},
+		"user:1":                     {6, 0},
+		"MEMCACHED_HOT_KEYS":         {4, 3},
+		"key:12345":                  {1, 3},
+		"abcdefgh":                   {3, 0},
+		"abcdefghijklmnopqrstuvwxyz": {0, 0},
+	}
+	weighted := WeightedCh3(weights)
+	for key, indexes := range expected {
+		if index := Crc32(key, 7); index != indexes[0] {
+			panic(fmt.Sprintf("crc32 of %q among 7 servers should be %d, not %d", key, indexes[0], index))
+		}
+		if index := weighted(key, len(weights)); index != indexes[1] {
+			panic(fmt.Sprintf("wch3 of %q among %v should be %d, not %d", key, weights, indexes[1], index))
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+
+	if _, err := NewShards(PoolsConfig{Pools: map[string]PoolConfig{"a": {Servers: []string{"a1"}}}, Routes: []PrefixRoute{{Prefix: "x", Pool: "b"}}}); err != ErrUnknownPool {
+		panic("routes should be to known pools")
+	}
+	shards, err := NewShards(PoolsConfig{
+		Pools: map[string]PoolConfig{
+			"main": {Servers: []string{"m1:11211", "m2:11211", "m3:11211"}},
+			"user": {Servers: []string{"u1:11211", "u2:11211"}, Hash: HashConfig{HashFunc: "crc32"}},
+		},
+		Routes:  []PrefixRoute{{Prefix: "u", Pool: "main"}, {Prefix: "user:", Pool: "user"}},
+		Default: "main",
+	})
+	if err != nil {
+		panic("shards should be initialized")
+	}
+	// mcrouter routes `user:1` to the second of the 2 crc32 servers, and `page:1` to the second of the 3 ch3 servers
+	if pool, server, ok := shards.Attribute("user:1|#|profile"); !ok || pool != "user" || server != "u2:11211" {
+		panic("the longest prefix should route the key, hashed till the hash stop")
+	}
+	if pool, server, ok := shards.Attribute("page:1"); !ok || pool != "main" || server != "m2:11211" {
+		panic("keys of no route should go to the default pool")
+	}
+}
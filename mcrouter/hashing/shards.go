@@ -0,0 +1,128 @@
+package hashing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrUnknownPool is an error when a route or the default names a pool the config doesn't define
+var ErrUnknownPool = errors.New("unknown pool")
+
+// HashConfig is the `hash` of a mcrouter route to a pool
+type HashConfig struct {
+	HashFunc string    `json:"hash_func"`
+	Weights  []float64 `json:"weights,omitempty"`
+}
+
+// PoolConfig is a memcached pool as mcrouter's config lists it, with the hash of the route to it, `ch3` by default
+type PoolConfig struct {
+	Servers []string   `json:"servers"`
+	Hash    HashConfig `json:"hash"`
+}
+
+// PrefixRoute routes the keys starting with `Prefix` to the `Pool`, the longest matching prefix wins as mcrouter's `PrefixSelectorRoute`
+type PrefixRoute struct {
+	Prefix string `json:"prefix"`
+	Pool   string `json:"pool"`
+}
+
+// PoolsConfig is the pools file, e.g.
+// `{"pools": {"main": {"servers": ["10.0.0.1:11211", "10.0.0.2:11211"], "hash": {"hash_func": "WeightedCh3", "weights": [1, 0.5]}}},
+// "routes": [{"prefix": "user:", "pool": "main"}], "default": "main"}`
+type PoolsConfig struct {
+	Pools   map[string]PoolConfig `json:"pools"`
+	Routes  []PrefixRoute         `json:"routes,omitempty"`
+	Default string                `json:"default,omitempty"`
+}
+
+type shardPool struct {
+	servers []string
+	hash    HashFunc
+}
+
+// Shards attributes the keys to the pool and the server mcrouter routes them to
+type Shards struct {
+	pools   map[string]*shardPool
+	routes  []PrefixRoute
+	fixed   string
+	servers map[string]int
+}
+
+// Pool gives the pool a key is routed to, by the longest matching prefix, or the default, or the only pool
+func (shards *Shards) Pool(key string) (string, bool) {
+	pool, matched := shards.fixed, -1
+	for _, route := range shards.routes {
+		if len(route.Prefix) > matched && strings.HasPrefix(key, route.Prefix) {
+			pool, matched = route.Pool, len(route.Prefix)
+		}
+	}
+	return pool, pool != ""
+}
+
+// Attribute gives the pool and the server of `key`
+func (shards *Shards) Attribute(key string) (string, string, bool) {
+	name, ok := shards.Pool(key)
+	if !ok {
+		return "", "", false
+	}
+	pool := shards.pools[name]
+	if len(pool.servers) == 0 {
+		return name, "", false
+	}
+	return name, pool.servers[pool.hash(HashedKey(key), len(pool.servers))], true
+}
+
+// Servers gives the number of servers of every pool
+func (shards *Shards) Servers() map[string]int {
+	return shards.servers
+}
+
+// NewShards initializes `Shards` of the `config`
+func NewShards(config PoolsConfig) (*Shards, error) {
+	shards := &Shards{pools: map[string]*shardPool{}, routes: config.Routes, fixed: config.Default, servers: map[string]int{}}
+	for name, pool := range config.Pools {
+		hashFunc := pool.Hash.HashFunc
+		if hashFunc == "" {
+			hashFunc = "ch3"
+		}
+		hash, err := NewHashFunc(hashFunc, pool.Hash.Weights)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %v", name, err)
+		}
+		if len(pool.Hash.Weights) > 0 && len(pool.Hash.Weights) != len(pool.Servers) {
+			return nil, fmt.Errorf("pool %s has %d weights of %d servers", name, len(pool.Hash.Weights), len(pool.Servers))
+		}
+		shards.pools[name] = &shardPool{servers: pool.Servers, hash: hash}
+		shards.servers[name] = len(pool.Servers)
+	}
+	if shards.fixed == "" && len(config.Pools) == 1 {
+		for name := range config.Pools {
+			shards.fixed = name
+		}
+	}
+	if _, ok := shards.pools[shards.fixed]; !ok && shards.fixed != "" {
+		return nil, ErrUnknownPool
+	}
+	for _, route := range config.Routes {
+		if _, ok := shards.pools[route.Pool]; !ok {
+			return nil, ErrUnknownPool
+		}
+	}
+	return shards, nil
+}
+
+// LoadShards loads the pools file at `path`, see `PoolsConfig`
+func LoadShards(path string) (*Shards, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := PoolsConfig{}
+	if err = json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+	return NewShards(config)
+}
@@ -0,0 +1,185 @@
+package hashing
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	spookyVars      = 12
+	spookyBlockSize = spookyVars * 8
+	spookyBufSize   = 2 * spookyBlockSize
+	spookyConst     = 0xdeadbeefdeadbeef
+)
+
+// le reads up to 8 bytes as a little endian integer
+func le(b []byte) uint64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+func spookyShortMix(h0, h1, h2, h3 uint64) (uint64, uint64, uint64, uint64) {
+	h2 = bits.RotateLeft64(h2, 50)
+	h2 += h3
+	h0 ^= h2
+	h3 = bits.RotateLeft64(h3, 52)
+	h3 += h0
+	h1 ^= h3
+	h0 = bits.RotateLeft64(h0, 30)
+	h0 += h1
+	h2 ^= h0
+	h1 = bits.RotateLeft64(h1, 41)
+	h1 += h2
+	h3 ^= h1
+	h2 = bits.RotateLeft64(h2, 54)
+	h2 += h3
+	h0 ^= h2
+	h3 = bits.RotateLeft64(h3, 48)
+	h3 += h0
+	h1 ^= h3
+	h0 = bits.RotateLeft64(h0, 38)
+	h0 += h1
+	h2 ^= h0
+	h1 = bits.RotateLeft64(h1, 37)
+	h1 += h2
+	h3 ^= h1
+	h2 = bits.RotateLeft64(h2, 62)
+	h2 += h3
+	h0 ^= h2
+	h3 = bits.RotateLeft64(h3, 34)
+	h3 += h0
+	h1 ^= h3
+	h0 = bits.RotateLeft64(h0, 5)
+	h0 += h1
+	h2 ^= h0
+	h1 = bits.RotateLeft64(h1, 36)
+	h1 += h2
+	h3 ^= h1
+	return h0, h1, h2, h3
+}
+
+func spookyShortEnd(h0, h1, h2, h3 uint64) (uint64, uint64) {
+	h3 ^= h2
+	h2 = bits.RotateLeft64(h2, 15)
+	h3 += h2
+	h0 ^= h3
+	h3 = bits.RotateLeft64(h3, 52)
+	h0 += h3
+	h1 ^= h0
+	h0 = bits.RotateLeft64(h0, 26)
+	h1 += h0
+	h2 ^= h1
+	h1 = bits.RotateLeft64(h1, 51)
+	h2 += h1
+	h3 ^= h2
+	h2 = bits.RotateLeft64(h2, 28)
+	h3 += h2
+	h0 ^= h3
+	h3 = bits.RotateLeft64(h3, 9)
+	h0 += h3
+	h1 ^= h0
+	h0 = bits.RotateLeft64(h0, 47)
+	h1 += h0
+	h2 ^= h1
+	h1 = bits.RotateLeft64(h1, 54)
+	h2 += h1
+	h3 ^= h2
+	h2 = bits.RotateLeft64(h2, 32)
+	h3 += h2
+	h0 ^= h3
+	h3 = bits.RotateLeft64(h3, 25)
+	h0 += h3
+	h1 ^= h0
+	h0 = bits.RotateLeft64(h0, 63)
+	h1 += h0
+	return h0, h1
+}
+
+// spookyShort hashes messages shorter than `spookyBufSize`
+func spookyShort(message []byte, hash1, hash2 uint64) (uint64, uint64) {
+	length := len(message)
+	a, b, c, d := hash1, hash2, uint64(spookyConst), uint64(spookyConst)
+	if length > 15 {
+		for ; len(message) >= 32; message = message[32:] {
+			c += binary.LittleEndian.Uint64(message)
+			d += binary.LittleEndian.Uint64(message[8:])
+			a, b, c, d = spookyShortMix(a, b, c, d)
+			a += binary.LittleEndian.Uint64(message[16:])
+			b += binary.LittleEndian.Uint64(message[24:])
+		}
+		if len(message) >= 16 {
+			c += binary.LittleEndian.Uint64(message)
+			d += binary.LittleEndian.Uint64(message[8:])
+			a, b, c, d = spookyShortMix(a, b, c, d)
+			message = message[16:]
+		}
+	}
+	d += uint64(length) << 56
+	switch remainder := len(message); {
+	case remainder == 0:
+		c += spookyConst
+		d += spookyConst
+	case remainder <= 8:
+		c += le(message)
+	default:
+		c += le(message[:8])
+		d += le(message[8:])
+	}
+	return spookyShortEnd(a, b, c, d)
+}
+
+type spookyState [spookyVars]uint64
+
+func (s *spookyState) mix(data []byte) {
+	rotations := [spookyVars]int{11, 32, 43, 31, 17, 28, 39, 57, 55, 54, 22, 46}
+	for i := 0; i < spookyVars; i++ {
+		s[i] += binary.LittleEndian.Uint64(data[8*i:])
+		s[(i+2)%spookyVars] ^= s[(i+10)%spookyVars]
+		s[(i+11)%spookyVars] ^= s[i]
+		s[i] = bits.RotateLeft64(s[i], rotations[i])
+		s[(i+11)%spookyVars] += s[(i+1)%spookyVars]
+	}
+}
+
+func (s *spookyState) endPartial() {
+	rotations := [spookyVars]int{44, 15, 34, 21, 38, 33, 10, 13, 38, 53, 42, 54}
+	for i := 0; i < spookyVars; i++ {
+		s[(i+11)%spookyVars] += s[(i+1)%spookyVars]
+		s[(i+2)%spookyVars] ^= s[(i+11)%spookyVars]
+		s[(i+1)%spookyVars] = bits.RotateLeft64(s[(i+1)%spookyVars], rotations[i])
+	}
+}
+
+func (s *spookyState) end(data []byte) {
+	for i := 0; i < spookyVars; i++ {
+		s[i] += binary.LittleEndian.Uint64(data[8*i:])
+	}
+	s.endPartial()
+	s.endPartial()
+	s.endPartial()
+}
+
+// SpookyHash128 is Bob Jenkins' SpookyHash V2 of the `message` seeded by `seed1` and `seed2`
+func SpookyHash128(message []byte, seed1, seed2 uint64) (uint64, uint64) {
+	if len(message) < spookyBufSize {
+		return spookyShort(message, seed1, seed2)
+	}
+	s := &spookyState{seed1, seed2, spookyConst, seed1, seed2, spookyConst, seed1, seed2, spookyConst, seed1, seed2, spookyConst}
+	for ; len(message) >= spookyBlockSize; message = message[spookyBlockSize:] {
+		s.mix(message)
+	}
+	buf := make([]byte, spookyBlockSize)
+	copy(buf, message)
+	buf[spookyBlockSize-1] = byte(len(message))
+	s.end(buf)
+	return s[0], s[1]
+}
+
+// SpookyHash32 is SpookyHash V2's `Hash32`, as folly's `SpookyHashV2::Hash32`
+func SpookyHash32(message []byte, seed uint32) uint32 {
+	hash1, _ := SpookyHash128(message, uint64(seed), uint64(seed))
+	return uint32(hash1)
+}
@@ -50,6 +50,8 @@ var (
 	NotFound = []byte("NOT_FOUND\r\n")
 	// ClientError is always the response to any other command other than abovementioned
 	ClientError = []byte("CLIENT_ERROR <ignore eavesdropping error>\r\n")
+	// ServerError is the response of a proxy whose upstream fails
+	ServerError = []byte("SERVER_ERROR upstream unavailable\r\n")
 	// ErrParse is sth wrong detected in the command parsing
 	ErrParse = errors.New("command_parse_error")
 )
@@ -107,9 +109,14 @@ func parseCommand(command string) (Command, []string, error) {
 		return GET, sections[1:], nil
 	case "gets":
 		return GETS, sections[1:], nil
-	case "gat":
-		return GAT, sections[2:], nil
-	case "gats":
+	case "gat", "gats":
+		// gat(s) <exptime> <key>*
+		if len(sections) < 2 {
+			return UNKNOWN, nil, ErrParse
+		}
+		if cmd == "gat" {
+			return GAT, sections[2:], nil
+		}
 		return GATS, sections[2:], nil
 	case "set":
 		return SET, sections[1:], nil
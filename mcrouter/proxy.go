@@ -0,0 +1,346 @@
+package mcrouter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// DefaultUpstreamTimeout bounds every exchange of a command and its response with the upstream
+	DefaultUpstreamTimeout = time.Second
+	// FetchedScoreTTL is how long the size of a value fetched through a proxy scores its key
+	FetchedScoreTTL = 10 * time.Minute
+)
+
+// Proxy forwards the commands of its clients to the upstream memcached or mcrouter, and relays the real responses,
+// unlike an eavesdropper mirrored to by mcrouter, it sees the hits, misses and sizes of the values fetched, and the upstream latency
+type Proxy struct {
+	upstream     string
+	timeout      time.Duration
+	eavesdropper *RollingWindowsMcrouterEavesdropper
+	shield       *ShieldCache
+}
+
+// NewProxy initializes a `Proxy` to the `upstream` address, which counts and scores the keys by the `eavesdropper`
+func NewProxy(upstream string, timeout time.Duration, eavesdropper *RollingWindowsMcrouterEavesdropper) *Proxy {
+	if timeout <= 0 {
+		timeout = DefaultUpstreamTimeout
+	}
+	return &Proxy{
+		upstream:     upstream,
+		timeout:      timeout,
+		eavesdropper: eavesdropper,
+	}
+}
+
+// EnableShield serves the hot keys' `get`s from the `shield` cache, which the proxy's writes invalidate,
+// it must be enabled before the proxy serves
+func (proxy *Proxy) EnableShield(shield *ShieldCache) {
+	proxy.shield = shield
+}
+
+// ServeProxy serves a client connection in the proxy mode, through an upstream connection of its own,
+// as the commands of a connection are answered in order
+func ServeProxy(conn net.Conn, proxy *Proxy) {
+	defer conn.Close()
+
+	upstream, err := net.DialTimeout("tcp", proxy.upstream, proxy.timeout)
+	if err != nil {
+		log.Warningf("<proxy> cannot connect upstream %s:%v\n", proxy.upstream, err)
+		conn.Write(ServerError)
+		return
+	}
+	defer upstream.Close()
+
+	client := bufio.NewReader(conn)
+	server := bufio.NewReader(upstream)
+	for {
+		resp, err := proxy.exchange(client, upstream, server)
+		if resp != nil {
+			if _, writeErr := conn.Write(resp); writeErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF && err != ErrQuit {
+				log.Warningf("<proxy> stops serving %v:%v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// exchange forwards the next command of the `client` and gives the response to relay,
+// an error stops the connection, as the client or the upstream may be amid a command or a response
+func (proxy *Proxy) exchange(client *bufio.Reader, upstream net.Conn, server *bufio.Reader) ([]byte, error) {
+	line, err := client.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	command, args, err := parseCommand(strings.TrimRight(line, CRLF))
+	if err != nil {
+		return ClientError, nil
+	}
+	if command == QUIT {
+		return nil, ErrQuit
+	}
+
+	request := []byte(line)
+	keys := args
+	var cached []byte
+	var sequence uint64
+	switch command {
+	case UNKNOWN:
+		// forwarded verbatim, e.g. `flush_all`, `verbosity` or the meta commands, whose response is a single line,
+		// or a `VA` line along with its value
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return ClientError, nil
+		}
+		args = fields[1:]
+		switch fields[0] {
+		case "ms":
+			// ms <key> <datalen> <flags>*\r\n<data>\r\n, the data block is read even if the command is rejected,
+			// or it'd be taken for the next command
+			key, n, exptime, err := parseMetaStore(args)
+			if err != nil {
+				// the data block can't be skipped
+				return ClientError, err
+			}
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(client, data); err != nil {
+				return nil, err
+			}
+			if hasFlag(args[2:], "q") {
+				// a quiet meta command answers nothing on success, which can't be told from a slow upstream
+				return ClientError, nil
+			}
+			request = append(request, data...)
+			proxy.eavesdropper.OnStore(key, n, exptime)
+			proxy.invalidate(key)
+		case "md", "ma":
+			if len(args) == 0 || hasFlag(args[1:], "q") {
+				return ClientError, nil
+			}
+			if fields[0] == "md" {
+				proxy.eavesdropper.OnDelete(args[0])
+			}
+			proxy.invalidate(args[0])
+		case "mg":
+			if len(args) == 0 || hasFlag(args[1:], "q") {
+				return ClientError, nil
+			}
+			proxy.eavesdropper.OnFetch(args[0])
+		case "flush_all":
+			if proxy.shield != nil {
+				proxy.shield.Flush()
+			}
+		}
+	case SET, ADD, REPLACE, CAS, APPEND, PREPEND:
+		key, n, exptime, err := parseStore(args)
+		if err != nil {
+			return ClientError, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(client, data); err != nil {
+			return nil, err
+		}
+		request = append(request, data...)
+		if command != APPEND && command != PREPEND {
+			proxy.eavesdropper.OnStore(key, n, exptime)
+		}
+		proxy.invalidate(key)
+	case DELETE:
+		if len(args) > 0 {
+			proxy.eavesdropper.OnDelete(args[0])
+			proxy.invalidate(args[0])
+		}
+	case INCR, DECR, TOUCH:
+		if len(args) > 0 {
+			proxy.invalidate(args[0])
+		}
+	case GET, GETS, GAT, GATS:
+		proxy.eavesdropper.OnFetch(args...)
+		// `gat` touches the keys upstream, only `get` and `gets` are served from the shield
+		if (command == GET || command == GETS) && proxy.shield != nil {
+			if cached, keys, sequence = proxy.shield.Lookup(args, command == GETS); len(keys) == 0 {
+				return append(cached, End...), nil
+			}
+			if len(keys) < len(args) {
+				request = []byte(strings.Fields(line)[0] + " " + strings.Join(keys, " ") + CRLF)
+			}
+		}
+	}
+
+	start := time.Now()
+	upstream.SetDeadline(start.Add(proxy.timeout))
+	if _, err := upstream.Write(request); err != nil {
+		return ServerError, err
+	}
+	var resp []byte
+	switch command {
+	case GET, GETS, GAT, GATS:
+		var values map[string]*fetchedValue
+		if resp, values, err = readValues(server); err != nil {
+			return ServerError, err
+		}
+		latency := time.Since(start)
+		for _, key := range keys {
+			if value, hit := values[key]; hit {
+				proxy.eavesdropper.OnFetched(key, true, value.bytes, latency)
+				if (command == GET || command == GETS) && proxy.shield != nil {
+					proxy.shield.Fill(key, value.block, sequence)
+				}
+			} else {
+				proxy.eavesdropper.OnFetched(key, false, 0, latency)
+			}
+		}
+		resp = append(cached, resp...)
+	case STATS:
+		resp, err = readUntilEnd(server)
+	default:
+		if len(args) > 0 && args[len(args)-1] == "noreply" {
+			// the upstream answers nothing, neither does the proxy
+			return nil, nil
+		}
+		resp, err = server.ReadBytes('\n')
+		if err == nil && command == UNKNOWN && bytes.HasPrefix(resp, []byte("VA ")) {
+			resp, err = readMetaValue(server, resp)
+		}
+		if err == nil && command == UNKNOWN && strings.HasPrefix(line, "mg ") {
+			hit, size := metaFetched(resp)
+			proxy.eavesdropper.OnFetched(args[0], hit, size, time.Since(start))
+		}
+	}
+	if err != nil {
+		return ServerError, err
+	}
+	return resp, nil
+}
+
+// invalidate drops the `key` written through the proxy from the shield
+func (proxy *Proxy) invalidate(key string) {
+	if proxy.shield != nil {
+		proxy.shield.Invalidate(key)
+	}
+}
+
+// fetchedValue is a value of a fetch response, its size and its whole `VALUE` block
+type fetchedValue struct {
+	bytes int
+	block []byte
+}
+
+// readValues reads the response of a fetch, and every value in it
+func readValues(server *bufio.Reader) ([]byte, map[string]*fetchedValue, error) {
+	resp := []byte{}
+	values := map[string]*fetchedValue{}
+	for {
+		line, err := server.ReadBytes('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.HasPrefix(line, []byte("VALUE ")) {
+			// `END`, or an error ending the response alike
+			return append(resp, line...), values, nil
+		}
+		// VALUE <key> <flags> <bytes> [<cas unique>]
+		fields := strings.Fields(string(line))
+		if len(fields) < 4 {
+			return nil, nil, ErrParse
+		}
+		n, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, nil, ErrParse
+		}
+		block := make([]byte, len(line)+n+2)
+		copy(block, line)
+		if _, err := io.ReadFull(server, block[len(line):]); err != nil {
+			return nil, nil, err
+		}
+		resp = append(resp, block...)
+		values[fields[1]] = &fetchedValue{bytes: n, block: block}
+	}
+}
+
+// readMetaValue reads the value following the `VA <size> <flags>*` line of a meta response
+func readMetaValue(server *bufio.Reader, line []byte) ([]byte, error) {
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return nil, ErrParse
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 0 {
+		return nil, ErrParse
+	}
+	resp := make([]byte, len(line)+n+2)
+	copy(resp, line)
+	if _, err := io.ReadFull(server, resp[len(line):]); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// metaFetched tells whether the response of a `mg` is a hit, `VA` or `HD`, and the size of the value, -1 when it's unknown
+func metaFetched(resp []byte) (bool, int) {
+	header := resp
+	if end := bytes.Index(resp, []byte(CRLF)); end >= 0 {
+		header = resp[:end]
+	}
+	fields := strings.Fields(string(header))
+	if len(fields) == 0 || (fields[0] != "VA" && fields[0] != "HD") {
+		// `EN`, or an error
+		return false, 0
+	}
+	if fields[0] == "VA" && len(fields) > 1 {
+		// VA <size> <flags>*
+		if n, err := strconv.Atoi(fields[1]); err == nil {
+			return true, n
+		}
+	}
+	for _, flag := range fields[1:] {
+		if strings.HasPrefix(flag, "s") {
+			if n, err := strconv.Atoi(flag[1:]); err == nil {
+				return true, n
+			}
+		}
+	}
+	return true, -1
+}
+
+// hasFlag tells whether the meta `flags` have the `flag`, which is a single letter followed by its token if any
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.HasPrefix(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// readUntilEnd reads the lines of a response till `END` or an error
+func readUntilEnd(server *bufio.Reader) ([]byte, error) {
+	resp := []byte{}
+	for {
+		line, err := server.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		resp = append(resp, line...)
+		if bytes.Equal(line, End) || isError(line) {
+			return resp, nil
+		}
+	}
+}
+
+// isError tells an `ERROR`, `CLIENT_ERROR` or `SERVER_ERROR` line
+func isError(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("ERROR")) || bytes.HasPrefix(line, []byte("CLIENT_ERROR")) || bytes.HasPrefix(line, []byte("SERVER_ERROR"))
+}
@@ -0,0 +1,190 @@
+package mcrouter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/inexplicable/mc_hotkeys/model"
+)
+
+// serveUpstream is a memcached alike of `get(s)`, `set`, `delete`, `flush_all` and the meta `mg`, `ms` and `md` only,
+// whose cas unique is the size of the value, which answers everything else with `ERROR`
+func serveUpstream(listener net.Listener) {
+	m := sync.Mutex{}
+	values := map[string][]byte{}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				fields := strings.Fields(line)
+				if len(fields) == 0 {
+					continue
+				}
+				m.Lock()
+				switch fields[0] {
+				case "get", "gets":
+					for _, key := range fields[1:] {
+						if value, ok := values[key]; ok && fields[0] == "gets" {
+							fmt.Fprintf(conn, "VALUE %s 0 %d %d\r\n%s\r\n", key, len(value), len(value), value)
+						} else if ok {
+							fmt.Fprintf(conn, "VALUE %s 0 %d\r\n%s\r\n", key, len(value), value)
+						}
+					}
+					conn.Write(End)
+				case "set":
+					n, _ := strconv.Atoi(fields[4])
+					data := make([]byte, n+2)
+					io.ReadFull(reader, data)
+					values[fields[1]] = data[:n]
+					conn.Write([]byte("STORED\r\n"))
+				case "delete":
+					delete(values, fields[1])
+					conn.Write([]byte("DELETED\r\n"))
+				case "flush_all":
+					values = map[string][]byte{}
+					conn.Write([]byte("OK\r\n"))
+				case "mg":
+					if value, ok := values[fields[1]]; ok {
+						fmt.Fprintf(conn, "VA %d v\r\n%s\r\n", len(value), value)
+					} else {
+						conn.Write([]byte("EN\r\n"))
+					}
+				case "ms":
+					n, _ := strconv.Atoi(fields[2])
+					data := make([]byte, n+2)
+					io.ReadFull(reader, data)
+					values[fields[1]] = data[:n]
+					conn.Write([]byte("HD\r\n"))
+				case "md":
+					delete(values, fields[1])
+					conn.Write([]byte("HD\r\n"))
+				default:
+					conn.Write([]byte("ERROR\r\n"))
+				}
+				m.Unlock()
+			}
+		}()
+	}
+}
+
+func TestProxy(t *testing.T) {
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("cannot listen upstream")
+	}
+	defer upstream.Close()
+	go serveUpstream(upstream)
+
+	scorer := model.NewSimpleKeyScorer(1, time.Minute)
+	rollingWindows := model.NewSimpleRollingWindows(scorer, func() model.GetKeyCounter {
+		return model.NewBucketGetKeyCounter(1)
+	}, 2, 10, 1)
+	proxy := NewProxy(upstream.Addr().String(), time.Second, NewRollingWindowsMcrouterEavesdropper(rollingWindows, scorer))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("cannot listen the proxy")
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ServeProxy(conn, proxy)
+		}
+	}()
+
+	client := memcache.New(listener.Addr().String())
+	if err := client.Set(&memcache.Item{Key: "hot_key", Value: []byte("some value")}); err != nil {
+		panic("a set should be relayed")
+	}
+	for i := 0; i < 3; i++ {
+		if item, err := client.Get("hot_key"); err != nil || string(item.Value) != "some value" {
+			panic("a hit should be relayed with its value")
+		}
+	}
+	if _, err := client.Get("cold_key"); err != memcache.ErrCacheMiss {
+		panic("a miss should be relayed")
+	}
+	if err := client.Delete("hot_key"); err != nil {
+		panic("a delete should be relayed")
+	}
+	if _, err := client.Get("hot_key"); err != memcache.ErrCacheMiss {
+		panic("a deleted key should miss")
+	}
+
+	// a fetched value scores its key without waiting for a set
+	client.Set(&memcache.Item{Key: "sized_key", Value: []byte("0123456789")})
+	scorer.DelScore("sized_key")
+	client.Get("sized_key")
+	if scorer.GetScore("sized_key") != 10 {
+		panic("a hit should score the key by the size of its value")
+	}
+
+	rollingWindows.Roll()
+	rollingWindows.Roll()
+	stats := rollingWindows.Metadata().Stats
+	if hot := stats["hot_key"]; hot == nil || hot.Hits != 3 || hot.Misses != 1 || hot.Bytes != 10 {
+		panic("the hits, misses and sizes of a key should be recorded")
+	}
+	if cold := stats["cold_key"]; cold == nil || cold.Hits != 0 || cold.Misses != 1 {
+		panic("the misses of a key should be recorded")
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		panic("cannot connect the proxy")
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	expect := func(message string, lines ...string) {
+		for _, expected := range lines {
+			if line, _ := reader.ReadString('\n'); line != expected {
+				panic(message)
+			}
+		}
+	}
+	fmt.Fprintf(conn, "ms meta_key 5 T0\r\nhello\r\nmg meta_key v\r\n")
+	expect("the meta commands should be forwarded, and their responses relayed along with the values", "HD\r\n", "VA 5 v\r\n", "hello\r\n")
+	if scorer.GetScore("meta_key") != 5 {
+		panic("a meta set should score the key by the size of its value")
+	}
+	fmt.Fprintf(conn, "md meta_key\r\nmg meta_key v\r\n")
+	expect("a meta delete should be forwarded", "HD\r\n", "EN\r\n")
+	rollingWindows.Roll()
+	rollingWindows.Roll()
+	if meta := rollingWindows.Metadata().Stats["meta_key"]; meta == nil || meta.Hits != 1 || meta.Misses != 1 || meta.Bytes != 5 {
+		panic("the hits, misses and sizes of the meta fetches should be recorded")
+	}
+
+	// the data block of a rejected quiet meta set is never taken for a command
+	fmt.Fprintf(conn, "ms quiet_key 9 q\r\nflush_all\r\nmg sized_key v\r\n")
+	expect("a quiet meta set should be rejected along with its data block", string(ClientError), "VA 10 v\r\n", "0123456789\r\n")
+	// a malformed command is rejected without stopping the proxy
+	fmt.Fprintf(conn, "gat\r\ngat 10\r\n")
+	expect("a malformed gat should be rejected", string(ClientError), "ERROR\r\n")
+	fmt.Fprintf(conn, "mg meta_key v q\r\nflush_all\r\nverbosity 1\r\n")
+	expect("the unknown commands should be forwarded verbatim, but the quiet meta commands", string(ClientError), "OK\r\n", "ERROR\r\n")
+	if _, err := client.Get("sized_key"); err != memcache.ErrCacheMiss {
+		panic("a flush_all should be forwarded")
+	}
+}
@@ -0,0 +1,457 @@
+package mcrouter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrNoRoute is an error when a routing description routes no key at all
+	ErrNoRoute = errors.New("neither a prefix nor a wildcard pool")
+	// ErrUnknownPool is an error when a routing description routes to a pool it doesn't define
+	ErrUnknownPool = errors.New("unknown pool")
+	// ErrNoHotKeysServers is an error when a routing description doesn't list the servers of the hot keys pool
+	ErrNoHotKeysServers = errors.New("no hotkeys servers")
+)
+
+// DefaultMirroredOperations are the operations mcrouter mirrors to the eavesdropper, the rest only go to the main pools
+var DefaultMirroredOperations = []string{"get", "add", "set", "delete"}
+
+// Wildcard stands for the keys without a known prefix in the routing findings
+const Wildcard = "*"
+
+// RoutingPool is a memcached pool of a mcrouter config
+type RoutingPool struct {
+	Servers []string `json:"servers"`
+}
+
+// RoutingDescription describes the pools, which prefixes go to which pool, and the pool of the eavesdroppers, e.g.
+// `{"pools": {"primary": {"servers": ["10.0.0.1:11211"]}, "secondary": {"servers": ["10.0.0.2:11211"]}},
+// "prefixes": {"user:": "primary"}, "wildcard": "secondary", "hotkeys_pool": "memc-hotkeys", "hotkeys_servers": ["10.0.0.3:11211"]}`
+type RoutingDescription struct {
+	Pools          map[string]RoutingPool `json:"pools"`
+	Prefixes       map[string]string      `json:"prefixes"`
+	Wildcard       string                 `json:"wildcard"`
+	HotKeysPool    string                 `json:"hotkeys_pool"`
+	HotKeysServers []string               `json:"hotkeys_servers"`
+	// Operations are mirrored to the eavesdroppers, `DefaultMirroredOperations` by default
+	Operations []string `json:"operations,omitempty"`
+}
+
+type macroDef struct {
+	Type   string      `json:"type"`
+	Params []string    `json:"params"`
+	Result interface{} `json:"result"`
+}
+
+type routingConfig struct {
+	Macros map[string]macroDef    `json:"macros"`
+	Pools  map[string]RoutingPool `json:"pools"`
+	Route  interface{}            `json:"route"`
+}
+
+func (description RoutingDescription) eavesdropping(pool string) (string, error) {
+	if _, ok := description.Pools[pool]; !ok || pool == description.HotKeysPool {
+		return "", fmt.Errorf("%v: %s", ErrUnknownPool, pool)
+	}
+	return fmt.Sprintf("@eavesdropping(%s, %s)", pool, description.HotKeysPool), nil
+}
+
+// Route gives the top level route of the generated config, a `PrefixSelectorRoute` eavesdropping on the pool of every prefix and the wildcard
+func (description RoutingDescription) Route() (map[string]interface{}, error) {
+	if len(description.Prefixes) == 0 && description.Wildcard == "" {
+		return nil, ErrNoRoute
+	}
+	policies := map[string]string{}
+	for prefix, pool := range description.Prefixes {
+		policy, err := description.eavesdropping(pool)
+		if err != nil {
+			return nil, err
+		}
+		policies[prefix] = policy
+	}
+	route := map[string]interface{}{"type": "PrefixSelectorRoute", "policies": policies}
+	if description.Wildcard != "" {
+		wildcard, err := description.eavesdropping(description.Wildcard)
+		if err != nil {
+			return nil, err
+		}
+		route["wildcard"] = wildcard
+	}
+	return route, nil
+}
+
+// KeyRoute gives the route of the `Route` the `key` takes, that of its longest prefix as mcrouter picks, or the wildcard,
+// nil when neither routes it
+func (description RoutingDescription) KeyRoute(key string) interface{} {
+	longest, pool := -1, description.Wildcard
+	for prefix, prefixPool := range description.Prefixes {
+		if strings.HasPrefix(key, prefix) && len(prefix) > longest {
+			longest, pool = len(prefix), prefixPool
+		}
+	}
+	if pool == "" {
+		return nil
+	}
+	route, err := description.eavesdropping(pool)
+	if err != nil {
+		return nil
+	}
+	return route
+}
+
+// GenerateRouting generates the mcrouter config eavesdropping on the described pools, every mirrored operation goes to
+// an `AllInitialRoute` of the main pool, which answers the clients, and the hot keys pool, any other operation only to the main pool
+func GenerateRouting(description RoutingDescription) ([]byte, error) {
+	if len(description.Prefixes) == 0 && description.Wildcard == "" {
+		return nil, ErrNoRoute
+	}
+	if len(description.HotKeysServers) == 0 {
+		return nil, ErrNoHotKeysServers
+	}
+	operations := description.Operations
+	if len(operations) == 0 {
+		operations = DefaultMirroredOperations
+	}
+	pools := map[string]RoutingPool{}
+	for name, pool := range description.Pools {
+		pools[name] = pool
+	}
+	pools[description.HotKeysPool] = RoutingPool{Servers: description.HotKeysServers}
+
+	route, err := description.Route()
+	if err != nil {
+		return nil, err
+	}
+
+	operationPolicies := map[string]string{}
+	for _, operation := range operations {
+		operationPolicies[operation] = "@createAllInitialRoute(%main%, %other%)"
+	}
+	return json.MarshalIndent(&routingConfig{
+		Macros: map[string]macroDef{
+			"createAllInitialRoute": {
+				Type:   "macroDef",
+				Params: []string{"main", "other"},
+				Result: map[string]interface{}{
+					"type":     "AllInitialRoute",
+					"children": []string{"PoolRoute|%main%", "PoolRoute|%other%"},
+				},
+			},
+			"eavesdropping": {
+				Type:   "macroDef",
+				Params: []string{"main", "other"},
+				Result: map[string]interface{}{
+					"type":               "OperationSelectorRoute",
+					"default_policy":     "PoolRoute|%main%",
+					"operation_policies": operationPolicies,
+				},
+			},
+		},
+		Pools: pools,
+		Route: route,
+	}, "", "  ")
+}
+
+// RoutingFinding is a prefix and an operation of a mcrouter config which the eavesdroppers miss or break,
+// the `Route` is the aliases of the route, if the config has several
+type RoutingFinding struct {
+	Route     string `json:"route,omitempty"`
+	Prefix    string `json:"prefix"`
+	Operation string `json:"operation"`
+	Reason    string `json:"reason"`
+}
+
+func (finding RoutingFinding) String() string {
+	if finding.Route != "" {
+		return fmt.Sprintf("%s %s %s: %s", finding.Route, finding.Prefix, finding.Operation, finding.Reason)
+	}
+	return fmt.Sprintf("%s %s: %s", finding.Prefix, finding.Operation, finding.Reason)
+}
+
+// routeWalker finds the pools a route sends an operation to, expanding the macros of the config
+type routeWalker struct {
+	macros      map[string]macroDef
+	hotKeysPool string
+	problems    []string
+	depth       int
+}
+
+// maxMacroDepth bounds the nested macro calls, e.g. of a macro calling itself
+const maxMacroDepth = 32
+
+func (walker *routeWalker) problem(format string, args ...interface{}) {
+	walker.problems = append(walker.problems, fmt.Sprintf(format, args...))
+}
+
+// expand substitutes the `%param%`s of a macro's result by the arguments of a call
+func expand(value interface{}, args map[string]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		for param, arg := range args {
+			v = strings.Replace(v, "%"+param+"%", arg, -1)
+		}
+		return v
+	case []interface{}:
+		expanded := make([]interface{}, len(v))
+		for i, child := range v {
+			expanded[i] = expand(child, args)
+		}
+		return expanded
+	case map[string]interface{}:
+		expanded := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			expanded[key] = expand(child, args)
+		}
+		return expanded
+	}
+	return value
+}
+
+// call expands a `@macro(arg, ...)` string, or an object whose type is a macro and whose fields are the arguments
+func (walker *routeWalker) call(route interface{}) (interface{}, bool) {
+	name, args := "", map[string]string{}
+	var values []string
+	switch r := route.(type) {
+	case string:
+		if !strings.HasPrefix(r, "@") {
+			return nil, false
+		}
+		open, end := strings.Index(r, "("), strings.LastIndex(r, ")")
+		if open < 0 || end < open {
+			name = r[1:]
+		} else {
+			name = r[1:open]
+			for _, arg := range strings.Split(r[open+1:end], ",") {
+				if arg = strings.TrimSpace(arg); arg != "" {
+					values = append(values, arg)
+				}
+			}
+		}
+	case map[string]interface{}:
+		name, _ = r["type"].(string)
+		if _, ok := walker.macros[name]; !ok {
+			return nil, false
+		}
+		for key, value := range r {
+			if s, ok := value.(string); ok {
+				args[key] = s
+			}
+		}
+	default:
+		return nil, false
+	}
+	macro, ok := walker.macros[name]
+	if !ok {
+		walker.problem("unknown macro %s", name)
+		return nil, true
+	}
+	for i, value := range values {
+		if i < len(macro.Params) {
+			args[macro.Params[i]] = value
+		}
+	}
+	return expand(macro.Result, args), true
+}
+
+// pools gives the pools the `route` sends the `operation` to
+func (walker *routeWalker) pools(route interface{}, operation string) map[string]bool {
+	if expanded, ok := walker.call(route); ok {
+		if expanded == nil {
+			return map[string]bool{}
+		}
+		if walker.depth >= maxMacroDepth {
+			walker.problem("macros nest deeper than %d", maxMacroDepth)
+			return map[string]bool{}
+		}
+		walker.depth++
+		defer func() { walker.depth-- }()
+		return walker.pools(expanded, operation)
+	}
+	reached := map[string]bool{}
+	union := func(routes ...interface{}) {
+		for _, child := range routes {
+			for pool := range walker.pools(child, operation) {
+				reached[pool] = true
+			}
+		}
+	}
+	switch r := route.(type) {
+	case nil:
+	case string:
+		switch {
+		case strings.HasPrefix(r, "PoolRoute|"):
+			reached[strings.TrimPrefix(r, "PoolRoute|")] = true
+		case r == "NullRoute" || r == "ErrorRoute" || strings.HasPrefix(r, "ErrorRoute|"):
+		default:
+			walker.problem("cannot analyze route %q", r)
+		}
+	case []interface{}:
+		union(r...)
+	case map[string]interface{}:
+		children, _ := r["children"].([]interface{})
+		switch kind, _ := r["type"].(string); kind {
+		case "PoolRoute":
+			if name, ok := r["pool"].(string); ok {
+				reached[name] = true
+			} else if pool, ok := r["pool"].(map[string]interface{}); ok {
+				name, _ := pool["name"].(string)
+				reached[name] = true
+			}
+		case "OperationSelectorRoute":
+			policies, _ := r["operation_policies"].(map[string]interface{})
+			if policy, ok := policies[operation]; ok {
+				union(policy)
+			} else {
+				union(r["default_policy"])
+			}
+		case "AllInitialRoute":
+			if len(children) > 0 && walker.pools(children[0], operation)[walker.hotKeysPool] {
+				walker.problem("the hot keys pool is the first child of an AllInitialRoute, its replies would reach the clients")
+			}
+			union(children...)
+		case "AllSyncRoute", "AllAsyncRoute", "AllFastestRoute", "AllMajorityRoute":
+			union(children...)
+		case "PrefixSelectorRoute":
+			policies, _ := r["policies"].(map[string]interface{})
+			for _, policy := range policies {
+				union(policy)
+			}
+			union(r["wildcard"])
+		case "NullRoute", "ErrorRoute":
+		default:
+			walker.problem("cannot analyze route type %s", kind)
+		}
+	}
+	return reached
+}
+
+// prefixes gives the top level routes of every prefix, and of the `Wildcard`
+func (walker *routeWalker) prefixes(route interface{}) map[string]interface{} {
+	if expanded, ok := walker.call(route); ok && walker.depth < maxMacroDepth {
+		walker.depth++
+		defer func() { walker.depth-- }()
+		return walker.prefixes(expanded)
+	}
+	if r, ok := route.(map[string]interface{}); ok && r["type"] == "PrefixSelectorRoute" {
+		prefixes := map[string]interface{}{}
+		policies, _ := r["policies"].(map[string]interface{})
+		for prefix, policy := range policies {
+			prefixes[prefix] = policy
+		}
+		if wildcard, ok := r["wildcard"]; ok {
+			prefixes[Wildcard] = wildcard
+		}
+		return prefixes
+	}
+	return map[string]interface{}{Wildcard: route}
+}
+
+// ValidateRouting reports every prefix and operation of the mcrouter `config` which isn't mirrored to the `hotKeysPool`,
+// or which the eavesdroppers would answer the clients of, the config may have the comments and trailing commas mcrouter allows
+func ValidateRouting(config []byte, hotKeysPool string, operations []string) ([]RoutingFinding, error) {
+	if len(operations) == 0 {
+		operations = DefaultMirroredOperations
+	}
+	parsed := struct {
+		Macros map[string]macroDef `json:"macros"`
+		Route  interface{}         `json:"route"`
+		Routes []struct {
+			Aliases []string    `json:"aliases"`
+			Route   interface{} `json:"route"`
+		} `json:"routes"`
+	}{}
+	if err := json.Unmarshal(stripJSON(config), &parsed); err != nil {
+		return nil, err
+	}
+	routes := map[string]interface{}{}
+	if parsed.Route != nil {
+		routes[""] = parsed.Route
+	}
+	for _, aliased := range parsed.Routes {
+		routes[strings.Join(aliased.Aliases, ",")] = aliased.Route
+	}
+
+	findings := []RoutingFinding{}
+	for alias, route := range routes {
+		walker := &routeWalker{macros: parsed.Macros, hotKeysPool: hotKeysPool}
+		for prefix, policy := range walker.prefixes(route) {
+			for _, operation := range operations {
+				walker.problems = nil
+				reached := walker.pools(policy, operation)
+				seen := map[string]bool{}
+				for _, problem := range walker.problems {
+					if seen[problem] {
+						continue
+					}
+					seen[problem] = true
+					findings = append(findings, RoutingFinding{Route: alias, Prefix: prefix, Operation: operation, Reason: problem})
+				}
+				if !reached[hotKeysPool] {
+					findings = append(findings, RoutingFinding{Route: alias, Prefix: prefix, Operation: operation, Reason: "not mirrored to " + hotKeysPool})
+				}
+			}
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Route != findings[j].Route {
+			return findings[i].Route < findings[j].Route
+		}
+		if findings[i].Prefix != findings[j].Prefix {
+			return findings[i].Prefix < findings[j].Prefix
+		}
+		if findings[i].Operation != findings[j].Operation {
+			return findings[i].Operation < findings[j].Operation
+		}
+		return findings[i].Reason < findings[j].Reason
+	})
+	return findings, nil
+}
+
+// stripJSON drops the `//` and `/* */` comments and the trailing commas mcrouter's configs may have
+func stripJSON(config []byte) []byte {
+	stripped := bytes.Buffer{}
+	inString := false
+	for i := 0; i < len(config); i++ {
+		c := config[i]
+		switch {
+		case inString:
+			stripped.WriteByte(c)
+			if c == '\\' && i+1 < len(config) {
+				i++
+				stripped.WriteByte(config[i])
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			stripped.WriteByte(c)
+		case c == '/' && i+1 < len(config) && config[i+1] == '/':
+			for i < len(config) && config[i] != '\n' {
+				i++
+			}
+			stripped.WriteByte('\n')
+		case c == '/' && i+1 < len(config) && config[i+1] == '*':
+			end := bytes.Index(config[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(config)
+			} else {
+				i += end + 3
+			}
+		case c == '}' || c == ']':
+			// a comma followed only by blanks is trailing
+			trimmed := bytes.TrimRight(stripped.Bytes(), " \t\r\n")
+			if len(trimmed) > 0 && trimmed[len(trimmed)-1] == ',' {
+				stripped.Truncate(len(trimmed) - 1)
+			}
+			stripped.WriteByte(c)
+		default:
+			stripped.WriteByte(c)
+		}
+	}
+	return stripped.Bytes()
+}
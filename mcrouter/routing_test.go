@@ -0,0 +1,109 @@
+package mcrouter
+
+import (
+	"testing"
+)
+
+func TestGenerateRouting(t *testing.T) {
+
+	if _, err := GenerateRouting(RoutingDescription{HotKeysPool: "memc-hotkeys"}); err != ErrNoRoute {
+		panic("a description should route some keys")
+	}
+	if _, err := GenerateRouting(RoutingDescription{Wildcard: "primary", HotKeysPool: "memc-hotkeys"}); err != ErrNoHotKeysServers {
+		panic("a description should list the servers of the hot keys pool")
+	}
+	generated, err := GenerateRouting(RoutingDescription{
+		Pools: map[string]RoutingPool{
+			"primary":   {Servers: []string{"10.0.0.1:11211"}},
+			"secondary": {Servers: []string{"10.0.0.2:11211"}},
+		},
+		Prefixes:       map[string]string{"user:": "primary"},
+		Wildcard:       "secondary",
+		HotKeysPool:    "memc-hotkeys",
+		HotKeysServers: []string{"10.0.0.3:11211"},
+	})
+	if err != nil {
+		panic("the described routing should be generated")
+	}
+	if findings, err := ValidateRouting(generated, "memc-hotkeys", nil); err != nil || len(findings) != 0 {
+		panic("the generated config should mirror every prefix")
+	}
+}
+
+func TestKeyRoute(t *testing.T) {
+
+	description := RoutingDescription{
+		Pools: map[string]RoutingPool{
+			"primary":   {Servers: []string{"10.0.0.1:11211"}},
+			"secondary": {Servers: []string{"10.0.0.2:11211"}},
+			"sessions":  {Servers: []string{"10.0.0.4:11211"}},
+		},
+		Prefixes:    map[string]string{"user:": "primary", "user:session:": "sessions"},
+		Wildcard:    "secondary",
+		HotKeysPool: "memc-hotkeys",
+	}
+	route, err := description.Route()
+	if err != nil {
+		panic("the described routing should have a route")
+	}
+	policies := route["policies"].(map[string]string)
+	if description.KeyRoute("user:1") != policies["user:"] || description.KeyRoute("user:session:1") != policies["user:session:"] ||
+		description.KeyRoute("item:1") != route["wildcard"] {
+		panic("a key should take the route of its longest prefix, or the wildcard")
+	}
+	description.Wildcard = ""
+	if description.KeyRoute("item:1") != nil {
+		panic("a key without a prefix nor a wildcard should have no route")
+	}
+}
+
+func TestValidateRouting(t *testing.T) {
+
+	config := []byte(`{
+  "macros": {
+    "createAllInitialRoute": {
+      "type": "macroDef",
+      "params": [ "main", "other" ],
+      "result": {
+        "type": "AllInitialRoute",
+        "children": ["PoolRoute|%main%", "PoolRoute|%other%"]
+      }
+    },
+    "eavesdropping": {
+      "type": "macroDef",
+      "params": [ "main", "other" ],
+      "result": {
+        "type": "OperationSelectorRoute",
+        "default_policy": "PoolRoute|%main%",
+        "operation_policies": {
+          "get": "@createAllInitialRoute(%main%, %other%)",
+          "set": "@createAllInitialRoute(%main%, %other%)", /* add and delete drifted away */
+        }
+      }
+    }
+  },
+  "route": {
+    "type": "PrefixSelectorRoute",
+    "policies": {
+      "PREFIX": "@eavesdropping(primary, memc-hotkeys)",
+      "BACKWARD": "@createAllInitialRoute(memc-hotkeys, primary)",
+    },
+    // All keys without a known prefix go to the default pool
+    "wildcard": "PoolRoute|secondary"
+  }
+}`)
+	findings, err := ValidateRouting(config, "memc-hotkeys", nil)
+	if err != nil {
+		panic("comments and trailing commas should be allowed")
+	}
+	reasons := map[string]string{}
+	for _, finding := range findings {
+		reasons[finding.Prefix+" "+finding.Operation] = finding.Reason
+	}
+	if reasons["PREFIX get"] != "" || reasons["PREFIX add"] != "not mirrored to memc-hotkeys" || reasons["PREFIX delete"] == "" {
+		panic("only the operations not mirrored should be reported")
+	}
+	if reasons["* get"] == "" || reasons["BACKWARD get"] == "" || len(findings) != 2+4+4 {
+		panic("the wildcard and the hot keys pool answering the clients should be reported")
+	}
+}
@@ -0,0 +1,213 @@
+package mcrouter
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inexplicable/mc_hotkeys/model"
+)
+
+// DefaultShieldTTL is how long a hot key is served from the shield cache without a max staleness of its own
+const DefaultShieldTTL = time.Second
+
+// ErrStalenessRule is an error of a malformed `<prefix>=<duration>` rule
+var ErrStalenessRule = errors.New("malformed staleness rule")
+
+// StalenessRule caps how long the keys of the `Prefix` are served from the shield cache, a zero `MaxStaleness` never caches them
+type StalenessRule struct {
+	Prefix       string
+	MaxStaleness time.Duration
+}
+
+// ParseStalenessRules parses the semicolon separated `<prefix>=<duration>` rules, e.g. `user:=100ms;config:=5s`
+func ParseStalenessRules(rules string) ([]StalenessRule, error) {
+	parsed := []StalenessRule{}
+	for _, rule := range strings.Split(rules, ";") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		sep := strings.LastIndex(rule, "=")
+		if sep < 0 {
+			return nil, ErrStalenessRule
+		}
+		staleness, err := time.ParseDuration(rule[sep+1:])
+		if err != nil || staleness < 0 {
+			return nil, ErrStalenessRule
+		}
+		parsed = append(parsed, StalenessRule{Prefix: rule[:sep], MaxStaleness: staleness})
+	}
+	return parsed, nil
+}
+
+// ShieldOptions tunes the shield cache of a proxy
+type ShieldOptions struct {
+	// TTL is how long a hot key is served from the cache, unless a staleness rule tells otherwise
+	TTL time.Duration
+	// MaxBytes caps the memory of the cached keys and values, the least recently used are evicted beyond it
+	MaxBytes int
+	// Staleness are the max staleness of the keys by prefix, the longest matching prefix wins
+	Staleness []StalenessRule
+}
+
+// ShieldStats counts the fetches the shield cache absorbed, and what happened to its entries
+type ShieldStats struct {
+	// Absorbed are the fetches of the keys served from the cache, which never reached the upstream
+	Absorbed uint64 `json:"absorbed"`
+	// Forwarded are the fetches of the hot keys which weren't cached
+	Forwarded uint64 `json:"forwarded"`
+	model.CacheStats
+}
+
+type shieldEntry struct {
+	key   string
+	flags string
+	// data is the value along with its CRLF
+	data []byte
+	// cas is the cas unique of a value fetched by `gets`, only such an entry answers a `gets`
+	cas string
+}
+
+func (entry *shieldEntry) size() int {
+	return len(entry.key) + len(entry.flags) + len(entry.data) + len(entry.cas)
+}
+
+// block renders the `VALUE` response of the entry, with its cas unique or not
+func (entry *shieldEntry) block(cas bool) []byte {
+	header := "VALUE " + entry.key + " " + entry.flags + " " + strconv.Itoa(len(entry.data)-2)
+	if cas {
+		header += " " + entry.cas
+	}
+	return append([]byte(header+CRLF), entry.data...)
+}
+
+// ShieldCache serves the keys hot at the proxy from memory for a short while, so that their identical fetches never reach the upstream,
+// it's a `model.HotKeyReporter` which learns the hot keys from every roll, and forgets the keys which cool down
+type ShieldCache struct {
+	m       sync.Mutex
+	options ShieldOptions
+	hot     map[string]bool
+	cache   *model.BoundedCache
+	stats   ShieldStats
+}
+
+// NewShieldCache initializes an empty `ShieldCache`, which caches nothing till it's reported the hot keys
+func NewShieldCache(options ShieldOptions) *ShieldCache {
+	if options.TTL <= 0 {
+		options.TTL = DefaultShieldTTL
+	}
+	return &ShieldCache{
+		m:       sync.Mutex{},
+		options: options,
+		hot:     map[string]bool{},
+		cache:   model.NewBoundedCache(options.MaxBytes),
+	}
+}
+
+// Report replaces the hot keys with those of the last roll, the keys no longer hot are dropped
+func (shieldCache *ShieldCache) Report(hotKeys map[string]uint64, metadata model.WindowsMetadata) {
+	shieldCache.m.Lock()
+	defer shieldCache.m.Unlock()
+
+	hot := make(map[string]bool, len(hotKeys))
+	for key := range hotKeys {
+		hot[key] = true
+	}
+	shieldCache.hot = hot
+	shieldCache.cache.Retain(func(key string) bool { return hot[key] })
+}
+
+// maxStaleness is the staleness of the longest prefix rule matching the `key`, or the ttl
+func (shieldCache *ShieldCache) maxStaleness(key string) time.Duration {
+	staleness, matched := shieldCache.options.TTL, -1
+	for _, rule := range shieldCache.options.Staleness {
+		if len(rule.Prefix) > matched && strings.HasPrefix(key, rule.Prefix) {
+			staleness, matched = rule.MaxStaleness, len(rule.Prefix)
+		}
+	}
+	return staleness
+}
+
+// Lookup gives the cached `VALUE` responses of the `keys`, with their cas uniques or not, and the keys to forward,
+// along with the sequence to `Fill` them with
+func (shieldCache *ShieldCache) Lookup(keys []string, cas bool) ([]byte, []string, uint64) {
+	shieldCache.m.Lock()
+	defer shieldCache.m.Unlock()
+
+	now := time.Now()
+	cached := []byte{}
+	forward := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if value, ok := shieldCache.cache.Get(key, now); ok {
+			if entry := value.(*shieldEntry); !cas || entry.cas != "" {
+				cached = append(cached, entry.block(cas)...)
+				shieldCache.stats.Absorbed++
+				continue
+			}
+		}
+		if shieldCache.hot[key] {
+			shieldCache.stats.Forwarded++
+		}
+		forward = append(forward, key)
+	}
+	return cached, forward, shieldCache.cache.Sequence()
+}
+
+// Fill caches the `VALUE` response `block` of a hot `key` fetched since the `sequence`, unless it was invalidated meanwhile
+func (shieldCache *ShieldCache) Fill(key string, block []byte, sequence uint64) {
+	shieldCache.m.Lock()
+	defer shieldCache.m.Unlock()
+
+	if !shieldCache.hot[key] {
+		return
+	}
+	staleness := shieldCache.maxStaleness(key)
+	// VALUE <key> <flags> <bytes> [<cas unique>]\r\n<data>\r\n
+	header := bytes.Index(block, []byte(CRLF))
+	if staleness <= 0 || header < 0 {
+		return
+	}
+	fields := strings.Fields(string(block[:header]))
+	if len(fields) < 4 || fields[1] != key {
+		return
+	}
+	entry := &shieldEntry{
+		key:   key,
+		flags: fields[2],
+		data:  append([]byte(nil), block[header+2:]...),
+	}
+	if len(fields) > 4 {
+		entry.cas = fields[4]
+	}
+	shieldCache.cache.Fill(key, entry, entry.size(), staleness, sequence)
+}
+
+// Invalidate drops the cached `key` written through the proxy, and keeps the fetches already forwarded from filling it,
+// hot or not, as the key may turn hot before they're answered
+func (shieldCache *ShieldCache) Invalidate(key string) {
+	shieldCache.m.Lock()
+	defer shieldCache.m.Unlock()
+
+	shieldCache.cache.Invalidate(key)
+}
+
+// Flush drops every cached key once the upstream is flushed through the proxy
+func (shieldCache *ShieldCache) Flush() {
+	shieldCache.m.Lock()
+	defer shieldCache.m.Unlock()
+
+	shieldCache.cache.Flush()
+}
+
+// Stats gives the counters, and the keys and bytes cached
+func (shieldCache *ShieldCache) Stats() ShieldStats {
+	shieldCache.m.Lock()
+	defer shieldCache.m.Unlock()
+
+	stats := shieldCache.stats
+	stats.CacheStats = shieldCache.cache.Stats()
+	return stats
+}
@@ -0,0 +1,170 @@
+package mcrouter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/inexplicable/mc_hotkeys/model"
+)
+
+func TestShieldCache(t *testing.T) {
+
+	if rules, err := ParseStalenessRules("user:=100ms; config:=5s"); err != nil || !reflect.DeepEqual(rules, []StalenessRule{
+		{Prefix: "user:", MaxStaleness: 100 * time.Millisecond},
+		{Prefix: "config:", MaxStaleness: 5 * time.Second},
+	}) {
+		panic("the staleness rules should be parsed")
+	}
+	if _, err := ParseStalenessRules("user:"); err != ErrStalenessRule {
+		panic("a rule without a staleness should be rejected")
+	}
+
+	block := func(key string) []byte {
+		return []byte("VALUE " + key + " 0 5\r\nvalue\r\n")
+	}
+	shield := NewShieldCache(ShieldOptions{
+		TTL:       time.Hour,
+		MaxBytes:  2 * (len("hot_a") + len(block("hot_a")) + model.CacheEntryOverhead),
+		Staleness: []StalenessRule{{Prefix: "hot_", MaxStaleness: time.Hour}, {Prefix: "hot_never", MaxStaleness: 0}, {Prefix: "hot_brief", MaxStaleness: time.Millisecond}},
+	})
+	shield.Fill("hot_a", block("hot_a"), 0)
+	if _, forward, _ := shield.Lookup([]string{"hot_a"}, false); len(forward) != 1 {
+		panic("a key shouldn't be cached before it's hot")
+	}
+	shield.Report(map[string]uint64{"hot_a": 1, "hot_b": 1, "hot_c": 1, "hot_never": 1, "hot_brief": 1}, model.WindowsMetadata{})
+	_, _, sequence := shield.Lookup([]string{"hot_a"}, false)
+	shield.Fill("hot_a", block("hot_a"), sequence)
+	if cached, forward, _ := shield.Lookup([]string{"hot_a", "cold"}, false); string(cached) != string(block("hot_a")) || !reflect.DeepEqual(forward, []string{"cold"}) {
+		panic("a hot key should be served from the cache")
+	}
+
+	// a fetch forwarded before a write doesn't fill the cache with the value it overwrote
+	_, _, sequence = shield.Lookup([]string{"hot_b"}, false)
+	shield.Invalidate("hot_b")
+	shield.Fill("hot_b", block("hot_b"), sequence)
+	if _, forward, _ := shield.Lookup([]string{"hot_b"}, false); len(forward) != 1 {
+		panic("a fetch older than the invalidation shouldn't fill the cache")
+	}
+	shield.Invalidate("hot_a")
+	if _, forward, _ := shield.Lookup([]string{"hot_a"}, false); len(forward) != 1 {
+		panic("a write should invalidate the cached key")
+	}
+
+	_, _, sequence = shield.Lookup(nil, false)
+	shield.Fill("hot_never", block("hot_never"), sequence)
+	shield.Fill("hot_brief", block("hot_brief"), sequence)
+	time.Sleep(5 * time.Millisecond)
+	if _, forward, _ := shield.Lookup([]string{"hot_never", "hot_brief"}, false); len(forward) != 2 {
+		panic("a key should be served no longer than its max staleness")
+	}
+
+	shield.Fill("hot_a", block("hot_a"), sequence)
+	shield.Fill("hot_b", block("hot_b"), sequence)
+	shield.Lookup([]string{"hot_a"}, false)
+	shield.Fill("hot_c", block("hot_c"), sequence)
+	if _, forward, _ := shield.Lookup([]string{"hot_a", "hot_b", "hot_c"}, false); !reflect.DeepEqual(forward, []string{"hot_b"}) {
+		panic("the least recently used key should be evicted beyond the memory cap")
+	}
+	if stats := shield.Stats(); stats.Keys != 2 || stats.Bytes > 2*(len("hot_a")+len(block("hot_a"))+model.CacheEntryOverhead) || stats.Evictions != 1 || stats.Expirations != 1 {
+		panic("the cache should stay within its memory cap")
+	}
+
+	shield.Report(map[string]uint64{"hot_c": 1}, model.WindowsMetadata{})
+	if stats := shield.Stats(); stats.Keys != 1 {
+		panic("the keys no longer hot should be dropped")
+	}
+
+	// a key written while it's cold, and hot by the time its fetch forwarded before the write is answered
+	_, _, sequence = shield.Lookup([]string{"hot_d"}, false)
+	shield.Invalidate("hot_d")
+	shield.Report(map[string]uint64{"hot_c": 1, "hot_d": 1}, model.WindowsMetadata{})
+	shield.Fill("hot_d", block("hot_d"), sequence)
+	if _, forward, _ := shield.Lookup([]string{"hot_d"}, false); len(forward) != 1 {
+		panic("a fetch older than the invalidation of a cold key shouldn't fill the cache")
+	}
+	// the invalidation is forgotten once the key is reported cold, along with the fetches forwarded before it
+	_, _, sequence = shield.Lookup([]string{"hot_e"}, false)
+	shield.Invalidate("hot_e")
+	shield.Report(map[string]uint64{"hot_c": 1}, model.WindowsMetadata{})
+	shield.Report(map[string]uint64{"hot_c": 1, "hot_e": 1}, model.WindowsMetadata{})
+	shield.Fill("hot_e", block("hot_e"), sequence)
+	if _, forward, _ := shield.Lookup([]string{"hot_e"}, false); len(forward) != 1 {
+		panic("a fetch older than a forgotten invalidation shouldn't fill the cache")
+	}
+}
+
+func TestShieldedProxy(t *testing.T) {
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("cannot listen upstream")
+	}
+	defer upstream.Close()
+	go serveUpstream(upstream)
+
+	scorer := model.NewSimpleKeyScorer(1, time.Minute)
+	rollingWindows := model.NewSimpleRollingWindows(scorer, func() model.GetKeyCounter {
+		return model.NewBucketGetKeyCounter(1)
+	}, 2, 10, 1)
+	proxy := NewProxy(upstream.Addr().String(), time.Second, NewRollingWindowsMcrouterEavesdropper(rollingWindows, scorer))
+	shield := NewShieldCache(ShieldOptions{TTL: time.Hour, MaxBytes: 1 << 20})
+	proxy.EnableShield(shield)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("cannot listen the proxy")
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ServeProxy(conn, proxy)
+		}
+	}()
+
+	client := memcache.New(listener.Addr().String())
+	direct := memcache.New(upstream.Addr().String())
+	client.Set(&memcache.Item{Key: "hot_key", Value: []byte("v1")})
+	client.Set(&memcache.Item{Key: "other_key", Value: []byte("other")})
+	shield.Report(map[string]uint64{"hot_key": 1}, model.WindowsMetadata{})
+	client.Get("hot_key")
+
+	// a write the proxy doesn't see is hidden by the cache, which absorbs the fetches
+	direct.Set(&memcache.Item{Key: "hot_key", Value: []byte("v2")})
+	if items, err := client.GetMulti([]string{"hot_key", "other_key"}); err != nil || string(items["hot_key"].Value) != "v1" || string(items["other_key"].Value) != "other" {
+		panic("a hot key should be served from the cache along with the forwarded keys")
+	}
+	if stats := shield.Stats(); stats.Absorbed != 1 || stats.Fills != 1 {
+		panic("the absorbed fetches should be counted")
+	}
+
+	client.Set(&memcache.Item{Key: "hot_key", Value: []byte("v3")})
+	if item, err := client.Get("hot_key"); err != nil || string(item.Value) != "v3" {
+		panic("a write through the proxy should invalidate the cache")
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		panic("cannot connect the proxy")
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "md hot_key\r\n")
+	if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "HD\r\n" {
+		panic("a meta delete should be forwarded")
+	}
+	if _, err := client.Get("hot_key"); err != memcache.ErrCacheMiss {
+		panic("a meta delete through the proxy should invalidate the cache")
+	}
+	client.Set(&memcache.Item{Key: "hot_key", Value: []byte("v4")})
+	client.Get("hot_key")
+	client.FlushAll()
+	if _, err := client.Get("hot_key"); err != memcache.ErrCacheMiss {
+		panic("a flush through the proxy should flush the cache")
+	}
+}
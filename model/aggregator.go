@@ -1,20 +1,29 @@
 package model
 
 import (
-	"container/heap"
+	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	log "github.com/golang/glog"
-	consul "github.com/hashicorp/consul/api"
 )
 
-// HotKeyEntry is needed for sorting
+// HotKeyEntry is needed for sorting, `Reporters` attributes the merged score to each contributing reporter,
+// and `Error` bounds the overestimate of a score merged from summaries
 type HotKeyEntry struct {
-	Key   string
-	Score uint64
+	Key       string
+	Score     uint64
+	Error     uint64            `json:",omitempty"`
+	Reporters map[string]uint64 `json:",omitempty"`
+	// Pool and Server are the memcached pool and server the key is routed to, when the aggregator attributes shards
+	Pool   string `json:",omitempty"`
+	Server string `json:",omitempty"`
+	// Stats are the merged outcomes of the key's fetches, when its reporters proxy them
+	Stats *KeyStats `json:",omitempty"`
 }
 
 // HotKeyEntries is a slice of `HotKey` with heap interface, and it's maxheap
@@ -40,126 +49,222 @@ func (entries *HotKeyEntries) Pop() interface{} {
 	return item
 }
 
+// ReporterStatus tells what the aggregator made of a discovered reporter's report
+type ReporterStatus string
+
+const (
+	// ReporterReported has a fresh report with hot keys
+	ReporterReported ReporterStatus = "reported"
+	// ReporterHeartbeat has a fresh report without any hot key
+	ReporterHeartbeat ReporterStatus = "heartbeat"
+	// ReporterMissing has no report, it's either never written or expired with a dead reporter
+	ReporterMissing ReporterStatus = "missing"
+	// ReporterStale has a report older than the staleness, which is treated as no data
+	ReporterStale ReporterStatus = "stale"
+	// ReporterIncompatible has a report that can't be parsed or validated, which is treated as no data
+	ReporterIncompatible ReporterStatus = "incompatible"
+)
+
+// AggregatedHotKeys is the consolidated view published by the aggregator
+type AggregatedHotKeys struct {
+	Version   int                       `json:"version"`
+	Timestamp int64                     `json:"timestamp"` // unix milliseconds of the aggregation
+	HotKeys   HotKeyEntries             `json:"hot_keys"`
+	Reporters map[string]ReporterStatus `json:"reporters"`
+	Exact     bool                      `json:"exact,omitempty"`
+	// Generation is bumped whenever the hot keys change, see `GenerationKey`
+	Generation uint64 `json:"generation,omitempty"`
+}
+
+// Generated is the time when the view was aggregated
+func (aggregated *AggregatedHotKeys) Generated() time.Time {
+	return time.Unix(0, aggregated.Timestamp*int64(time.Millisecond))
+}
+
+// AggregatorOptions tunes how a `MemcachedHotKeyAggregator` aggregates
+type AggregatorOptions struct {
+	// TopN is the number of hot keys in the consolidated view
+	TopN int
+	// MergeMode merges the same key's scores of different reports
+	MergeMode MergeMode
+	// MergeSummaries merges the reports' summaries instead of their topN hot keys, it always sums up
+	MergeSummaries bool
+	// Interval is how often the leader aggregates
+	Interval time.Duration
+	// ReportInterval is how often reporters report, reports older than their ttl are treated as no data
+	ReportInterval time.Duration
+	// Exact runs the TPUT rounds with the reporters after collecting their reports for the exact global topN,
+	// it only merges by `MergeSum`, as the bounds of the rounds are bounds of the sums
+	Exact bool
+	// ExactTimeout is how long each exact round waits for the reporters' answers
+	ExactTimeout time.Duration
+	// Scope is what the aggregator aggregates, the zero value aggregates every reporter as the flat tier,
+	// a zone aggregates its reporters, a region its zones' views, and the global tier the regions' views
+	Scope Scope
+	// Shards annotates the hot keys with their memcached servers, and publishes the load of the servers, when it's set
+	Shards ShardAttributor
+	// Mitigation routes the keys which stay hot away by a mcrouter route fragment, when it's set
+	Mitigation *MitigationController
+}
+
 // MemcachedHotKeyAggregator aggregates `MemcachedHotKeyReporter`'s reports
 type MemcachedHotKeyAggregator struct {
 	serviceName     string
 	reportKey       string
-	topN            int
-	interval        int
+	options         AggregatorOptions
+	staleness       time.Duration
 	memcachedClient *memcache.Client
-	consulClient    *consul.Client
+	codec           *ValueCodec
+	publisher       Publisher
+	discovery       ReporterDiscovery
+	elector         Elector
+	m               sync.Mutex
+	state           LeadershipState
+	observers       []func(state LeadershipState)
+	done            chan struct{}
+	// the generation last published, restored from memcached whenever the aggregator starts leading
+	restored    bool
+	generation  uint64
+	lastHotKeys HotKeyEntries
+	// lastUnknown tells the hot keys of the restored generation are unknown, so the next publish bumps it regardless
+	lastUnknown bool
 }
 
-func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) discover() []string {
-	qo := &consul.QueryOptions{
-		AllowStale:        true,
-		RequireConsistent: false,
-	}
-
-	reporters, _, err := memcachedHotKeyAggregator.consulClient.Health().Service(memcachedHotKeyAggregator.serviceName, "", true, qo)
+// discover gives the members of the aggregator's scope
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) discover() []Member {
+	members, err := memcachedHotKeyAggregator.discovery.Discover()
 	if err != nil {
-		log.Warningf("<aggregator> discover `mc_guardian` service failed")
-		reporters = []*consul.ServiceEntry{}
+		log.Warningf("<aggregator> discover reporters failed:%v\n", err)
+		return []Member{}
 	}
 
-	reporterKeys := make([]string, 0, len(reporters))
-	for _, reporter := range reporters {
-		reporterKeys = append(reporterKeys, fmt.Sprintf("%s:%s", memcachedHotKeyAggregator.reportKey, reporter.Node.Address))
+	scoped := make([]Member, 0, len(members))
+	for _, member := range members {
+		if memcachedHotKeyAggregator.options.Scope.Contains(member) {
+			scoped = append(scoped, member)
+		}
 	}
-	return reporterKeys
+	return scoped
 }
 
-func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) elect(interval int) error {
-
-	lockKey := fmt.Sprintf("%s:%s:leader", memcachedHotKeyAggregator.serviceName, memcachedHotKeyAggregator.reportKey)
-	lockOpt := &consul.LockOptions{Key: lockKey}
-	if locker, err := memcachedHotKeyAggregator.consulClient.LockOpts(lockOpt); err == nil {
-		for {
-			// blocks till leadership is acquired
-			if leader, err := locker.Lock(nil); err == nil {
-				ticker := time.NewTicker(time.Duration(interval) * time.Second)
-				for {
-					<-ticker.C // wait till next tick
-					select {   // check if leadership is still in possesion
-					case _, open := <-leader:
-						if !open {
-							log.Infof("<memcached aggregator> leadership lost:%v\n", time.Now())
-							ticker.Stop()
-							break
-						}
-					}
-					log.Infof("<memcached aggregator> start:%v\n", time.Now())
-					memcachedHotKeyAggregator.Aggregate()
-				}
-			} else {
-				log.Warningf("<memcached aggregator> recover from leadership election errror:%v\n", err)
-			}
-		}
-	} else {
-		log.Errorf("<memcached aggregator> stops leadership election due to error:%v\n", err)
-		return err
-	}
+// scopeKey is where the aggregator publishes, and runs its exact rounds
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) scopeKey() string {
+	return ScopeKey(memcachedHotKeyAggregator.reportKey, memcachedHotKeyAggregator.options.Scope)
 }
 
 // Aggregate aggregates reports from all repoters and take the highest topN subset
 func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) Aggregate() error {
+	return memcachedHotKeyAggregator.aggregate(context.Background())
+}
+
+// aggregate gives up as soon as the `ctx` is done, a deposed leader never publishes
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) aggregate(ctx context.Context) error {
 
-	reporterKeys := memcachedHotKeyAggregator.discover()
-	if len(reporterKeys) == 0 {
+	members := memcachedHotKeyAggregator.discover()
+	if tier := memcachedHotKeyAggregator.options.Scope.Tier; tier == RegionTier || tier == GlobalTier {
+		return memcachedHotKeyAggregator.aggregateViews(ctx, members)
+	}
+	if len(members) == 0 {
 		return nil
 	}
+	reporterKeys := make([]string, 0, len(members))
+	for _, member := range members {
+		reporterKeys = append(reporterKeys, fmt.Sprintf("%s:%s", memcachedHotKeyAggregator.reportKey, member.Identity))
+	}
 	reports, err := memcachedHotKeyAggregator.memcachedClient.GetMulti(reporterKeys)
 	if err != nil {
 		return err
 	}
-	hotKeyEntries := HotKeyEntries{}
-	for _, report := range reports {
-		candidates := map[string]uint64{}
-		if err = json.Unmarshal(report.Value, &candidates); err == nil {
-			for key, score := range candidates {
-				hotKeyEntries = append(hotKeyEntries, &HotKeyEntry{key, score})
+	now := time.Now()
+	merger := NewHotKeyMerger(memcachedHotKeyAggregator.options.MergeMode)
+	summaries := map[string]*HotKeySummary{}
+	valid := map[string]*HotKeyReport{}
+	statuses := make(map[string]ReporterStatus, len(reporterKeys))
+	for _, reporterKey := range reporterKeys {
+		identity := strings.TrimPrefix(reporterKey, memcachedHotKeyAggregator.reportKey+":")
+		item, ok := reports[reporterKey]
+		if !ok {
+			// expired or never written, either way there's no data from this reporter
+			statuses[identity] = ReporterMissing
+			continue
+		}
+		report := &HotKeyReport{}
+		rawBytes, err := DecodeValue(item, memcachedHotKeyAggregator.memcachedClient.GetMulti)
+		if err == nil {
+			err = json.Unmarshal(rawBytes, report)
+		}
+		if err != nil {
+			log.Warningf("<memcached aggregator> skips malformed report of %s:%v\n", identity, err)
+			statuses[identity] = ReporterIncompatible
+			continue
+		}
+		if err := report.Validate(identity, now, memcachedHotKeyAggregator.staleness); err != nil {
+			log.Warningf("<memcached aggregator> skips report of %s:%v\n", identity, err)
+			if err == ErrStaleReport {
+				statuses[identity] = ReporterStale
+			} else {
+				statuses[identity] = ReporterIncompatible
 			}
+			continue
 		}
-	}
-	// topN is likely to be small, will switch to `container/heap` for better efficiency
-	heap.Init(&hotKeyEntries)
-	cutN := HotKeyEntries(make([]*HotKeyEntry, 0, memcachedHotKeyAggregator.topN))
-	for t := 0; t < memcachedHotKeyAggregator.topN && hotKeyEntries.Len() > 0; t++ {
-		if top, ok := heap.Pop(&hotKeyEntries).(*HotKeyEntry); ok {
-			cutN = append(cutN, top)
+		if report.Heartbeat() {
+			statuses[identity] = ReporterHeartbeat
+		} else {
+			statuses[identity] = ReporterReported
+		}
+		valid[identity] = report
+		if memcachedHotKeyAggregator.options.MergeSummaries {
+			// a heartbeat might still carry a summary of keys below its threshold
+			summaries[identity] = SummaryOf(report)
+			merger.MergeStats(report)
+		} else {
+			merger.Merge(report)
 		}
 	}
-	hotKeysRawBytes, err := json.Marshal(cutN)
-	if err != nil {
-		return err
-	}
-	aggregateItem := &memcache.Item{
-		Key:   memcachedHotKeyAggregator.reportKey,
-		Value: hotKeysRawBytes,
+	var cutN HotKeyEntries
+	exact := false
+	if memcachedHotKeyAggregator.options.Exact {
+		cutN, exact = memcachedHotKeyAggregator.exactTop(ctx, valid)
+	} else if memcachedHotKeyAggregator.options.MergeSummaries {
+		cutN = MergeSummaries(summaries, memcachedHotKeyAggregator.options.TopN)
+	} else {
+		cutN = merger.Top(memcachedHotKeyAggregator.options.TopN)
 	}
-	return memcachedHotKeyAggregator.memcachedClient.Set(aggregateItem)
+	merger.AttachStats(cutN)
+	return memcachedHotKeyAggregator.publishAggregated(ctx, &AggregatedHotKeys{
+		Version:   ReportSchemaVersion,
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+		HotKeys:   cutN,
+		Reporters: statuses,
+		Exact:     exact,
+	})
 }
 
-// NewMemcachedHotKeyAggregator initializes a `MemcachedHotKeyAggregator`
-func NewMemcachedHotKeyAggregator(serviceName, reportKey string, topN int, interval int, registry McrouterRegistry) *MemcachedHotKeyAggregator {
+// NewMemcachedHotKeyAggregator initializes a `MemcachedHotKeyAggregator` which aggregates the reports of the reporters `discovery` finds as the `options` tell,
+// whenever it's elected the leader by the `elector`, till the `ctx` is done, the reports are read from the servers the `selector` picks,
+// either the mcrouter registry or a memcached pool published to directly
+func NewMemcachedHotKeyAggregator(ctx context.Context, serviceName, reportKey string, options AggregatorOptions, selector memcache.ServerSelector, discovery ReporterDiscovery, elector Elector, codec *ValueCodec, publisher Publisher) (*MemcachedHotKeyAggregator, error) {
 
-	memcachedClient := memcache.NewFromSelector(registry)
-	consulClient, err := NewConsulClient()
-	if err != nil {
-		log.Errorf("cannot get consul client due to %v\n", err)
-		return nil
+	if options.Exact && options.MergeMode != MergeSum && options.MergeMode != "" {
+		return nil, ErrExactMergeMode
 	}
+	memcachedClient := memcache.NewFromSelector(selector)
 
 	aggregator := &MemcachedHotKeyAggregator{
 		serviceName:     serviceName,
 		reportKey:       reportKey,
-		topN:            topN,
+		options:         options,
+		staleness:       time.Duration(ReportTTL(options.ReportInterval)) * time.Second,
 		memcachedClient: memcachedClient,
-		consulClient:    consulClient,
+		codec:           codec,
+		publisher:       publisher,
+		discovery:       discovery,
+		elector:         elector,
+		m:               sync.Mutex{},
+		state:           Campaigning,
+		done:            make(chan struct{}),
 	}
 
-	go func() {
-		aggregator.elect(interval)
-	}()
-	return aggregator
+	go aggregator.lead(ctx, options.Interval)
+	return aggregator, nil
 }
@@ -1,5 +1,12 @@
 package model
 
+import (
+	"context"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
 // GetKeyCounter is a 1 second bucket of keys GET occurances counter
 // it's writtable when it's created, until it's snapshotted, then the counter will freeze
 type GetKeyCounter interface {
@@ -21,15 +28,77 @@ type RollingWindows interface {
 	last() GetKeyCounter
 	Scorer() KeyScorer
 	Roll() map[string]uint64
+	Metadata() WindowsMetadata
 	Increment(key string, delta uint64)
+	// Observe records the outcome of a fetch, a hit of `bytes` or a miss, and its upstream latency, as only a proxy sees them
+	Observe(key string, hit bool, bytes int, latency time.Duration)
+}
+
+// WindowsMetadata describes how the last `Roll` of a `RollingWindows` was produced,
+// and the mergeable summary or the scores of all its keys when those are enabled, and the stats of its hot keys when a proxy observes them,
+// all are readonly
+type WindowsMetadata struct {
+	Width     int
+	TopN      int
+	Threshold uint64
+	Total     uint64
+	Summary   *HotKeySummary
+	Scores    map[string]uint64
+	Stats     map[string]*KeyStats
 }
 
 // HotKeyReporter is a reporter of `RollingWindows` snapshot at a fixed interval
 type HotKeyReporter interface {
-	Report(map[string]uint64)
+	Report(hotKeys map[string]uint64, metadata WindowsMetadata)
+}
+
+// Publisher writes an item to memcached on behalf of reporters and aggregators
+type Publisher interface {
+	Publish(item *memcache.Item) error
+}
+
+// ItemsPublisher is a `Publisher` which publishes the items of an encoded value as a whole, e.g. its chunks and then its manifest,
+// so that what it retries is the latest value of the manifest's key rather than each item on its own
+type ItemsPublisher interface {
+	Publisher
+	PublishItems(items []*memcache.Item) error
 }
 
 // HotKeyAggregator aggregates the reporters' subview into a consolidated view
 type HotKeyAggregator interface {
 	Aggregate() error
 }
+
+// Member is a reporter found by a `ReporterDiscovery`, its `Identity` is the suffix of its report key,
+// and the `Region` and `Zone` place it in the tiers of a hierarchical aggregation
+type Member struct {
+	Identity string
+	Region   string
+	Zone     string
+}
+
+// ReporterDiscovery finds the reporters whose reports the aggregator aggregates
+type ReporterDiscovery interface {
+	Discover() ([]Member, error)
+}
+
+// Elector elects the one aggregator that aggregates
+type Elector interface {
+	// Campaign blocks till the leadership is acquired or `ctx` is done, the channel it gives is closed once the leadership is lost
+	Campaign(ctx context.Context) (<-chan struct{}, error)
+	// Resign gives up the leadership
+	Resign() error
+}
+
+// McrouterResolver gives the candidate addresses a mcrouter listens at, from the `remote` address of a connection it made,
+// no candidate and no error means the resolver doesn't know the remote
+type McrouterResolver interface {
+	Resolve(remote string) ([]string, error)
+}
+
+// ShardAttributor tells the memcached pool and server a key is routed to
+type ShardAttributor interface {
+	Attribute(key string) (pool string, server string, ok bool)
+	// Servers gives the number of servers of every pool
+	Servers() map[string]int
+}
@@ -0,0 +1,156 @@
+package model
+
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	// CacheEntryOverhead is the bookkeeping bytes of a cached key counted against the memory cap besides its key and value
+	CacheEntryOverhead = 64
+	// MaxCacheInvalidations caps the invalidations remembered, they're all forgotten at once beyond it
+	MaxCacheInvalidations = 4096
+)
+
+// CacheStats counts what happened to the entries of a `BoundedCache`, and the keys and bytes cached
+type CacheStats struct {
+	Fills         uint64 `json:"fills"`
+	Invalidations uint64 `json:"invalidations"`
+	Evictions     uint64 `json:"evictions"`
+	Expirations   uint64 `json:"expirations"`
+	Keys          int    `json:"keys"`
+	Bytes         int    `json:"bytes"`
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	size    int
+	expires time.Time
+}
+
+// BoundedCache keeps the values of the keys for a while within a memory cap, the least recently used are evicted beyond it,
+// it's the shared core of the proxy's shield and the client's near cache, which serialize their calls to it
+type BoundedCache struct {
+	maxBytes int
+	entries  map[string]*list.Element
+	lru      *list.List
+	bytes    int
+	// sequence of the invalidations, a read from before the last invalidation of its key, or the last flush, never fills the cache,
+	// nor does one from before the invalidations forgotten once their keys were dropped
+	sequence    uint64
+	flushed     uint64
+	forgotten   uint64
+	invalidated map[string]uint64
+	stats       CacheStats
+}
+
+// NewBoundedCache initializes an empty `BoundedCache` of `maxBytes`
+func NewBoundedCache(maxBytes int) *BoundedCache {
+	return &BoundedCache{
+		maxBytes:    maxBytes,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+		invalidated: map[string]uint64{},
+	}
+}
+
+// Get gives the value of `key` unless it's missing or expired by `now`
+func (boundedCache *BoundedCache) Get(key string, now time.Time) (interface{}, bool) {
+	element, ok := boundedCache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		boundedCache.remove(element)
+		boundedCache.stats.Expirations++
+		return nil, false
+	}
+	boundedCache.lru.MoveToFront(element)
+	return entry.value, true
+}
+
+// Sequence is what a read missing the cache fills it with
+func (boundedCache *BoundedCache) Sequence() uint64 {
+	return boundedCache.sequence
+}
+
+// Fill caches the `value` of `key` read since the `sequence` for the `ttl`, unless it was invalidated meanwhile,
+// `size` is the bytes of the key and value
+func (boundedCache *BoundedCache) Fill(key string, value interface{}, size int, ttl time.Duration, sequence uint64) {
+	if boundedCache.flushed > sequence || boundedCache.forgotten > sequence || boundedCache.invalidated[key] > sequence {
+		return
+	}
+	size += CacheEntryOverhead
+	if size > boundedCache.maxBytes {
+		return
+	}
+	if element, ok := boundedCache.entries[key]; ok {
+		boundedCache.remove(element)
+	}
+	for boundedCache.bytes+size > boundedCache.maxBytes {
+		boundedCache.remove(boundedCache.lru.Back())
+		boundedCache.stats.Evictions++
+	}
+	boundedCache.entries[key] = boundedCache.lru.PushFront(&cacheEntry{key: key, value: value, size: size, expires: time.Now().Add(ttl)})
+	boundedCache.bytes += size
+	boundedCache.stats.Fills++
+}
+
+// Invalidate drops the cached `key` once it's written, and keeps the reads from before the write from filling it,
+// whether it's cached or not, as it may be by the time they're answered
+func (boundedCache *BoundedCache) Invalidate(key string) {
+	if len(boundedCache.invalidated) >= MaxCacheInvalidations {
+		// the keys written but never retained or dropped, e.g. cold ones, would pile up otherwise
+		boundedCache.forgotten = boundedCache.sequence
+		boundedCache.invalidated = map[string]uint64{}
+	}
+	boundedCache.sequence++
+	boundedCache.invalidated[key] = boundedCache.sequence
+	if element, ok := boundedCache.entries[key]; ok {
+		boundedCache.remove(element)
+		boundedCache.stats.Invalidations++
+	}
+}
+
+// Retain drops the cached keys, and forgets the invalidations of the keys, which aren't to `keep`,
+// the reads from before the forgotten invalidations never fill the cache
+func (boundedCache *BoundedCache) Retain(keep func(key string) bool) {
+	for key, element := range boundedCache.entries {
+		if !keep(key) {
+			boundedCache.remove(element)
+		}
+	}
+	for key, sequence := range boundedCache.invalidated {
+		if !keep(key) {
+			if sequence > boundedCache.forgotten {
+				boundedCache.forgotten = sequence
+			}
+			delete(boundedCache.invalidated, key)
+		}
+	}
+}
+
+// Flush drops every cached key, and keeps the reads from before the flush from filling it
+func (boundedCache *BoundedCache) Flush() {
+	boundedCache.sequence++
+	boundedCache.flushed = boundedCache.sequence
+	boundedCache.invalidated = map[string]uint64{}
+	boundedCache.entries = map[string]*list.Element{}
+	boundedCache.lru.Init()
+	boundedCache.bytes = 0
+}
+
+// Stats gives the counters, and the keys and bytes cached
+func (boundedCache *BoundedCache) Stats() CacheStats {
+	stats := boundedCache.stats
+	stats.Keys, stats.Bytes = len(boundedCache.entries), boundedCache.bytes
+	return stats
+}
+
+func (boundedCache *BoundedCache) remove(element *list.Element) {
+	entry := boundedCache.lru.Remove(element).(*cacheEntry)
+	delete(boundedCache.entries, entry.key)
+	boundedCache.bytes -= entry.size
+}
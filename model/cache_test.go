@@ -0,0 +1,60 @@
+package model
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBoundedCache(t *testing.T) {
+
+	cache := NewBoundedCache(2 * (1 + CacheEntryOverhead))
+	now := time.Now()
+	cache.Fill("a", "1", 1, time.Hour, cache.Sequence())
+	if value, ok := cache.Get("a", now); !ok || value != "1" {
+		panic("a filled key should be cached")
+	}
+	if _, ok := cache.Get("a", now.Add(2*time.Hour)); ok || cache.Stats().Expirations != 1 {
+		panic("a key should expire after its ttl")
+	}
+
+	// a read from before a write never fills the cache, whether the key was cached or not
+	sequence := cache.Sequence()
+	cache.Invalidate("b")
+	cache.Fill("b", "old", 1, time.Hour, sequence)
+	if _, ok := cache.Get("b", now); ok {
+		panic("a read older than the invalidation shouldn't fill the cache")
+	}
+	sequence = cache.Sequence()
+	cache.Invalidate("c")
+	cache.Retain(func(key string) bool { return key != "c" })
+	cache.Fill("c", "old", 1, time.Hour, sequence)
+	if _, ok := cache.Get("c", now); ok {
+		panic("a read older than a forgotten invalidation shouldn't fill the cache")
+	}
+	sequence = cache.Sequence()
+	for i := 0; i <= MaxCacheInvalidations; i++ {
+		cache.Invalidate(fmt.Sprintf("cold:%d", i))
+	}
+	if len(cache.invalidated) > MaxCacheInvalidations {
+		panic("the invalidations remembered should be capped")
+	}
+	cache.Fill("cold:0", "old", 1, time.Hour, sequence)
+	if _, ok := cache.Get("cold:0", now); ok {
+		panic("a read older than the capped invalidations shouldn't fill the cache")
+	}
+
+	sequence = cache.Sequence()
+	cache.Fill("a", "1", 1, time.Hour, sequence)
+	cache.Fill("b", "2", 1, time.Hour, sequence)
+	cache.Get("a", now)
+	cache.Fill("c", "3", 1, time.Hour, sequence)
+	if _, ok := cache.Get("b", now); ok || cache.Stats().Evictions != 1 || cache.Stats().Keys != 2 {
+		panic("the least recently used key should be evicted beyond the memory cap")
+	}
+	cache.Flush()
+	cache.Fill("a", "1", 1, time.Hour, sequence)
+	if stats := cache.Stats(); stats.Keys != 0 || stats.Bytes != 0 {
+		panic("a read older than the flush shouldn't fill the cache")
+	}
+}
@@ -0,0 +1,214 @@
+package model
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/golang/snappy"
+)
+
+// Compression is the compression of report values
+type Compression string
+
+const (
+	// NoCompression writes the json as is
+	NoCompression Compression = "none"
+	// GzipCompression compresses the json with gzip
+	GzipCompression Compression = "gzip"
+	// SnappyCompression compresses the json with snappy
+	SnappyCompression Compression = "snappy"
+)
+
+const (
+	// MaxItemBytes is memcached's default item size limit
+	MaxItemBytes = 1024 * 1024
+	// DefaultChunkBytes leaves room for the key and the item header within `MaxItemBytes`
+	DefaultChunkBytes = MaxItemBytes - 4*1024
+	// DefaultChunkExpiration (seconds) is the expiration of chunks of a value that never expires,
+	// so that the chunks of superseded generations eventually disappear
+	DefaultChunkExpiration = 60 * 60
+)
+
+// a framed value starts with `frameMarker`, which never starts a json, followed by its kind
+const (
+	frameMarker  = byte(0)
+	frameGzip    = byte('g')
+	frameSnappy  = byte('s')
+	frameChunked = byte('m')
+)
+
+var (
+	// ErrUnknownCompression is an error of an unsupported compression
+	ErrUnknownCompression = errors.New("unknown compression")
+	// ErrCorruptedValue is an error when a framed value or its chunks can't be decoded
+	ErrCorruptedValue = errors.New("corrupted value")
+)
+
+// chunkManifest is written at the key of a chunked value, the chunks are at `key:generation:index`
+type chunkManifest struct {
+	Generation int64  `json:"generation"`
+	Chunks     int    `json:"chunks"`
+	Bytes      int    `json:"bytes"`
+	Checksum   uint32 `json:"checksum"`
+}
+
+// ValueCodec encodes a value into memcached items, compressed and chunked when it exceeds the chunk size
+type ValueCodec struct {
+	compression Compression
+	chunkBytes  int
+}
+
+// Encode gives the items to write for the `value` at `key`, the last item is always the one at `key`,
+// and it must be written after all the others, so that readers never see a manifest of missing chunks
+func (codec *ValueCodec) Encode(key string, value []byte, expiration int32) ([]*memcache.Item, error) {
+
+	framed, err := compress(value, codec.compression)
+	if err != nil {
+		return nil, err
+	}
+	if len(framed) <= codec.chunkBytes {
+		return []*memcache.Item{{Key: key, Value: framed, Expiration: expiration}}, nil
+	}
+
+	chunkExpiration := expiration
+	if chunkExpiration == 0 {
+		chunkExpiration = DefaultChunkExpiration
+	}
+	manifest := &chunkManifest{
+		Generation: time.Now().UnixNano(),
+		Chunks:     (len(framed) + codec.chunkBytes - 1) / codec.chunkBytes,
+		Bytes:      len(framed),
+		Checksum:   crc32.ChecksumIEEE(framed),
+	}
+	items := make([]*memcache.Item, 0, manifest.Chunks+1)
+	for c := 0; c < manifest.Chunks; c++ {
+		to := (c + 1) * codec.chunkBytes
+		if to > len(framed) {
+			to = len(framed)
+		}
+		items = append(items, &memcache.Item{
+			Key:        chunkKey(key, manifest.Generation, c),
+			Value:      framed[c*codec.chunkBytes : to],
+			Expiration: chunkExpiration,
+		})
+	}
+	rawBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return append(items, &memcache.Item{
+		Key:        key,
+		Value:      append([]byte{frameMarker, frameChunked}, rawBytes...),
+		Expiration: expiration,
+	}), nil
+}
+
+func chunkKey(key string, generation int64, index int) string {
+	return fmt.Sprintf("%s:%d:%d", key, generation, index)
+}
+
+func compress(value []byte, compression Compression) ([]byte, error) {
+	switch compression {
+	case NoCompression, "":
+		return value, nil
+	case GzipCompression:
+		buf := bytes.NewBuffer([]byte{frameMarker, frameGzip})
+		writer := gzip.NewWriter(buf)
+		if _, err := writer.Write(value); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case SnappyCompression:
+		return append([]byte{frameMarker, frameSnappy}, snappy.Encode(nil, value)...), nil
+	default:
+		return nil, ErrUnknownCompression
+	}
+}
+
+func decompress(framed []byte) ([]byte, error) {
+	if len(framed) < 2 || framed[0] != frameMarker {
+		// a plain json value
+		return framed, nil
+	}
+	switch framed[1] {
+	case frameGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(framed[2:]))
+		if err != nil {
+			return nil, ErrCorruptedValue
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	case frameSnappy:
+		return snappy.Decode(nil, framed[2:])
+	default:
+		return nil, ErrCorruptedValue
+	}
+}
+
+// DecodeValue gives back the json of an item written by `ValueCodec`, plain json values are given as they are,
+// `getMulti` fetches the chunks when the item is a manifest of a chunked value
+func DecodeValue(item *memcache.Item, getMulti func(keys []string) (map[string]*memcache.Item, error)) ([]byte, error) {
+
+	value := item.Value
+	if len(value) < 2 || value[0] != frameMarker || value[1] != frameChunked {
+		return decompress(value)
+	}
+
+	manifest := &chunkManifest{}
+	if err := json.Unmarshal(value[2:], manifest); err != nil || manifest.Chunks <= 0 {
+		return nil, ErrCorruptedValue
+	}
+	keys := make([]string, 0, manifest.Chunks)
+	for c := 0; c < manifest.Chunks; c++ {
+		keys = append(keys, chunkKey(item.Key, manifest.Generation, c))
+	}
+	chunks, err := getMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	framed := make([]byte, 0, manifest.Bytes)
+	for _, key := range keys {
+		chunk, ok := chunks[key]
+		if !ok {
+			return nil, ErrCorruptedValue
+		}
+		framed = append(framed, chunk.Value...)
+	}
+	if len(framed) != manifest.Bytes || crc32.ChecksumIEEE(framed) != manifest.Checksum {
+		return nil, ErrCorruptedValue
+	}
+	return decompress(framed)
+}
+
+// ParseCompression validates the compression name
+func ParseCompression(name string) (Compression, error) {
+	switch compression := Compression(name); compression {
+	case NoCompression, GzipCompression, SnappyCompression:
+		return compression, nil
+	case "":
+		return NoCompression, nil
+	default:
+		return NoCompression, ErrUnknownCompression
+	}
+}
+
+// NewValueCodec initializes a `ValueCodec`, values beyond `chunkBytes` after compression are chunked
+func NewValueCodec(compression Compression, chunkBytes int) *ValueCodec {
+	if chunkBytes <= 0 || chunkBytes > DefaultChunkBytes {
+		chunkBytes = DefaultChunkBytes
+	}
+	return &ValueCodec{
+		compression: compression,
+		chunkBytes:  chunkBytes,
+	}
+}
@@ -0,0 +1,93 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func itemsGetter(items []*memcache.Item) func(keys []string) (map[string]*memcache.Item, error) {
+	return func(keys []string) (map[string]*memcache.Item, error) {
+		got := map[string]*memcache.Item{}
+		for _, key := range keys {
+			for _, item := range items {
+				if item.Key == key {
+					got[key] = item
+				}
+			}
+		}
+		return got, nil
+	}
+}
+
+func largeJSON(keys int) []byte {
+	buf := bytes.NewBufferString("{")
+	for k := 0; k < keys; k++ {
+		if k > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(buf, `"some_rather_long_hot_key_%d":%d`, k, k)
+	}
+	buf.WriteString("}")
+	return buf.Bytes()
+}
+
+func TestValueCodec(t *testing.T) {
+
+	value := largeJSON(100)
+	for _, compression := range []Compression{NoCompression, GzipCompression, SnappyCompression} {
+		items, err := NewValueCodec(compression, 0).Encode("some_key", value, 3)
+		if err != nil || len(items) != 1 || items[0].Key != "some_key" || items[0].Expiration != 3 {
+			panic("small value should be written as a single item")
+		}
+		if compression == NoCompression && !bytes.Equal(items[0].Value, value) {
+			panic("uncompressed value should be plain json")
+		}
+		decoded, err := DecodeValue(items[0], itemsGetter(items))
+		if err != nil || !bytes.Equal(decoded, value) {
+			panic("value should be decoded as it was")
+		}
+	}
+}
+
+func TestChunkedValueCodec(t *testing.T) {
+
+	value := largeJSON(1000)
+	for _, compression := range []Compression{NoCompression, GzipCompression, SnappyCompression} {
+		items, err := NewValueCodec(compression, 128).Encode("some_key", value, 0)
+		if err != nil || len(items) < 3 {
+			panic("large value should be chunked")
+		}
+		manifest := items[len(items)-1]
+		if manifest.Key != "some_key" || manifest.Expiration != 0 {
+			panic("manifest should be the last item at the key")
+		}
+		for _, chunk := range items[:len(items)-1] {
+			if len(chunk.Value) > 128 || chunk.Expiration != DefaultChunkExpiration {
+				panic("chunks should be within the chunk size and eventually expire")
+			}
+		}
+		decoded, err := DecodeValue(manifest, itemsGetter(items))
+		if err != nil || !bytes.Equal(decoded, value) {
+			panic("chunked value should be decoded as it was")
+		}
+		if _, err = DecodeValue(manifest, itemsGetter(items[1:])); err != ErrCorruptedValue {
+			panic("chunked value with a missing chunk should be corrupted")
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+
+	if compression, err := ParseCompression("snappy"); err != nil || compression != SnappyCompression {
+		panic("snappy should be supported")
+	}
+	if compression, err := ParseCompression(""); err != nil || compression != NoCompression {
+		panic("no compression by default")
+	}
+	if _, err := ParseCompression("lz4"); err != ErrUnknownCompression {
+		panic("lz4 is not supported")
+	}
+}
@@ -0,0 +1,203 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// fakeConsul serves the agent's service registration and deregistration with the health of the registered services, which are all passing,
+// the sessions, and the kv locks of the sessions, requests without the `token` are denied once it's set
+type fakeConsul struct {
+	m        sync.Mutex
+	server   *httptest.Server
+	token    string
+	index    uint64
+	changed  chan struct{}
+	services map[string]*consul.AgentServiceRegistration
+	sessions map[string]bool
+	kv       map[string]*consul.KVPair
+}
+
+func newFakeConsul() *fakeConsul {
+	fake := &fakeConsul{
+		index:    1,
+		changed:  make(chan struct{}),
+		services: map[string]*consul.AgentServiceRegistration{},
+		sessions: map[string]bool{},
+		kv:       map[string]*consul.KVPair{},
+	}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	return fake
+}
+
+// Client gives a client of the `token`
+func (fake *fakeConsul) Client(token string) *consul.Client {
+	client, err := consul.NewClient(&consul.Config{Address: strings.TrimPrefix(fake.server.URL, "http://"), Token: token})
+	if err != nil {
+		panic("consul client should be created")
+	}
+	return client
+}
+
+func (fake *fakeConsul) Close() {
+	fake.server.Close()
+}
+
+// SetToken rotates the token, the sessions of the previous token are invalidated
+func (fake *fakeConsul) SetToken(token string) {
+	fake.m.Lock()
+	defer fake.m.Unlock()
+	fake.token = token
+	for session := range fake.sessions {
+		fake.invalidate(session)
+	}
+}
+
+// Invalidate invalidates the session holding the lock of `key`, as if it had expired
+func (fake *fakeConsul) Invalidate(key string) {
+	fake.m.Lock()
+	defer fake.m.Unlock()
+	if pair, ok := fake.kv[key]; ok {
+		fake.invalidate(pair.Session)
+	}
+}
+
+// Holder gives the session holding the lock of `key`
+func (fake *fakeConsul) Holder(key string) string {
+	fake.m.Lock()
+	defer fake.m.Unlock()
+	if pair, ok := fake.kv[key]; ok {
+		return pair.Session
+	}
+	return ""
+}
+
+func (fake *fakeConsul) invalidate(session string) {
+	delete(fake.sessions, session)
+	for _, pair := range fake.kv {
+		if pair.Session == session {
+			pair.Session = ""
+		}
+	}
+	fake.change()
+}
+
+func (fake *fakeConsul) change() {
+	fake.index++
+	close(fake.changed)
+	fake.changed = make(chan struct{})
+}
+
+func (fake *fakeConsul) serve(w http.ResponseWriter, r *http.Request) {
+	fake.m.Lock()
+	defer fake.m.Unlock()
+	if fake.token != "" && r.Header.Get("X-Consul-Token") != fake.token {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/agent/service/register":
+		registration := &consul.AgentServiceRegistration{}
+		if json.NewDecoder(r.Body).Decode(registration) != nil || registration.Check == nil || registration.Check.HTTP == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fake.services[registration.ID] = registration
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		if _, ok := fake.services[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(fake.services, id)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		entries := []*consul.ServiceEntry{}
+		for _, registration := range fake.services {
+			if registration.Name == strings.TrimPrefix(r.URL.Path, "/v1/health/service/") {
+				entries = append(entries, &consul.ServiceEntry{
+					Node: &consul.Node{Address: "10.0.0.1"},
+					Service: &consul.AgentService{
+						ID:      registration.ID,
+						Service: registration.Name,
+						Address: registration.Address,
+						Port:    registration.Port,
+						Meta:    registration.Meta,
+					},
+				})
+			}
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(fake.index, 10))
+		json.NewEncoder(w).Encode(entries)
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/session/create":
+		session := fmt.Sprintf("session-%d", fake.index)
+		fake.sessions[session] = true
+		fake.change()
+		json.NewEncoder(w).Encode(map[string]string{"ID": session})
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		session := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+		if !fake.sessions[session] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]*consul.SessionEntry{{ID: session, TTL: "15s"}})
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		fake.invalidate(strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+		json.NewEncoder(w).Encode(true)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		if index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); index == fake.index {
+			// blocks till the next change, or shortly as if the wait has timed out
+			changed := fake.changed
+			fake.m.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(50 * time.Millisecond):
+			}
+			fake.m.Lock()
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(fake.index, 10))
+		pair, ok := fake.kv[strings.TrimPrefix(r.URL.Path, "/v1/kv/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]*consul.KVPair{pair})
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		value, _ := ioutil.ReadAll(r.Body)
+		flags, _ := strconv.ParseUint(r.URL.Query().Get("flags"), 10, 64)
+		pair, ok := fake.kv[key]
+		if !ok {
+			pair = &consul.KVPair{Key: key}
+		}
+		if session := r.URL.Query().Get("acquire"); session != "" {
+			if !fake.sessions[session] || (pair.Session != "" && pair.Session != session) {
+				json.NewEncoder(w).Encode(false)
+				return
+			}
+			pair.Session = session
+		} else if session := r.URL.Query().Get("release"); session != "" {
+			if pair.Session != session {
+				json.NewEncoder(w).Encode(false)
+				return
+			}
+			pair.Session = ""
+		}
+		pair.Value, pair.Flags, pair.ModifyIndex = value, flags, fake.index+1
+		fake.kv[key] = pair
+		fake.change()
+		json.NewEncoder(w).Encode(true)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,73 +17,228 @@ import (
 // ErrParseMcrouter is an error when parsing mcrouter address string
 var ErrParseMcrouter = errors.New("mcrouter parse error")
 
+const (
+	// DefaultProbeInterval is how often the registered mcrouters are probed
+	DefaultProbeInterval = 10 * time.Second
+	// DefaultProbeFailures is the number of consecutive failed probes which evicts a mcrouter
+	DefaultProbeFailures = 3
+	// MaxRejections is the number of the latest rejections a registry keeps
+	MaxRejections = 100
+)
+
 // McrouterRegistry registers/lists mcrouter hosts known from the connections
 type McrouterRegistry interface {
 	memcache.ServerSelector
 	Register(mcrouter string) error
 	Unregister(mcrouter string) error
+	// Members gives the registered mcrouters with the status of their last probe
+	Members() []McrouterMember
+	// Rejections gives the latest candidates which failed to register, with the reason
+	Rejections() []McrouterRejection
+	// StartProbing probes the registered mcrouters every `interval`, and evicts those failing `failures` probes in a row
+	StartProbing(interval time.Duration, failures int)
+}
+
+// McrouterMember is a registered mcrouter, keyed by its `host:mcrouterPort` address
+type McrouterMember struct {
+	Address string `json:"address"`
+	// Usages is the number of open connections from the mcrouter
+	Usages int `json:"usages"`
+	// Healthy mcrouters are served, an evicted one comes back once it passes a probe again
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"` // consecutive failed probes
+	LastProbe time.Time `json:"last_probe"`
+}
+
+// McrouterRejection is a connection which didn't register a mcrouter, the `Candidate` is empty when none was resolved
+type McrouterRejection struct {
+	Remote    string    `json:"remote"`
+	Candidate string    `json:"candidate,omitempty"`
+	Reason    string    `json:"reason"`
+	Time      time.Time `json:"time"`
 }
 
 // SimpleMcrouterRegistry is a implementer of McrouterRegistry
 type SimpleMcrouterRegistry struct {
-	m            sync.Mutex
-	ss           *memcache.ServerList
-	mcrouterPort int
-	mcrouters    map[string]int
+	m          sync.Mutex
+	ss         *memcache.ServerList
+	resolver   McrouterResolver
+	mcrouters  map[string]*McrouterMember
+	remotes    map[string]string
+	rejections []McrouterRejection
+	failures   int
 }
 
-// Register tries registering a candidate `mcrouter`, it actually tests if a tcp `version\r\n` request gets the proper response back.
-func (simpleMcrouterRegistry *SimpleMcrouterRegistry) Register(mcrouter string) error {
+// Register tries registering the mcrouter which made a connection from the `remote` address, the candidates the resolver gives are
+// tested in order, it actually tests if a tcp `version\r\n` request gets the proper response back,
+// every connection from an already registered mcrouter adds to its usages
+func (simpleMcrouterRegistry *SimpleMcrouterRegistry) Register(remote string) error {
 	simpleMcrouterRegistry.m.Lock()
-	defer simpleMcrouterRegistry.m.Unlock()
-
-	if _, ok := simpleMcrouterRegistry.mcrouters[mcrouter]; ok {
+	_, ok := simpleMcrouterRegistry.remotes[remote]
+	simpleMcrouterRegistry.m.Unlock()
+	if ok {
 		return nil
 	}
 
-	if testing, err := parseMcrouter(mcrouter, simpleMcrouterRegistry.mcrouterPort); err == nil && testMcrouter(testing) {
-		simpleMcrouterRegistry.mcrouters[testing]++
-		simpleMcrouterRegistry.unsafeUpdateServerList()
+	candidates, err := simpleMcrouterRegistry.resolver.Resolve(remote)
+	if err != nil {
+		simpleMcrouterRegistry.reject(remote, "", fmt.Sprintf("unresolved: %v", err))
+		return err
+	}
+	if len(candidates) == 0 {
+		simpleMcrouterRegistry.reject(remote, "", "no candidate")
+		return ErrParseMcrouter
+	}
+	for _, candidate := range candidates {
+		simpleMcrouterRegistry.m.Lock()
+		_, known := simpleMcrouterRegistry.mcrouters[candidate]
+		simpleMcrouterRegistry.m.Unlock()
+		// the test takes up to a second, the lock isn't held meanwhile
+		if !known {
+			if err := testMcrouter(candidate); err != nil {
+				simpleMcrouterRegistry.reject(remote, candidate, err.Error())
+				continue
+			}
+		}
+		simpleMcrouterRegistry.m.Lock()
+		member, ok := simpleMcrouterRegistry.mcrouters[candidate]
+		if !ok {
+			member = &McrouterMember{Address: candidate, Healthy: true, LastProbe: time.Now()}
+			simpleMcrouterRegistry.mcrouters[candidate] = member
+			simpleMcrouterRegistry.unsafeUpdateServerList()
+		}
+		member.Usages++
+		simpleMcrouterRegistry.remotes[remote] = candidate
+		simpleMcrouterRegistry.m.Unlock()
 		return nil
 	}
 	return ErrParseMcrouter
 }
 
-// Unregister reduces the `usages` of a mcrouter
-func (simpleMcrouterRegistry *SimpleMcrouterRegistry) Unregister(mcrouter string) error {
+func (simpleMcrouterRegistry *SimpleMcrouterRegistry) reject(remote string, candidate string, reason string) {
+	log.Warningf("<discovery> rejected %s of %s: %s\n", candidate, remote, reason)
 	simpleMcrouterRegistry.m.Lock()
 	defer simpleMcrouterRegistry.m.Unlock()
-
-	if _, ok := simpleMcrouterRegistry.mcrouters[mcrouter]; !ok {
-		return nil
+	simpleMcrouterRegistry.rejections = append(simpleMcrouterRegistry.rejections, McrouterRejection{
+		Remote:    remote,
+		Candidate: candidate,
+		Reason:    reason,
+		Time:      time.Now(),
+	})
+	if len(simpleMcrouterRegistry.rejections) > MaxRejections {
+		simpleMcrouterRegistry.rejections = simpleMcrouterRegistry.rejections[len(simpleMcrouterRegistry.rejections)-MaxRejections:]
 	}
+}
 
-	if parsed, err := parseMcrouter(mcrouter, simpleMcrouterRegistry.mcrouterPort); err == nil {
-		simpleMcrouterRegistry.mcrouters[parsed]--
-		simpleMcrouterRegistry.unsafeUpdateServerList()
+// Rejections gives a copy of the latest rejections, from the oldest to the latest
+func (simpleMcrouterRegistry *SimpleMcrouterRegistry) Rejections() []McrouterRejection {
+	simpleMcrouterRegistry.m.Lock()
+	defer simpleMcrouterRegistry.m.Unlock()
+	return append([]McrouterRejection{}, simpleMcrouterRegistry.rejections...)
+}
+
+// Unregister reduces the `usages` of the mcrouter the `remote` connection registered, and drops it once none of its connections is open
+func (simpleMcrouterRegistry *SimpleMcrouterRegistry) Unregister(remote string) error {
+	simpleMcrouterRegistry.m.Lock()
+	defer simpleMcrouterRegistry.m.Unlock()
+
+	address, ok := simpleMcrouterRegistry.remotes[remote]
+	if !ok {
 		return nil
 	}
-	return ErrParseMcrouter
+	delete(simpleMcrouterRegistry.remotes, remote)
+	if member, ok := simpleMcrouterRegistry.mcrouters[address]; ok {
+		if member.Usages--; member.Usages <= 0 {
+			delete(simpleMcrouterRegistry.mcrouters, address)
+			simpleMcrouterRegistry.unsafeUpdateServerList()
+		}
+	}
+	return nil
 }
 
 func (simpleMcrouterRegistry *SimpleMcrouterRegistry) unsafeUpdateServerList() {
 	servers := make([]string, 0, len(simpleMcrouterRegistry.mcrouters))
-	for m, usages := range simpleMcrouterRegistry.mcrouters {
-		if usages > 0 {
-			servers = append(servers, m)
+	for address, member := range simpleMcrouterRegistry.mcrouters {
+		if member.Healthy {
+			servers = append(servers, address)
 		}
 	}
+	// a stable order keeps the keys on the same mcrouters as long as the members don't change
+	sort.Strings(servers)
 	simpleMcrouterRegistry.ss.SetServers(servers...)
 }
 
-func parseMcrouter(mcrouter string, mcrouterPort int) (string, error) {
-	if colon := strings.LastIndex(mcrouter, ":"); colon > 0 && colon < len(mcrouter)-1 {
-		host := mcrouter[0:colon]
-		if _, err := strconv.Atoi(mcrouter[colon+1:]); err == nil {
-			return fmt.Sprintf("%s:%d", host, mcrouterPort), nil
+// Members gives a copy of the registered mcrouters ordered by address
+func (simpleMcrouterRegistry *SimpleMcrouterRegistry) Members() []McrouterMember {
+	simpleMcrouterRegistry.m.Lock()
+	defer simpleMcrouterRegistry.m.Unlock()
+	members := make([]McrouterMember, 0, len(simpleMcrouterRegistry.mcrouters))
+	for _, member := range simpleMcrouterRegistry.mcrouters {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Address < members[j].Address })
+	return members
+}
+
+// probe tests every registered mcrouter once, in parallel,
+// one failing `failures` probes in a row is evicted from the server list, and comes back after a successful probe
+func (simpleMcrouterRegistry *SimpleMcrouterRegistry) probe() {
+	simpleMcrouterRegistry.m.Lock()
+	addresses := make([]string, 0, len(simpleMcrouterRegistry.mcrouters))
+	for address := range simpleMcrouterRegistry.mcrouters {
+		addresses = append(addresses, address)
+	}
+	simpleMcrouterRegistry.m.Unlock()
+
+	passed := make([]bool, len(addresses))
+	wait := sync.WaitGroup{}
+	for i, address := range addresses {
+		wait.Add(1)
+		go func(i int, address string) {
+			defer wait.Done()
+			passed[i] = testMcrouter(address) == nil
+		}(i, address)
+	}
+	wait.Wait()
+
+	simpleMcrouterRegistry.m.Lock()
+	defer simpleMcrouterRegistry.m.Unlock()
+	now, changed := time.Now(), false
+	for i, address := range addresses {
+		member, ok := simpleMcrouterRegistry.mcrouters[address]
+		if !ok {
+			continue
+		}
+		member.LastProbe = now
+		if passed[i] {
+			member.Failures = 0
+			if !member.Healthy {
+				log.Infof("<discovery> %s is back after passing a probe\n", address)
+				member.Healthy, changed = true, true
+			}
+			continue
+		}
+		if member.Failures++; member.Healthy && member.Failures >= simpleMcrouterRegistry.failures {
+			log.Warningf("<discovery> evicts %s after %d failed probes\n", address, member.Failures)
+			member.Healthy, changed = false, true
 		}
 	}
-	return "", ErrParseMcrouter
+	if changed {
+		simpleMcrouterRegistry.unsafeUpdateServerList()
+	}
+}
+
+// StartProbing probes the registered mcrouters every `interval`
+func (simpleMcrouterRegistry *SimpleMcrouterRegistry) StartProbing(interval time.Duration, failures int) {
+	simpleMcrouterRegistry.m.Lock()
+	simpleMcrouterRegistry.failures = failures
+	simpleMcrouterRegistry.m.Unlock()
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			simpleMcrouterRegistry.probe()
+		}
+	}()
 }
 
 // PickServer gives a set of `mcrouter` hosts registered
@@ -96,34 +251,47 @@ func (simpleMcrouterRegistry *SimpleMcrouterRegistry) Each(f func(net.Addr) erro
 	return simpleMcrouterRegistry.ss.Each(f)
 }
 
-func testMcrouter(candidate string) bool {
+// testMcrouter tells why the `candidate` isn't a mcrouter, if it's not
+func testMcrouter(candidate string) error {
 	log.Infof("<discovery> testing:%s for being a mcrouter\n", candidate)
-	if addr, err := net.ResolveTCPAddr("tcp", candidate); err == nil {
-		if conn, err := net.DialTCP("tcp", nil, addr); err == nil {
-			defer conn.Close()
-			if err = conn.SetDeadline(time.Now().Add(1 * time.Second)); err == nil {
-				if _, err = conn.Write([]byte("version\r\n")); err == nil {
-					buf := make([]byte, 128)
-					if read, err := conn.Read(buf); err == nil {
-						// VERSION 36.0.0-master mcrouter
-						if strings.HasSuffix(strings.TrimSpace(string(buf[0:read])), "mcrouter") {
-							return true
-						}
-					}
-				}
-			}
-		}
+	conn, err := net.DialTimeout("tcp", candidate, 1*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(1 * time.Second)); err != nil {
+		return err
+	}
+	if _, err = conn.Write([]byte("version\r\n")); err != nil {
+		return err
+	}
+	buf := make([]byte, 128)
+	read, err := conn.Read(buf)
+	if err != nil {
+		return err
 	}
-	log.Warningf("<discovery> %s failed the test of mcrouter\n", candidate)
-	return false
+	// VERSION 36.0.0-master mcrouter
+	if version := strings.TrimSpace(string(buf[0:read])); !strings.HasSuffix(version, "mcrouter") {
+		log.Warningf("<discovery> %s failed the test of mcrouter\n", candidate)
+		return fmt.Errorf("not a mcrouter: %q", version)
+	}
+	return nil
 }
 
-// NewMcrouterRegistry creates a `SimpleMcrouterRegistry` instance
+// NewMcrouterRegistry creates a `SimpleMcrouterRegistry` instance of the mcrouters listening at the known `port`
 func NewMcrouterRegistry(port int) McrouterRegistry {
+	return NewResolvedMcrouterRegistry(NewPortResolver(port))
+}
+
+// NewResolvedMcrouterRegistry creates a `SimpleMcrouterRegistry` instance of the mcrouters the `resolver` resolves
+func NewResolvedMcrouterRegistry(resolver McrouterResolver) McrouterRegistry {
 	return &SimpleMcrouterRegistry{
-		m:            sync.Mutex{},
-		ss:           &memcache.ServerList{},
-		mcrouterPort: port,
-		mcrouters:    map[string]int{},
+		m:          sync.Mutex{},
+		ss:         &memcache.ServerList{},
+		resolver:   resolver,
+		mcrouters:  map[string]*McrouterMember{},
+		remotes:    map[string]string{},
+		rejections: []McrouterRejection{},
+		failures:   DefaultProbeFailures,
 	}
 }
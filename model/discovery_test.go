@@ -2,6 +2,7 @@ package model
 
 import (
 	"net"
+	"sync/atomic"
 	"testing"
 )
 
@@ -42,3 +43,65 @@ func TestMcrouterRegistry(t *testing.T) {
 		panic("mcrouter registry shoudl serve localhost:8989 but got:" + addr.String())
 	}
 }
+
+func TestMcrouterRegistryProbes(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("cannot start fake mcrouter")
+	}
+	defer l.Close()
+	var healthy int32 = 1
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, len("version\r\n"))
+			conn.Read(buf)
+			if atomic.LoadInt32(&healthy) == 1 {
+				conn.Write([]byte("VERSION 36.0.0-master mcrouter\r\n"))
+			} else {
+				conn.Write([]byte("SERVER_ERROR\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	registry := NewMcrouterRegistry(l.Addr().(*net.TCPAddr).Port).(*SimpleMcrouterRegistry)
+	registry.failures = 2
+	// the connections come from ephemeral ports of the same host
+	registry.Register("127.0.0.1:50001")
+	registry.Register("127.0.0.1:50002")
+	if members := registry.Members(); len(members) != 1 || members[0].Usages != 2 || !members[0].Healthy {
+		panic("every connection of a mcrouter should count as a usage of the same member")
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	registry.probe()
+	if _, err := registry.PickServer("some_key"); err != nil {
+		panic("a single failed probe shouldn't evict the mcrouter")
+	}
+	registry.probe()
+	if members := registry.Members(); members[0].Healthy || members[0].Failures != 2 || members[0].LastProbe.IsZero() {
+		panic("consecutive failed probes should evict the mcrouter")
+	}
+	if _, err := registry.PickServer("some_key"); err == nil {
+		panic("an evicted mcrouter shouldn't be served")
+	}
+	atomic.StoreInt32(&healthy, 1)
+	registry.probe()
+	if _, err := registry.PickServer("some_key"); err != nil {
+		panic("a mcrouter passing a probe again should be served")
+	}
+
+	registry.Unregister("127.0.0.1:50001")
+	registry.Unregister("127.0.0.1:50002")
+	if len(registry.Members()) != 0 {
+		panic("a mcrouter should be dropped once its connections are all closed")
+	}
+	if _, err := registry.PickServer("some_key"); err == nil {
+		panic("a dropped mcrouter shouldn't be served")
+	}
+}
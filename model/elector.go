@@ -0,0 +1,299 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	log "github.com/golang/glog"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// ErrCampaignStopped is an error when a campaign is stopped before the leadership is acquired
+var ErrCampaignStopped = errors.New("campaign stopped")
+
+const (
+	// MinElectionBackoff is the wait before campaigning again after a failed campaign, doubled on every consecutive failure
+	MinElectionBackoff = 1 * time.Second
+	// MaxElectionBackoff is the longest wait between failed campaigns
+	MaxElectionBackoff = 1 * time.Minute
+)
+
+// LeaderKey is the key of the aggregators' leadership of the reports of `reportKey`
+func LeaderKey(serviceName string, reportKey string) string {
+	return fmt.Sprintf("%s:%s:leader", serviceName, reportKey)
+}
+
+// ConsulElector elects the leader by a consul lock, the client, its session and the lock are rebuilt whenever the token rotates
+type ConsulElector struct {
+	m         sync.Mutex
+	key       string
+	newClient func() (*consul.Client, error)
+	client    *consul.Client
+	rotated   chan struct{}
+	locker    *consul.Lock
+	resign    chan struct{}
+}
+
+// rotate rebuilds the client on every token rotation, the leadership of the previous client's session is lost
+func (consulElector *ConsulElector) rotate(rotation <-chan struct{}) {
+	for range rotation {
+		client, err := consulElector.newClient()
+		if err != nil {
+			log.Errorf("<consul elector> cannot rebuild client after token rotation:%v\n", err)
+			continue
+		}
+		consulElector.m.Lock()
+		consulElector.client = client
+		close(consulElector.rotated)
+		consulElector.rotated = make(chan struct{})
+		consulElector.m.Unlock()
+		log.Infof("<consul elector> rebuilt client after token rotation\n")
+	}
+}
+
+// Campaign acquires the consul lock with a new session, a token rotation stops the campaign as if the lock was lost
+func (consulElector *ConsulElector) Campaign(ctx context.Context) (<-chan struct{}, error) {
+	consulElector.m.Lock()
+	client, rotated := consulElector.client, consulElector.rotated
+	consulElector.m.Unlock()
+
+	locker, err := client.LockOpts(&consul.LockOptions{Key: consulElector.key})
+	if err != nil {
+		return nil, err
+	}
+	stop, campaigned := make(chan struct{}), make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-rotated:
+		case <-campaigned:
+			return
+		}
+		close(stop)
+	}()
+	leader, err := locker.Lock(stop)
+	close(campaigned)
+	if err != nil {
+		return nil, err
+	}
+	if leader == nil {
+		return nil, ErrCampaignStopped
+	}
+
+	lost, resign := make(chan struct{}), make(chan struct{})
+	consulElector.m.Lock()
+	consulElector.locker, consulElector.resign = locker, resign
+	consulElector.m.Unlock()
+	go func() {
+		defer close(lost)
+		select {
+		case <-leader:
+		case <-rotated:
+			// the session of the previous token can't be renewed, it's released while it still can be
+			locker.Unlock()
+		case <-resign:
+		}
+	}()
+	return lost, nil
+}
+
+// Resign releases the consul lock
+func (consulElector *ConsulElector) Resign() error {
+	consulElector.m.Lock()
+	defer consulElector.m.Unlock()
+	if consulElector.locker == nil {
+		return nil
+	}
+	close(consulElector.resign)
+	err := consulElector.locker.Unlock()
+	consulElector.locker, consulElector.resign = nil, nil
+	if err == consul.ErrLockNotHeld {
+		return nil
+	}
+	return err
+}
+
+// NewConsulElector initializes a `ConsulElector` of the lock at `key` with a client of `newClient`,
+// which is called again whenever the token rotates on `rotation`, e.g. `ConsulTokenC`
+func NewConsulElector(key string, newClient func() (*consul.Client, error), rotation <-chan struct{}) (*ConsulElector, error) {
+	client, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	consulElector := &ConsulElector{
+		m:         sync.Mutex{},
+		key:       key,
+		newClient: newClient,
+		client:    client,
+		rotated:   make(chan struct{}),
+	}
+	if rotation != nil {
+		go consulElector.rotate(rotation)
+	}
+	return consulElector, nil
+}
+
+// MemcachedLeaseElector elects the leader by a lease key, which the leader holds with its identity,
+// the lease is taken by `add`, renewed by `cas` every third of its ttl, and lost once it can't be renewed within the ttl
+type MemcachedLeaseElector struct {
+	m        sync.Mutex
+	key      string
+	identity string
+	ttl      time.Duration
+	client   *memcache.Client
+	resign   chan struct{}
+}
+
+func (leaseElector *MemcachedLeaseElector) expiration() int32 {
+	return int32(math.Ceil(leaseElector.ttl.Seconds()))
+}
+
+// acquire takes the lease if nobody holds it, or it's released, or renews it if this elector holds it
+func (leaseElector *MemcachedLeaseElector) acquire() (bool, error) {
+	item, err := leaseElector.client.Get(leaseElector.key)
+	if err == memcache.ErrCacheMiss {
+		err = leaseElector.client.Add(&memcache.Item{Key: leaseElector.key, Value: []byte(leaseElector.identity), Expiration: leaseElector.expiration()})
+		if err == memcache.ErrNotStored {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(item.Value) > 0 && string(item.Value) != leaseElector.identity {
+		return false, nil
+	}
+	item.Value, item.Expiration = []byte(leaseElector.identity), leaseElector.expiration()
+	err = leaseElector.client.CompareAndSwap(item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Campaign retries to take the lease every third of its ttl
+func (leaseElector *MemcachedLeaseElector) Campaign(ctx context.Context) (<-chan struct{}, error) {
+	renewal := leaseElector.ttl / 3
+	for {
+		acquired, err := leaseElector.acquire()
+		if err != nil {
+			log.Warningf("<memcached lease:%s> cannot acquire:%v\n", leaseElector.identity, err)
+		}
+		if acquired {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ErrCampaignStopped
+		case <-time.After(renewal):
+		}
+	}
+
+	lost := make(chan struct{})
+	resign := make(chan struct{})
+	leaseElector.m.Lock()
+	leaseElector.resign = resign
+	leaseElector.m.Unlock()
+	go func() {
+		defer close(lost)
+		ticker := time.NewTicker(renewal)
+		defer ticker.Stop()
+		renewed := time.Now()
+		for {
+			select {
+			case <-resign:
+				return
+			case <-ticker.C:
+			}
+			acquired, err := leaseElector.acquire()
+			if acquired {
+				renewed = time.Now()
+				continue
+			}
+			if err == nil || time.Since(renewed) >= leaseElector.ttl {
+				// another elector holds the lease, or this one's lease has expired
+				log.Infof("<memcached lease:%s> lost lease:%v\n", leaseElector.identity, err)
+				return
+			}
+			log.Warningf("<memcached lease:%s> cannot renew:%v\n", leaseElector.identity, err)
+		}
+	}()
+	return lost, nil
+}
+
+// Resign stops renewing the lease, and releases it if it's still held
+func (leaseElector *MemcachedLeaseElector) Resign() error {
+	leaseElector.m.Lock()
+	defer leaseElector.m.Unlock()
+	if leaseElector.resign == nil {
+		return nil
+	}
+	close(leaseElector.resign)
+	leaseElector.resign = nil
+
+	item, err := leaseElector.client.Get(leaseElector.key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if string(item.Value) != leaseElector.identity {
+		return nil
+	}
+	// the release is a cas, it never overwrites a lease another elector took after this one's expired,
+	// the released lease is taken at once by the next campaign, or expires shortly
+	item.Value, item.Expiration = []byte{}, 1
+	err = leaseElector.client.CompareAndSwap(item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		return nil
+	}
+	return err
+}
+
+// NewMemcachedLeaseElector initializes a `MemcachedLeaseElector` of the lease at `key`, held for `ttl` as `identity`
+func NewMemcachedLeaseElector(key string, identity string, ttl time.Duration, client *memcache.Client) *MemcachedLeaseElector {
+	return &MemcachedLeaseElector{
+		m:        sync.Mutex{},
+		key:      key,
+		identity: identity,
+		ttl:      ttl,
+		client:   client,
+	}
+}
+
+// StandaloneElector is always the leader, for a single aggregator
+type StandaloneElector struct {
+	m      sync.Mutex
+	leader chan struct{}
+}
+
+// Campaign acquires the leadership at once
+func (standaloneElector *StandaloneElector) Campaign(ctx context.Context) (<-chan struct{}, error) {
+	standaloneElector.m.Lock()
+	defer standaloneElector.m.Unlock()
+	standaloneElector.leader = make(chan struct{})
+	return standaloneElector.leader, nil
+}
+
+// Resign loses the leadership
+func (standaloneElector *StandaloneElector) Resign() error {
+	standaloneElector.m.Lock()
+	defer standaloneElector.m.Unlock()
+	if standaloneElector.leader != nil {
+		close(standaloneElector.leader)
+		standaloneElector.leader = nil
+	}
+	return nil
+}
+
+// NewStandaloneElector initializes a `StandaloneElector`
+func NewStandaloneElector() *StandaloneElector {
+	return &StandaloneElector{m: sync.Mutex{}}
+}
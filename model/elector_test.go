@@ -0,0 +1,171 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/inexplicable/mc_hotkeys/internal/memcachedtest"
+)
+
+func TestMemcachedLeaseElector(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	first := NewMemcachedLeaseElector("leader", "host1:11211", time.Second, memcache.New(fake.Addr()))
+	second := NewMemcachedLeaseElector("leader", "host2:11211", time.Second, memcache.New(fake.Addr()))
+
+	lost, err := first.Campaign(context.Background())
+	if err != nil {
+		panic("the first campaign should take the lease")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := second.Campaign(ctx); err != ErrCampaignStopped {
+		panic("a held lease should block the campaign till it's stopped")
+	}
+
+	elected := make(chan (<-chan struct{}))
+	go func() {
+		secondLost, _ := second.Campaign(context.Background())
+		elected <- secondLost
+	}()
+	if first.Resign() != nil {
+		panic("resign should release the lease")
+	}
+	<-lost
+	secondLost := <-elected
+	if value, _ := fake.Value("leader"); string(value) != "host2:11211" {
+		panic("a released lease should be taken by the next campaign")
+	}
+
+	// the lease is taken away from the second elector
+	fake.Delete("leader")
+	memcache.New(fake.Addr()).Set(&memcache.Item{Key: "leader", Value: []byte("host1:11211"), Expiration: 1})
+	select {
+	case <-secondLost:
+	case <-time.After(time.Second):
+		panic("a lease held by another elector should be lost")
+	}
+	if second.Resign() != nil {
+		panic("resign should succeed without the lease")
+	}
+	if value, _ := fake.Value("leader"); string(value) != "host1:11211" {
+		panic("resign shouldn't release the lease another elector took")
+	}
+}
+
+func newLeadingAggregator(elector Elector) (*MemcachedHotKeyAggregator, chan LeadershipState) {
+	aggregator := &MemcachedHotKeyAggregator{
+		discovery: NewStaticDiscovery(),
+		elector:   elector,
+		state:     Campaigning,
+		done:      make(chan struct{}),
+	}
+	states := make(chan LeadershipState, 16)
+	aggregator.Observe(func(state LeadershipState) { states <- state })
+	return aggregator, states
+}
+
+func expectStates(states chan LeadershipState, expected ...LeadershipState) {
+	for _, state := range expected {
+		select {
+		case actual := <-states:
+			if actual != state {
+				panic(fmt.Sprintf("leadership should be %v rather than %v", state, actual))
+			}
+		case <-time.After(5 * time.Second):
+			panic(fmt.Sprintf("leadership should become %v", state))
+		}
+	}
+}
+
+func TestLeadStepDown(t *testing.T) {
+
+	elector := NewStandaloneElector()
+	aggregator, states := newLeadingAggregator(elector)
+	ctx, cancel := context.WithCancel(context.Background())
+	go aggregator.lead(ctx, 10*time.Millisecond)
+
+	expectStates(states, Leading)
+	elector.Resign()
+	expectStates(states, SteppingDown, Campaigning, Leading)
+	cancel()
+	expectStates(states, SteppingDown, Stopped)
+	<-aggregator.Done()
+}
+
+func TestLeadConsulLockLoss(t *testing.T) {
+
+	fake := newFakeConsul()
+	defer fake.Close()
+	elector, err := NewConsulElector("mc_hotkeys:MEMCACHED_HOT_KEYS:leader", func() (*consul.Client, error) {
+		return fake.Client(""), nil
+	}, nil)
+	if err != nil {
+		panic("consul elector should be initialized")
+	}
+	aggregator, states := newLeadingAggregator(elector)
+	ctx, cancel := context.WithCancel(context.Background())
+	go aggregator.lead(ctx, 10*time.Millisecond)
+
+	expectStates(states, Leading)
+	held := fake.Holder("mc_hotkeys:MEMCACHED_HOT_KEYS:leader")
+	fake.Invalidate("mc_hotkeys:MEMCACHED_HOT_KEYS:leader")
+	expectStates(states, SteppingDown, Campaigning, Leading)
+	if reacquired := fake.Holder("mc_hotkeys:MEMCACHED_HOT_KEYS:leader"); reacquired == "" || reacquired == held {
+		panic("a lost lock should be reacquired with a new session")
+	}
+
+	cancel()
+	expectStates(states, SteppingDown, Stopped)
+	<-aggregator.Done()
+	if fake.Holder("mc_hotkeys:MEMCACHED_HOT_KEYS:leader") != "" {
+		panic("a stopped aggregator should release the lock")
+	}
+}
+
+func TestConsulElectorTokenRotation(t *testing.T) {
+
+	fake := newFakeConsul()
+	defer fake.Close()
+	fake.SetToken("first")
+	token := make(chan string, 1)
+	token <- "first"
+	rotation := make(chan struct{})
+	elector, err := NewConsulElector("leader", func() (*consul.Client, error) {
+		current := <-token
+		token <- current
+		return fake.Client(current), nil
+	}, rotation)
+	if err != nil {
+		panic("consul elector should be initialized")
+	}
+
+	lost, err := elector.Campaign(context.Background())
+	if err != nil {
+		panic("campaign should acquire the lock")
+	}
+	held := fake.Holder("leader")
+	fake.SetToken("second")
+	<-token
+	token <- "second"
+	rotation <- struct{}{}
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		panic("token rotation should lose the leadership")
+	}
+	elector.Resign()
+
+	if _, err := elector.Campaign(context.Background()); err != nil {
+		panic("campaign should acquire the lock with the rotated token")
+	}
+	if reacquired := fake.Holder("leader"); reacquired == "" || reacquired == held {
+		panic("the lock should be held by a session of the rotated token")
+	}
+	elector.Resign()
+}
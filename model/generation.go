@@ -0,0 +1,193 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	log "github.com/golang/glog"
+)
+
+// HotKeysDiff is the change of the hot keys from the generation `From` to the generation `To`,
+// the `Upserts` are the entries added or rescored, and the `Removes` are the keys no longer hot
+type HotKeysDiff struct {
+	Version int    `json:"version"`
+	From    uint64 `json:"from"`
+	To      uint64 `json:"to"`
+	// Timestamp is the unix milliseconds of the aggregation of the view at `To`
+	Timestamp int64         `json:"timestamp,omitempty"`
+	Upserts   HotKeyEntries `json:"upserts"`
+	Removes   []string      `json:"removes"`
+}
+
+// GenerationKey is where the generation of the view published at `key` is, a decimal counter bumped whenever the hot keys change
+func GenerationKey(key string) string {
+	return fmt.Sprintf("%s:generation", key)
+}
+
+// DiffKey is where the diff from the previous generation of the view published at `key` is
+func DiffKey(key string) string {
+	return fmt.Sprintf("%s:diff", key)
+}
+
+// ParseGeneration parses the value of a generation key
+func ParseGeneration(value []byte) (uint64, error) {
+	return strconv.ParseUint(string(value), 10, 64)
+}
+
+// DiffHotKeys gives the entries of `to` which are new or scored differently from `from`, and the keys of `from` missing in `to`,
+// the attribution of an entry alone doesn't make it changed
+func DiffHotKeys(from HotKeyEntries, to HotKeyEntries) (HotKeyEntries, []string) {
+	previous := make(map[string]*HotKeyEntry, len(from))
+	for _, entry := range from {
+		previous[entry.Key] = entry
+	}
+	upserts := HotKeyEntries{}
+	for _, entry := range to {
+		if was, ok := previous[entry.Key]; !ok || was.Score != entry.Score || was.Error != entry.Error {
+			upserts = append(upserts, entry)
+		}
+		delete(previous, entry.Key)
+	}
+	removes := make([]string, 0, len(previous))
+	for key := range previous {
+		removes = append(removes, key)
+	}
+	sort.Strings(removes)
+	return upserts, removes
+}
+
+// Apply gives the hot keys of the `To` generation from those of the `From` generation, from the highest to the lowest score
+func (diff *HotKeysDiff) Apply(entries HotKeyEntries) HotKeyEntries {
+	applied := make(map[string]*HotKeyEntry, len(entries)+len(diff.Upserts))
+	for _, entry := range entries {
+		applied[entry.Key] = entry
+	}
+	for _, key := range diff.Removes {
+		delete(applied, key)
+	}
+	for _, entry := range diff.Upserts {
+		applied[entry.Key] = entry
+	}
+	result := make(HotKeyEntries, 0, len(applied))
+	for _, entry := range applied {
+		result = append(result, entry)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// publishedGeneration reads the generation and hot keys of the view published at `key` from its snapshot,
+// or at least the generation after the one of the generation key, whose hot keys are `unknown`, all zero when neither is published
+func publishedGeneration(client *memcache.Client, key string) (generation uint64, hotKeys HotKeyEntries, unknown bool, err error) {
+	item, err := client.Get(key)
+	if err == nil {
+		published := &AggregatedHotKeys{}
+		if rawBytes, err := DecodeValue(item, client.GetMulti); err == nil && json.Unmarshal(rawBytes, published) == nil {
+			return published.Generation, published.HotKeys, false, nil
+		}
+	} else if err != memcache.ErrCacheMiss {
+		return 0, nil, false, err
+	}
+	item, err = client.Get(GenerationKey(key))
+	if err == nil {
+		// without the hot keys of that generation, a diff from it would remove nothing, so a generation is skipped,
+		// the next diff is from the skipped one no client is at, and they all fall back to the snapshot
+		if generation, err := ParseGeneration(item.Value); err == nil {
+			return generation + 1, nil, true, nil
+		}
+	} else if err != memcache.ErrCacheMiss {
+		return 0, nil, false, err
+	}
+	return 0, nil, false, nil
+}
+
+// restoreGeneration picks up the generation and hot keys where the previous leader left them
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) restoreGeneration() {
+	generation, hotKeys, unknown, err := publishedGeneration(memcachedHotKeyAggregator.memcachedClient, memcachedHotKeyAggregator.scopeKey())
+	if err == nil && (generation > 0 || hotKeys != nil) {
+		memcachedHotKeyAggregator.generation, memcachedHotKeyAggregator.lastHotKeys = generation, hotKeys
+		memcachedHotKeyAggregator.lastUnknown = unknown
+	}
+}
+
+// publishDiff writes the `diff` to a bumped generation, and then the generation, once the snapshot of the generation is published
+func publishDiff(publisher Publisher, codec *ValueCodec, key string, diff *HotKeysDiff, interval time.Duration) error {
+	rawBytes, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+	if err = publishView(publisher, codec, DiffKey(key), rawBytes, interval); err != nil {
+		return err
+	}
+	// the generation is tiny and never encoded, a client reads it with a plain get
+	return publisher.Publish(&memcache.Item{Key: GenerationKey(key), Value: []byte(strconv.FormatUint(diff.To, 10))})
+}
+
+// publishAggregated publishes the consolidated view at the scope key unless the `ctx` is done,
+// when the hot keys change, it bumps the generation, and writes the snapshot, then the diff, and then the generation,
+// so that a client which sees a new generation always finds its diff and snapshot
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) publishAggregated(ctx context.Context, aggregated *AggregatedHotKeys) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !memcachedHotKeyAggregator.restored {
+		memcachedHotKeyAggregator.restoreGeneration()
+		memcachedHotKeyAggregator.restored = true
+	}
+	key := memcachedHotKeyAggregator.scopeKey()
+	generation := memcachedHotKeyAggregator.generation
+	upserts, removes := DiffHotKeys(memcachedHotKeyAggregator.lastHotKeys, aggregated.HotKeys)
+	changed := generation == 0 || memcachedHotKeyAggregator.lastUnknown || len(upserts) > 0 || len(removes) > 0
+	if changed {
+		generation++
+	}
+	aggregated.Generation = generation
+	if memcachedHotKeyAggregator.options.Shards != nil {
+		AttributeShards(aggregated.HotKeys, memcachedHotKeyAggregator.options.Shards)
+	}
+
+	hotKeysRawBytes, err := json.Marshal(aggregated)
+	if err != nil {
+		return err
+	}
+	if err = publishView(memcachedHotKeyAggregator.publisher, memcachedHotKeyAggregator.codec, key, hotKeysRawBytes, memcachedHotKeyAggregator.options.Interval); err != nil {
+		return err
+	}
+	if memcachedHotKeyAggregator.options.Shards != nil {
+		if err := memcachedHotKeyAggregator.publishServerLoads(key, aggregated.HotKeys); err != nil {
+			log.Warningf("<memcached aggregator> cannot publish the server loads:%v\n", err)
+		}
+	}
+	if memcachedHotKeyAggregator.options.Mitigation != nil {
+		if err := memcachedHotKeyAggregator.options.Mitigation.Observe(aggregated); err != nil {
+			log.Warningf("<memcached aggregator> cannot mitigate the hot keys:%v\n", err)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err = publishDiff(memcachedHotKeyAggregator.publisher, memcachedHotKeyAggregator.codec, key, &HotKeysDiff{
+		Version:   ReportSchemaVersion,
+		From:      generation - 1,
+		To:        generation,
+		Timestamp: aggregated.Timestamp,
+		Upserts:   upserts,
+		Removes:   removes,
+	}, memcachedHotKeyAggregator.options.Interval); err != nil {
+		return err
+	}
+	memcachedHotKeyAggregator.generation, memcachedHotKeyAggregator.lastHotKeys = generation, aggregated.HotKeys
+	memcachedHotKeyAggregator.lastUnknown = false
+	log.Infof("<memcached aggregator> generation:%d, upserts:%d, removes:%d\n", generation, len(upserts), len(removes))
+	return nil
+}
@@ -0,0 +1,137 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/inexplicable/mc_hotkeys/internal/memcachedtest"
+)
+
+func TestPublishGenerations(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	publisher, err := NewResilientPublisher(&memcache.ServerList{}, time.Hour, fake.Addr())
+	if err != nil {
+		panic("publisher should be initialized with fallback")
+	}
+	newAggregator := func() *MemcachedHotKeyAggregator {
+		return &MemcachedHotKeyAggregator{
+			reportKey:       "MEMCACHED_HOT_KEYS",
+			options:         AggregatorOptions{TopN: 2, Interval: time.Second},
+			memcachedClient: memcache.New(fake.Addr()),
+			codec:           NewValueCodec(NoCompression, 0),
+			publisher:       publisher,
+		}
+	}
+	publish := func(aggregator *MemcachedHotKeyAggregator, hotKeys HotKeyEntries) {
+		if aggregator.publishAggregated(context.Background(), &AggregatedHotKeys{Version: ReportSchemaVersion, Timestamp: 42, HotKeys: hotKeys}) != nil {
+			panic("publish should succeed")
+		}
+	}
+	generation := func() uint64 {
+		rawBytes, _ := fake.Value(GenerationKey("MEMCACHED_HOT_KEYS"))
+		parsed, err := ParseGeneration(rawBytes)
+		if err != nil {
+			panic("generation should be a plain counter")
+		}
+		return parsed
+	}
+	diff := func() *HotKeysDiff {
+		rawBytes, _ := fake.Value(DiffKey("MEMCACHED_HOT_KEYS"))
+		parsed := &HotKeysDiff{}
+		if json.Unmarshal(rawBytes, parsed) != nil {
+			panic("diff should be published")
+		}
+		return parsed
+	}
+
+	aggregator := newAggregator()
+	first := HotKeyEntries{{Key: "a", Score: 10}, {Key: "b", Score: 5}}
+	publish(aggregator, first)
+	if generation() != 1 || diff().To != 1 {
+		panic("the first view should be the first generation")
+	}
+	publish(aggregator, HotKeyEntries{{Key: "a", Score: 10}, {Key: "b", Score: 5}})
+	if generation() != 1 {
+		panic("an unchanged view shouldn't bump the generation")
+	}
+	second := HotKeyEntries{{Key: "c", Score: 20}, {Key: "a", Score: 10}}
+	publish(aggregator, second)
+	if changes := diff(); generation() != 2 || changes.From != 1 || changes.Timestamp != 42 || len(changes.Upserts) != 1 || !reflect.DeepEqual(changes.Removes, []string{"b"}) {
+		panic("the diff should carry only the changes since the previous generation")
+	} else if applied := changes.Apply(first); applied[0].Key != "c" || applied[1].Key != "a" || len(applied) != 2 {
+		panic("applying the diff should give the hot keys of the new generation")
+	}
+
+	// a new leader picks up where the previous one left
+	successor := newAggregator()
+	publish(successor, second)
+	if generation() != 2 {
+		panic("a new leader should restore the generation from the snapshot")
+	}
+	publish(successor, first)
+	if changes := diff(); generation() != 3 || changes.From != 2 || !reflect.DeepEqual(changes.Removes, []string{"c"}) {
+		panic("a new leader should diff against the restored snapshot")
+	}
+
+	// a new leader finding only the generation can't tell the keys to remove, a client at that generation reads the snapshot
+	fake.Delete("MEMCACHED_HOT_KEYS")
+	blind := newAggregator()
+	publish(blind, HotKeyEntries{{Key: "a", Score: 10}})
+	if changes := diff(); generation() != 5 || changes.From == 3 {
+		panic("a new leader without the snapshot should skip a generation")
+	}
+	if rawBytes, _ := fake.Value("MEMCACHED_HOT_KEYS"); json.Unmarshal(rawBytes, &AggregatedHotKeys{}) != nil {
+		panic("the snapshot of the new generation should be published")
+	}
+	fake.Delete("MEMCACHED_HOT_KEYS")
+	empty := newAggregator()
+	publish(empty, HotKeyEntries{})
+	if generation() != 7 {
+		panic("a new leader without the snapshot should bump the generation even when nothing's hot")
+	}
+}
+
+func TestPublishViewChunks(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	publisher, err := NewResilientPublisher(&memcache.ServerList{}, time.Hour, fake.Addr())
+	if err != nil {
+		panic("publisher should be initialized with fallback")
+	}
+	// a tiny chunk size chunks the view
+	aggregator := &MemcachedHotKeyAggregator{
+		reportKey:       "MEMCACHED_HOT_KEYS",
+		options:         AggregatorOptions{TopN: 2, Interval: 10 * time.Second},
+		memcachedClient: memcache.New(fake.Addr()),
+		codec:           NewValueCodec(NoCompression, 16),
+		publisher:       publisher,
+	}
+	if aggregator.publishAggregated(context.Background(), &AggregatedHotKeys{Version: ReportSchemaVersion, HotKeys: HotKeyEntries{{Key: "a", Score: 10}}}) != nil {
+		panic("publish should succeed")
+	}
+
+	chunks := 0
+	for key, exptime := range fake.Expirations() {
+		switch key {
+		case "MEMCACHED_HOT_KEYS", DiffKey("MEMCACHED_HOT_KEYS"), GenerationKey("MEMCACHED_HOT_KEYS"):
+			if !exptime.IsZero() {
+				panic("the view itself should never expire")
+			}
+		default:
+			chunks++
+			if exptime.IsZero() || exptime.After(time.Now().Add(time.Duration(ReportTTL(10*time.Second))*time.Second)) {
+				panic("the chunks of the view should expire a few intervals later")
+			}
+		}
+	}
+	if chunks == 0 {
+		panic("the view should be chunked")
+	}
+}
@@ -0,0 +1,324 @@
+package model
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	log "github.com/golang/glog"
+)
+
+const (
+	// DefaultGossipFanout is the number of peers each instance exchanges its view with every round
+	DefaultGossipFanout = 3
+	// MaxGossipBytes bounds a single gossip message
+	MaxGossipBytes = 4 << 20
+)
+
+// gossipMessage is what peers exchange, the freshest report each of them knows of every reporter
+type gossipMessage struct {
+	Version int                      `json:"version"`
+	From    string                   `json:"from"`
+	Reports map[string]*HotKeyReport `json:"reports"`
+}
+
+// GossipOptions tunes how a `GossipAggregator` exchanges and aggregates
+type GossipOptions struct {
+	// TopN is the number of hot keys in the view
+	TopN int
+	// MergeMode merges the same key's scores of different reports
+	MergeMode MergeMode
+	// MergeSummaries merges the reports' summaries instead of their topN hot keys
+	MergeSummaries bool
+	// Interval is how often an instance gossips, and publishes its view if it does
+	Interval time.Duration
+	// Fanout is the number of random peers of every round
+	Fanout int
+	// Staleness is how old a report can be before it's dropped from the view
+	Staleness time.Duration
+	// Publish makes the instance publish its view to memcached besides serving it over http
+	Publish bool
+}
+
+// GossipAggregator aggregates without a leader, every instance keeps the freshest report of every reporter it knows of,
+// exchanges them with a few random peers every round over tcp, and converges on the same view as its peers
+type GossipAggregator struct {
+	m         sync.Mutex
+	identity  string
+	reportKey string
+	options   GossipOptions
+	sequence  uint64
+	reports   map[string]*HotKeyReport
+	discovery ReporterDiscovery
+	address   func(member Member) string
+	listener  net.Listener
+	// the client reading the view published by any instance, whose generation the next publish follows
+	memcachedClient *memcache.Client
+	codec           *ValueCodec
+	publisher       Publisher
+}
+
+// Report keeps the instance's own report, which is gossiped in the next rounds
+func (gossipAggregator *GossipAggregator) Report(hotKeys map[string]uint64, metadata WindowsMetadata) {
+	sequence := atomic.AddUint64(&gossipAggregator.sequence, 1)
+	gossipAggregator.merge(map[string]*HotKeyReport{
+		gossipAggregator.identity: NewHotKeyReport(gossipAggregator.identity, sequence, hotKeys, metadata),
+	})
+}
+
+// merge keeps the fresher of the known and the `received` report of every reporter, and drops the stale ones
+func (gossipAggregator *GossipAggregator) merge(received map[string]*HotKeyReport) {
+	gossipAggregator.m.Lock()
+	defer gossipAggregator.m.Unlock()
+	now := time.Now()
+	for identity, report := range received {
+		if report == nil || report.Validate(identity, now, gossipAggregator.options.Staleness) != nil {
+			continue
+		}
+		known, ok := gossipAggregator.reports[identity]
+		if !ok || report.Timestamp > known.Timestamp || (report.Timestamp == known.Timestamp && report.Sequence > known.Sequence) {
+			gossipAggregator.reports[identity] = report
+		}
+	}
+	for identity, report := range gossipAggregator.reports {
+		if now.Sub(report.Generated()) > gossipAggregator.options.Staleness {
+			delete(gossipAggregator.reports, identity)
+		}
+	}
+}
+
+func (gossipAggregator *GossipAggregator) message() *gossipMessage {
+	gossipAggregator.m.Lock()
+	defer gossipAggregator.m.Unlock()
+	reports := make(map[string]*HotKeyReport, len(gossipAggregator.reports))
+	for identity, report := range gossipAggregator.reports {
+		reports[identity] = report
+	}
+	return &gossipMessage{Version: ReportSchemaVersion, From: gossipAggregator.identity, Reports: reports}
+}
+
+func send(conn net.Conn, message *gossipMessage) error {
+	return json.NewEncoder(conn).Encode(message)
+}
+
+func receive(conn net.Conn) (*gossipMessage, error) {
+	received := &gossipMessage{}
+	if err := json.NewDecoder(bufio.NewReader(io.LimitReader(conn, MaxGossipBytes))).Decode(received); err != nil {
+		return nil, err
+	}
+	if received.Version != ReportSchemaVersion {
+		return nil, ErrIncompatibleReport
+	}
+	return received, nil
+}
+
+func (gossipAggregator *GossipAggregator) serve() {
+	for {
+		conn, err := gossipAggregator.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			// the peer who dialed sends first, and the one who accepted answers with what it knew before merging
+			conn.SetDeadline(time.Now().Add(gossipAggregator.options.Interval))
+			received, err := receive(conn)
+			if err == nil {
+				err = send(conn, gossipAggregator.message())
+			}
+			if err != nil {
+				log.Warningf("<gossip:%s> exchange with %v failed:%v\n", gossipAggregator.identity, conn.RemoteAddr(), err)
+				return
+			}
+			gossipAggregator.merge(received.Reports)
+		}()
+	}
+}
+
+// round exchanges the view with the fanout of random peers
+func (gossipAggregator *GossipAggregator) round() {
+	members, err := gossipAggregator.discovery.Discover()
+	if err != nil {
+		log.Warningf("<gossip:%s> discover peers failed:%v\n", gossipAggregator.identity, err)
+		return
+	}
+	peers := make([]Member, 0, len(members))
+	for _, member := range members {
+		if member.Identity != gossipAggregator.identity {
+			peers = append(peers, member)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > gossipAggregator.options.Fanout {
+		peers = peers[:gossipAggregator.options.Fanout]
+	}
+
+	wait := sync.WaitGroup{}
+	for _, peer := range peers {
+		wait.Add(1)
+		go func(peer Member) {
+			defer wait.Done()
+			conn, err := net.DialTimeout("tcp", gossipAggregator.address(peer), gossipAggregator.options.Interval)
+			if err != nil {
+				log.Warningf("<gossip:%s> cannot reach %s:%v\n", gossipAggregator.identity, peer.Identity, err)
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(gossipAggregator.options.Interval))
+			err = send(conn, gossipAggregator.message())
+			var received *gossipMessage
+			if err == nil {
+				received, err = receive(conn)
+			}
+			if err != nil {
+				log.Warningf("<gossip:%s> exchange with %s failed:%v\n", gossipAggregator.identity, peer.Identity, err)
+				return
+			}
+			gossipAggregator.merge(received.Reports)
+		}(peer)
+	}
+	wait.Wait()
+}
+
+// View aggregates the reports known so far, every instance converges on the same view
+func (gossipAggregator *GossipAggregator) View() *AggregatedHotKeys {
+	now := time.Now()
+	reports := gossipAggregator.message().Reports
+	statuses := make(map[string]ReporterStatus, len(reports))
+	if members, err := gossipAggregator.discovery.Discover(); err == nil {
+		for _, member := range members {
+			statuses[member.Identity] = ReporterMissing
+		}
+	}
+	merger := NewHotKeyMerger(gossipAggregator.options.MergeMode)
+	summaries := make(map[string]*HotKeySummary, len(reports))
+	for identity, report := range reports {
+		if now.Sub(report.Generated()) > gossipAggregator.options.Staleness {
+			statuses[identity] = ReporterStale
+			continue
+		}
+		if report.Heartbeat() {
+			statuses[identity] = ReporterHeartbeat
+		} else {
+			statuses[identity] = ReporterReported
+		}
+		if gossipAggregator.options.MergeSummaries {
+			summaries[identity] = SummaryOf(report)
+			merger.MergeStats(report)
+		} else {
+			merger.Merge(report)
+		}
+	}
+	var cutN HotKeyEntries
+	if gossipAggregator.options.MergeSummaries {
+		cutN = MergeSummaries(summaries, gossipAggregator.options.TopN)
+	} else {
+		cutN = merger.Top(gossipAggregator.options.TopN)
+	}
+	merger.AttachStats(cutN)
+	return &AggregatedHotKeys{
+		Version:   ReportSchemaVersion,
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+		HotKeys:   cutN,
+		Reporters: statuses,
+	}
+}
+
+// ServeHTTP serves the view as json
+func (gossipAggregator *GossipAggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gossipAggregator.View())
+}
+
+// Addr is the address the aggregator listens for its peers on
+func (gossipAggregator *GossipAggregator) Addr() net.Addr {
+	return gossipAggregator.listener.Addr()
+}
+
+func (gossipAggregator *GossipAggregator) run(ctx context.Context) {
+	ticker := time.NewTicker(gossipAggregator.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			gossipAggregator.listener.Close()
+			return
+		case <-ticker.C:
+			gossipAggregator.round()
+			if !gossipAggregator.options.Publish {
+				continue
+			}
+			if err := gossipAggregator.publish(gossipAggregator.View()); err != nil {
+				log.Warningf("<gossip:%s> cannot publish view:%v\n", gossipAggregator.identity, err)
+			}
+		}
+	}
+}
+
+// publish publishes the `view` as the next generation of the view any instance published last if its hot keys changed,
+// writing the snapshot, then the diff, and then the generation as the leader does, the instances publish the same converged view,
+// but while they converge, a client following the diff of one instance may keep a key only another one had till it reads the snapshot again
+func (gossipAggregator *GossipAggregator) publish(view *AggregatedHotKeys) error {
+	key := gossipAggregator.reportKey
+	generation, published, unknown, err := publishedGeneration(gossipAggregator.memcachedClient, key)
+	if err != nil {
+		// a generation taken as 0 would take every client back to the first one
+		return err
+	}
+	upserts, removes := DiffHotKeys(published, view.HotKeys)
+	changed := generation == 0 || unknown || len(upserts) > 0 || len(removes) > 0
+	if changed {
+		generation++
+	}
+	view.Generation = generation
+	rawBytes, err := json.Marshal(view)
+	if err != nil {
+		return err
+	}
+	if err = publishView(gossipAggregator.publisher, gossipAggregator.codec, key, rawBytes, gossipAggregator.options.Interval); err != nil || !changed {
+		return err
+	}
+	return publishDiff(gossipAggregator.publisher, gossipAggregator.codec, key, &HotKeysDiff{
+		Version:   ReportSchemaVersion,
+		From:      generation - 1,
+		To:        generation,
+		Timestamp: view.Timestamp,
+		Upserts:   upserts,
+		Removes:   removes,
+	}, gossipAggregator.options.Interval)
+}
+
+// NewGossipAggregator initializes a `GossipAggregator` of the reporter `identity` listening at `listenAddress`,
+// it gossips with the peers `discovery` finds at their `address`, till the `ctx` is done, the published view is read from the servers the `selector` picks
+func NewGossipAggregator(ctx context.Context, identity string, reportKey string, listenAddress string, address func(member Member) string, options GossipOptions,
+	selector memcache.ServerSelector, discovery ReporterDiscovery, codec *ValueCodec, publisher Publisher) (*GossipAggregator, error) {
+
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return nil, err
+	}
+	gossipAggregator := &GossipAggregator{
+		m:               sync.Mutex{},
+		identity:        identity,
+		reportKey:       reportKey,
+		options:         options,
+		reports:         map[string]*HotKeyReport{},
+		discovery:       discovery,
+		address:         address,
+		listener:        listener,
+		memcachedClient: memcache.NewFromSelector(selector),
+		codec:           codec,
+		publisher:       publisher,
+	}
+	go gossipAggregator.serve()
+	go gossipAggregator.run(ctx)
+	return gossipAggregator, nil
+}
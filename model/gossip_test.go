@@ -0,0 +1,112 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/inexplicable/mc_hotkeys/internal/memcachedtest"
+)
+
+func TestGossipConvergence(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	identities := []string{"host1:11211", "host2:11211", "host3:11211", "host4:11211"}
+	addresses := map[string]string{}
+	discovery := NewStaticDiscovery(identities...)
+	options := GossipOptions{TopN: 2, Interval: time.Hour, Fanout: 2, Staleness: time.Minute}
+
+	aggregators := []*GossipAggregator{}
+	for i, identity := range identities {
+		aggregator, err := NewGossipAggregator(ctx, identity, "MEMCACHED_HOT_KEYS", "127.0.0.1:0", func(member Member) string {
+			return addresses[member.Identity]
+		}, options, nil, discovery, nil, nil)
+		if err != nil {
+			panic("gossip aggregator should listen")
+		}
+		addresses[identity] = aggregator.Addr().String()
+		aggregator.Report(map[string]uint64{"everywhere": 10, fmt.Sprintf("only%d", i): uint64(i)}, WindowsMetadata{Width: 10, TopN: 2})
+		aggregators = append(aggregators, aggregator)
+	}
+
+	converged := func() bool {
+		for _, aggregator := range aggregators {
+			view := aggregator.View()
+			if len(view.HotKeys) != 2 || view.HotKeys[0].Key != "everywhere" || view.HotKeys[0].Score != 40 || view.HotKeys[1].Key != "only3" {
+				return false
+			}
+			if !reflect.DeepEqual(view.HotKeys, aggregators[0].View().HotKeys) {
+				return false
+			}
+		}
+		return true
+	}
+	for rounds := 0; !converged(); rounds++ {
+		if rounds == 10 {
+			panic("every instance should converge on the same view")
+		}
+		for _, aggregator := range aggregators {
+			aggregator.round()
+		}
+	}
+	if view := aggregators[0].View(); view.Reporters["host4:11211"] != ReporterReported || len(view.Reporters) != 4 {
+		panic("the view should tell the status of every reporter")
+	}
+}
+
+func TestGossipMergeFresher(t *testing.T) {
+
+	aggregator := &GossipAggregator{reports: map[string]*HotKeyReport{}, options: GossipOptions{Staleness: time.Minute}}
+	older := NewHotKeyReport("host1:11211", 2, map[string]uint64{"a": 1}, WindowsMetadata{Width: 10})
+	newer := NewHotKeyReport("host1:11211", 1, map[string]uint64{"a": 2}, WindowsMetadata{Width: 10})
+	newer.Timestamp = older.Timestamp + 1
+	aggregator.merge(map[string]*HotKeyReport{"host1:11211": newer})
+	aggregator.merge(map[string]*HotKeyReport{"host1:11211": older})
+	if aggregator.reports["host1:11211"] != newer {
+		panic("the fresher report should win even with a lower sequence, e.g. after a restart")
+	}
+	stale := NewHotKeyReport("host2:11211", 1, map[string]uint64{"a": 1}, WindowsMetadata{Width: 10})
+	stale.Timestamp -= int64(time.Hour / time.Millisecond)
+	aggregator.merge(map[string]*HotKeyReport{"host2:11211": stale, "host3:11211": newer})
+	if len(aggregator.reports) != 1 {
+		panic("stale reports and reports of another identity should be dropped")
+	}
+}
+
+func TestGossipPublish(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	publisher, err := NewResilientPublisher(&memcache.ServerList{}, time.Hour, fake.Addr())
+	if err != nil {
+		panic("publisher should be initialized with fallback")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// a tiny chunk size chunks the view
+	aggregator, err := NewGossipAggregator(ctx, "host1:11211", "MEMCACHED_HOT_KEYS", "127.0.0.1:0", func(member Member) string {
+		return ""
+	}, GossipOptions{TopN: 2, Interval: 20 * time.Millisecond, Staleness: time.Minute, Publish: true}, publisher.Selector(), NewStaticDiscovery(), NewValueCodec(NoCompression, 16), publisher)
+	if err != nil {
+		panic("gossip aggregator should listen")
+	}
+	aggregator.Report(map[string]uint64{"a": 10}, WindowsMetadata{Width: 10, TopN: 2})
+	time.Sleep(100 * time.Millisecond)
+
+	expirations := fake.Expirations()
+	if exptime, ok := expirations["MEMCACHED_HOT_KEYS"]; !ok || !exptime.IsZero() {
+		panic("the view should be published, and never expire")
+	}
+	if _, ok := expirations[GenerationKey("MEMCACHED_HOT_KEYS")]; !ok {
+		panic("the generation of the view should be published")
+	}
+	for key, exptime := range expirations {
+		if key != "MEMCACHED_HOT_KEYS" && key != DiffKey("MEMCACHED_HOT_KEYS") && key != GenerationKey("MEMCACHED_HOT_KEYS") && (exptime.IsZero() || exptime.After(time.Now().Add(time.Duration(ReportTTL(20*time.Millisecond))*time.Second))) {
+			panic("the chunks of the view should expire a few intervals later")
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package model
+
+import (
+	"sync"
+	"time"
+)
+
+// KeyStats are the outcomes of fetching a key a proxy saw, the hits and misses, the size of its value and the upstream latency
+type KeyStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	// Bytes is the largest value fetched
+	Bytes uint64 `json:"bytes"`
+	// LatencyMicros adds up the upstream latency of every fetch, `MeanLatency` divides it by the fetches
+	LatencyMicros uint64 `json:"latency_us"`
+}
+
+// Add adds up the `other` stats, the largest value is kept
+func (stats *KeyStats) Add(other *KeyStats) {
+	stats.Hits += other.Hits
+	stats.Misses += other.Misses
+	stats.LatencyMicros += other.LatencyMicros
+	if other.Bytes > stats.Bytes {
+		stats.Bytes = other.Bytes
+	}
+}
+
+// HitRatio is the part of the fetches which hit
+func (stats *KeyStats) HitRatio() float64 {
+	if fetches := stats.Hits + stats.Misses; fetches > 0 {
+		return float64(stats.Hits) / float64(fetches)
+	}
+	return 0
+}
+
+// MeanLatency is the mean upstream latency of a fetch
+func (stats *KeyStats) MeanLatency() time.Duration {
+	if fetches := stats.Hits + stats.Misses; fetches > 0 {
+		return time.Duration(stats.LatencyMicros/fetches) * time.Microsecond
+	}
+	return 0
+}
+
+// KeyStatsCounter is the 1 second bucket of the keys' `KeyStats`, which rolls along with the `GetKeyCounter` of the same window
+type KeyStatsCounter struct {
+	m     sync.Mutex
+	stats map[string]*KeyStats
+}
+
+// Observe records a fetch of the `key`, a hit of `bytes` or a miss, which took the upstream `latency`
+func (keyStatsCounter *KeyStatsCounter) Observe(key string, hit bool, bytes int, latency time.Duration) {
+	keyStatsCounter.m.Lock()
+	defer keyStatsCounter.m.Unlock()
+
+	stats, ok := keyStatsCounter.stats[key]
+	if !ok {
+		stats = &KeyStats{}
+		keyStatsCounter.stats[key] = stats
+	}
+	if hit {
+		stats.Hits++
+	} else {
+		stats.Misses++
+	}
+	if uint64(bytes) > stats.Bytes {
+		stats.Bytes = uint64(bytes)
+	}
+	stats.LatencyMicros += uint64(latency / time.Microsecond)
+}
+
+// addTo adds the stats of the `keys` to the `totals`
+func (keyStatsCounter *KeyStatsCounter) addTo(totals map[string]*KeyStats, keys map[string]uint64) {
+	keyStatsCounter.m.Lock()
+	defer keyStatsCounter.m.Unlock()
+
+	for key := range keys {
+		if stats, ok := keyStatsCounter.stats[key]; ok {
+			total, ok := totals[key]
+			if !ok {
+				total = &KeyStats{}
+				totals[key] = total
+			}
+			total.Add(stats)
+		}
+	}
+}
+
+// NewKeyStatsCounter initializes an empty `KeyStatsCounter`
+func NewKeyStatsCounter() *KeyStatsCounter {
+	return &KeyStatsCounter{
+		m:     sync.Mutex{},
+		stats: map[string]*KeyStats{},
+	}
+}
@@ -0,0 +1,49 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyStats(t *testing.T) {
+
+	rollingWindows := NewSimpleRollingWindows(&dumbKeyScorer{}, func() GetKeyCounter {
+		return NewBucketGetKeyCounter(1)
+	}, 2, 1, 1)
+	rollingWindows.Increment("hot_key", uint64(2))
+	rollingWindows.Increment("cold_key", uint64(1))
+	rollingWindows.Observe("hot_key", true, 100, 2*time.Millisecond)
+	rollingWindows.Observe("hot_key", false, 0, 4*time.Millisecond)
+	rollingWindows.Observe("cold_key", true, 10, time.Millisecond)
+	rollingWindows.Roll()
+	stats := rollingWindows.Metadata().Stats
+	if !reflect.DeepEqual(stats, map[string]*KeyStats{"hot_key": {Hits: 1, Misses: 1, Bytes: 100, LatencyMicros: 6000}}) {
+		panic("only the hot keys' stats should be gathered")
+	}
+	if stats["hot_key"].HitRatio() != 0.5 || stats["hot_key"].MeanLatency() != 3*time.Millisecond {
+		panic("the hit ratio and mean latency should be of all fetches")
+	}
+
+	rollingWindows.Increment("hot_key", uint64(1))
+	rollingWindows.Observe("hot_key", true, 200, time.Millisecond)
+	rollingWindows.Roll()
+	if stats := rollingWindows.Metadata().Stats["hot_key"]; stats.Hits != 2 || stats.Bytes != 200 {
+		panic("the stats should roll along with the counts")
+	}
+	rollingWindows.Roll()
+	rollingWindows.Roll()
+	if rollingWindows.Metadata().Stats != nil {
+		panic("the stats should roll out along with the counts")
+	}
+
+	merger := NewHotKeyMerger(MergeSum)
+	merger.Merge(&HotKeyReport{Identity: "host1:11211", Width: 10, HotKeys: map[string]uint64{"hot_key": 10}, Stats: map[string]*KeyStats{"hot_key": {Hits: 1, Bytes: 10}}})
+	merger.Merge(&HotKeyReport{Identity: "host2:11211", Width: 10, HotKeys: map[string]uint64{"hot_key": 10}, Stats: map[string]*KeyStats{"hot_key": {Misses: 1}}})
+	merger.Merge(&HotKeyReport{Identity: "host3:11211", Width: 10, HotKeys: map[string]uint64{"hot_key": 10}})
+	top := merger.Top(1)
+	merger.AttachStats(top)
+	if !reflect.DeepEqual(top[0].Stats, &KeyStats{Hits: 1, Misses: 1, Bytes: 10}) {
+		panic("the stats of a key should be merged across its reporters")
+	}
+}
@@ -0,0 +1,147 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// LeadershipState is the state of an aggregator's leadership
+type LeadershipState int
+
+const (
+	// Campaigning aggregator waits to be elected, and backs off after failed campaigns
+	Campaigning LeadershipState = iota
+	// Leading aggregator aggregates every interval
+	Leading
+	// SteppingDown aggregator lost its leadership or is stopping, it has stopped aggregating, and resigns
+	SteppingDown
+	// Stopped aggregator's context is done, it never campaigns again
+	Stopped
+)
+
+func (state LeadershipState) String() string {
+	switch state {
+	case Campaigning:
+		return "campaigning"
+	case Leading:
+		return "leading"
+	case SteppingDown:
+		return "stepping down"
+	case Stopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// Observe adds an `observer` of the leadership transitions, it's told every new state
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) Observe(observer func(state LeadershipState)) {
+	memcachedHotKeyAggregator.m.Lock()
+	defer memcachedHotKeyAggregator.m.Unlock()
+	memcachedHotKeyAggregator.observers = append(memcachedHotKeyAggregator.observers, observer)
+}
+
+// State gives the current leadership state
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) State() LeadershipState {
+	memcachedHotKeyAggregator.m.Lock()
+	defer memcachedHotKeyAggregator.m.Unlock()
+	return memcachedHotKeyAggregator.state
+}
+
+// Done is closed once the aggregator has stopped
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) Done() <-chan struct{} {
+	return memcachedHotKeyAggregator.done
+}
+
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) transition(state LeadershipState) {
+	memcachedHotKeyAggregator.m.Lock()
+	if memcachedHotKeyAggregator.state == state {
+		memcachedHotKeyAggregator.m.Unlock()
+		return
+	}
+	memcachedHotKeyAggregator.state = state
+	observers := memcachedHotKeyAggregator.observers
+	memcachedHotKeyAggregator.m.Unlock()
+	log.Infof("<memcached aggregator> %v at:%v\n", state, time.Now())
+	for _, observer := range observers {
+		observer(state)
+	}
+}
+
+// lead runs the leadership state machine till the `ctx` is done, it aggregates every `interval` while it's leading
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) lead(ctx context.Context, interval time.Duration) {
+	defer close(memcachedHotKeyAggregator.done)
+	elector := memcachedHotKeyAggregator.elector
+	backoff := MinElectionBackoff
+	var lost <-chan struct{}
+	for state := Campaigning; state != Stopped; {
+		memcachedHotKeyAggregator.transition(state)
+		switch state {
+		case Campaigning:
+			elected, err := elector.Campaign(ctx)
+			switch {
+			case ctx.Err() != nil:
+				state = Stopped
+			case err == ErrCampaignStopped:
+				// the elector gave up this campaign by itself, e.g. to campaign again with a rotated token
+			case err != nil:
+				log.Warningf("<memcached aggregator> campaign again in:%v after error:%v\n", backoff, err)
+				select {
+				case <-ctx.Done():
+					state = Stopped
+				case <-time.After(jitter(backoff)):
+				}
+				if backoff *= 2; backoff > MaxElectionBackoff {
+					backoff = MaxElectionBackoff
+				}
+			default:
+				lost, backoff, state = elected, MinElectionBackoff, Leading
+			}
+		case Leading:
+			// another leader may have published generations meanwhile
+			memcachedHotKeyAggregator.restored = false
+			if mitigation := memcachedHotKeyAggregator.options.Mitigation; mitigation != nil {
+				mitigation.restart()
+			}
+			memcachedHotKeyAggregator.aggregateEvery(ctx, lost, interval)
+			state = SteppingDown
+		case SteppingDown:
+			if err := elector.Resign(); err != nil {
+				log.Warningf("<memcached aggregator> resign failed:%v\n", err)
+			}
+			if state = Campaigning; ctx.Err() != nil {
+				state = Stopped
+			}
+		}
+	}
+	memcachedHotKeyAggregator.transition(Stopped)
+}
+
+// aggregateEvery aggregates every `interval` till the leadership is `lost` or the `ctx` is done,
+// either one cancels the aggregation in progress at once
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) aggregateEvery(ctx context.Context, lost <-chan struct{}, interval time.Duration) {
+	leadership, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-lost:
+			log.Infof("<memcached aggregator> leadership lost:%v\n", time.Now())
+			cancel()
+		case <-leadership.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-leadership.Done():
+			return
+		case <-ticker.C:
+			if err := memcachedHotKeyAggregator.aggregate(leadership); err != nil && leadership.Err() == nil {
+				log.Warningf("<memcached aggregator> aggregate failed:%v\n", err)
+			}
+		}
+	}
+}
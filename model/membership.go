@@ -0,0 +1,371 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	log "github.com/golang/glog"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// ErrAnnounceConflict is an error when the membership key keeps changing under an announcement
+var ErrAnnounceConflict = errors.New("announce conflict")
+
+const (
+	// maxAnnounceAttempts is the number of compare-and-swap attempts of a single announcement
+	maxAnnounceAttempts = 5
+	// ConsulIdentityMeta is the consul service metadata of a registered reporter's identity
+	ConsulIdentityMeta = "identity"
+	// ConsulRegionMeta is the consul service metadata of a registered reporter's region
+	ConsulRegionMeta = "region"
+	// ConsulZoneMeta is the consul service metadata of a registered reporter's zone
+	ConsulZoneMeta = "zone"
+)
+
+// String gives `identity@region/zone`, without the labels the member doesn't have, which `ParseMember` parses
+func (member Member) String() string {
+	if member.Region == "" {
+		return member.Identity
+	}
+	if member.Zone == "" {
+		return fmt.Sprintf("%s@%s", member.Identity, member.Region)
+	}
+	return fmt.Sprintf("%s@%s/%s", member.Identity, member.Region, member.Zone)
+}
+
+// ParseMember parses `identity[@region[/zone]]`
+func ParseMember(member string) Member {
+	parsed := Member{Identity: member}
+	if at := strings.LastIndex(member, "@"); at >= 0 {
+		parsed.Identity = member[:at]
+		labels := strings.SplitN(member[at+1:], "/", 2)
+		parsed.Region = labels[0]
+		if len(labels) > 1 {
+			parsed.Zone = labels[1]
+		}
+	}
+	return parsed
+}
+
+// ConsulDiscovery discovers the healthy instances of the consul service, registered by `RegisterConsulService`
+type ConsulDiscovery struct {
+	serviceName string
+	client      *consul.Client
+}
+
+// Discover queries the consul health of the service
+func (consulDiscovery *ConsulDiscovery) Discover() ([]Member, error) {
+	qo := &consul.QueryOptions{
+		AllowStale:        true,
+		RequireConsistent: false,
+	}
+
+	reporters, _, err := consulDiscovery.client.Health().Service(consulDiscovery.serviceName, "", true, qo)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]Member, 0, len(reporters))
+	for _, reporter := range reporters {
+		members = append(members, consulMember(reporter))
+	}
+	return members, nil
+}
+
+// consulMember gives the identity and labels a reporter registered with, or its service address and port when it registered no identity
+func consulMember(reporter *consul.ServiceEntry) Member {
+	member := Member{
+		Identity: reporter.Service.Meta[ConsulIdentityMeta],
+		Region:   reporter.Service.Meta[ConsulRegionMeta],
+		Zone:     reporter.Service.Meta[ConsulZoneMeta],
+	}
+	if member.Identity == "" {
+		address := reporter.Service.Address
+		if address == "" {
+			address = reporter.Node.Address
+		}
+		member.Identity = fmt.Sprintf("%s:%d", address, reporter.Service.Port)
+	}
+	return member
+}
+
+// RegisterConsulService registers the reporter `member` as an instance of the consul service,
+// consul checks its health at `healthURL` every `interval`, and deregisters it after a minute of failed checks,
+// it gives the service id to deregister with
+func RegisterConsulService(client *consul.Client, serviceName string, member Member, healthURL string, interval time.Duration) (string, error) {
+	identity := member.Identity
+	host, port, err := net.SplitHostPort(identity)
+	if err != nil {
+		return "", err
+	}
+	servicePort, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
+	serviceID := fmt.Sprintf("%s:%s", serviceName, identity)
+	err = client.Agent().ServiceRegister(&consul.AgentServiceRegistration{
+		ID:      serviceID,
+		Name:    serviceName,
+		Address: host,
+		Port:    servicePort,
+		Meta:    map[string]string{ConsulIdentityMeta: identity, ConsulRegionMeta: member.Region, ConsulZoneMeta: member.Zone},
+		Check: &consul.AgentServiceCheck{
+			HTTP:                           healthURL,
+			Interval:                       interval.String(),
+			Timeout:                        interval.String(),
+			DeregisterCriticalServiceAfter: time.Minute.String(),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Infof("<discovery> registered %s as %s of consul service %s\n", identity, serviceID, serviceName)
+	return serviceID, nil
+}
+
+// DeregisterConsulService deregisters the instance `serviceID` of the consul service, so that it's no longer discovered
+// without waiting for its failed checks to deregister it
+func DeregisterConsulService(client *consul.Client, serviceID string) error {
+	if err := client.Agent().ServiceDeregister(serviceID); err != nil {
+		return err
+	}
+	log.Infof("<discovery> deregistered %s from consul\n", serviceID)
+	return nil
+}
+
+// NewConsulDiscovery initializes a `ConsulDiscovery` of the `serviceName`
+func NewConsulDiscovery(serviceName string, client *consul.Client) *ConsulDiscovery {
+	return &ConsulDiscovery{
+		serviceName: serviceName,
+		client:      client,
+	}
+}
+
+// StaticDiscovery always discovers the same members
+type StaticDiscovery struct {
+	members []Member
+}
+
+// Discover gives the static members
+func (staticDiscovery *StaticDiscovery) Discover() ([]Member, error) {
+	return staticDiscovery.members, nil
+}
+
+// NewStaticDiscovery initializes a `StaticDiscovery` of the reporters' `identities`, each might be labeled as `ParseMember` parses
+func NewStaticDiscovery(identities ...string) *StaticDiscovery {
+	members := make([]Member, 0, len(identities))
+	for _, identity := range identities {
+		members = append(members, ParseMember(identity))
+	}
+	return &StaticDiscovery{members: members}
+}
+
+// FileDiscovery discovers the reporters listed in a file, one member per line as `ParseMember` parses, blank lines, `#` comments and members without an identity are skipped,
+// the file is watched, and the members are reloaded whenever it changes
+type FileDiscovery struct {
+	m        sync.RWMutex
+	path     string
+	modified time.Time
+	members  []Member
+}
+
+// Discover gives the members of the last successful load
+func (fileDiscovery *FileDiscovery) Discover() ([]Member, error) {
+	fileDiscovery.m.RLock()
+	defer fileDiscovery.m.RUnlock()
+	return fileDiscovery.members, nil
+}
+
+func (fileDiscovery *FileDiscovery) reload() error {
+	info, err := os.Stat(fileDiscovery.path)
+	if err != nil {
+		return err
+	}
+	fileDiscovery.m.RLock()
+	unchanged := info.ModTime().Equal(fileDiscovery.modified)
+	fileDiscovery.m.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(fileDiscovery.path)
+	if err != nil {
+		return err
+	}
+	members := []Member{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if member := ParseMember(line); member.Identity != "" {
+			members = append(members, member)
+		} else {
+			log.Warningf("<discovery> skipped member %q without an identity in %s\n", line, fileDiscovery.path)
+		}
+	}
+
+	fileDiscovery.m.Lock()
+	defer fileDiscovery.m.Unlock()
+	fileDiscovery.modified = info.ModTime()
+	fileDiscovery.members = members
+	log.Infof("<discovery> reloaded %d members from %s\n", len(members), fileDiscovery.path)
+	return nil
+}
+
+// NewFileDiscovery initializes a `FileDiscovery` of the file at `path`, which is checked for changes every `tick`
+func NewFileDiscovery(path string, tick time.Duration) (*FileDiscovery, error) {
+	fileDiscovery := &FileDiscovery{
+		m:       sync.RWMutex{},
+		path:    path,
+		members: []Member{},
+	}
+	err := fileDiscovery.reload()
+	ticker := time.NewTicker(tick)
+	go func() {
+		for range ticker.C {
+			if err := fileDiscovery.reload(); err != nil {
+				log.Errorf("<discovery> unable to reload members from %s: %v", path, err)
+			}
+		}
+	}()
+	return fileDiscovery, err
+}
+
+// DNSDiscovery discovers the reporters by the SRV records of a name, each target and port is a reporter's identity
+type DNSDiscovery struct {
+	name string
+}
+
+// Discover looks up the SRV records
+func (dnsDiscovery *DNSDiscovery) Discover() ([]Member, error) {
+	_, records, err := net.LookupSRV("", "", dnsDiscovery.name)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]Member, 0, len(records))
+	for _, record := range records {
+		members = append(members, Member{Identity: fmt.Sprintf("%s:%d", strings.TrimSuffix(record.Target, "."), record.Port)})
+	}
+	return members, nil
+}
+
+// NewDNSDiscovery initializes a `DNSDiscovery` of the SRV `name`, e.g. `_mc_hotkeys._tcp.example.com`
+func NewDNSDiscovery(name string) *DNSDiscovery {
+	return &DNSDiscovery{name: name}
+}
+
+// MemcachedMembership is a self announced membership, every reporter adds itself labeled as `Member.String` gives with a timestamp to a memcached key,
+// and members that haven't announced themselves within the `ttl` are dropped
+type MemcachedMembership struct {
+	key    string
+	ttl    time.Duration
+	client *memcache.Client
+}
+
+// Discover gives the members announced within the ttl
+func (membership *MemcachedMembership) Discover() ([]Member, error) {
+	item, err := membership.client.Get(membership.key)
+	if err == memcache.ErrCacheMiss {
+		return []Member{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	announced := map[string]int64{}
+	if err = json.Unmarshal(item.Value, &announced); err != nil {
+		return nil, err
+	}
+	labeled := make([]string, 0, len(announced))
+	for member := range membership.alive(announced, time.Now()) {
+		labeled = append(labeled, member)
+	}
+	sort.Strings(labeled)
+	members := make([]Member, 0, len(labeled))
+	for _, member := range labeled {
+		members = append(members, ParseMember(member))
+	}
+	return members, nil
+}
+
+func (membership *MemcachedMembership) alive(announced map[string]int64, now time.Time) map[string]int64 {
+	since := now.Add(-membership.ttl).UnixNano() / int64(time.Millisecond)
+	for member, at := range announced {
+		if at < since {
+			delete(announced, member)
+		}
+	}
+	return announced
+}
+
+// Announce adds or refreshes the `member` in the membership key with compare-and-swap, dropping the dead members on the way
+func (membership *MemcachedMembership) Announce(member Member) error {
+	for attempt := 0; attempt < maxAnnounceAttempts; attempt++ {
+		now := time.Now()
+		item, err := membership.client.Get(membership.key)
+		announced := map[string]int64{}
+		if err == nil {
+			if json.Unmarshal(item.Value, &announced) != nil {
+				// overwrite a corrupted membership, members will announce themselves again
+				announced = map[string]int64{}
+			}
+		} else if err != memcache.ErrCacheMiss {
+			return err
+		}
+		announced = membership.alive(announced, now)
+		announced[member.String()] = now.UnixNano() / int64(time.Millisecond)
+		rawBytes, err := json.Marshal(announced)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			err = membership.client.Add(&memcache.Item{Key: membership.key, Value: rawBytes})
+		} else {
+			item.Value = rawBytes
+			err = membership.client.CompareAndSwap(item)
+		}
+		if err != memcache.ErrNotStored && err != memcache.ErrCASConflict {
+			return err
+		}
+	}
+	return ErrAnnounceConflict
+}
+
+// StartAnnouncing announces the `member` every `interval`, the ttl should cover a couple of missed announcements
+func (membership *MemcachedMembership) StartAnnouncing(member Member, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for ; true; <-ticker.C {
+			if err := membership.Announce(member); err != nil {
+				log.Warningf("<discovery> cannot announce %v:%v\n", member, err)
+			}
+		}
+	}()
+}
+
+// NewMemcachedMembership initializes a `MemcachedMembership` at the memcached `key`
+func NewMemcachedMembership(key string, ttl time.Duration, client *memcache.Client) *MemcachedMembership {
+	return &MemcachedMembership{
+		key:    key,
+		ttl:    ttl,
+		client: client,
+	}
+}
+
+// MembershipKey is the memcached key of the self announced membership of the reporters of `reportKey`
+func MembershipKey(reportKey string) string {
+	return fmt.Sprintf("%s:members", reportKey)
+}
@@ -0,0 +1,213 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/inexplicable/mc_hotkeys/internal/memcachedtest"
+)
+
+func TestAggregateStaticDiscovery(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	publisher, err := NewResilientPublisher(&memcache.ServerList{}, time.Hour, fake.Addr())
+	if err != nil {
+		panic("publisher should be initialized with fallback")
+	}
+	codec := NewValueCodec(NoCompression, 0)
+	reporter := NewMemcachedHotKeyReporter("host1:11211", "MEMCACHED_HOT_KEYS", 2, time.Second, codec, publisher)
+	reporter.Report(map[string]uint64{"a": 10}, WindowsMetadata{Width: 10, TopN: 2})
+
+	aggregator := &MemcachedHotKeyAggregator{
+		reportKey:       "MEMCACHED_HOT_KEYS",
+		options:         AggregatorOptions{TopN: 2, ReportInterval: time.Second},
+		staleness:       time.Minute,
+		memcachedClient: memcache.New(fake.Addr()),
+		codec:           codec,
+		publisher:       publisher,
+		discovery:       NewStaticDiscovery("host1:11211", "host2:11211"),
+	}
+	if err := aggregator.Aggregate(); err != nil {
+		panic("aggregate should succeed without consul")
+	}
+	rawBytes, ok := fake.Value("MEMCACHED_HOT_KEYS")
+	aggregated := &AggregatedHotKeys{}
+	if !ok || json.Unmarshal(rawBytes, aggregated) != nil {
+		panic("aggregated hot keys should be published")
+	}
+	if len(aggregated.HotKeys) != 1 || aggregated.Reporters["host1:11211"] != ReporterReported || aggregated.Reporters["host2:11211"] != ReporterMissing {
+		panic("every statically discovered reporter should be aggregated")
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "mc_hotkeys")
+	if err != nil {
+		panic("temp dir should be created")
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reporters")
+	ioutil.WriteFile(path, []byte("# reporters\nhost1:11211\n\n"), 0644)
+
+	fileDiscovery, err := NewFileDiscovery(path, 10*time.Millisecond)
+	if err != nil {
+		panic("file discovery should load the file")
+	}
+	if members, _ := fileDiscovery.Discover(); len(members) != 1 || members[0].Identity != "host1:11211" {
+		panic("file discovery should skip comments and blank lines")
+	}
+
+	ioutil.WriteFile(path, []byte("host1:11211@us-east/us-east-1a\nhost2:11211@us-west\n@us-east/us-east-1b\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	time.Sleep(100 * time.Millisecond)
+	members, _ := fileDiscovery.Discover()
+	if len(members) != 2 {
+		panic("file discovery should reload the changed file, and skip the member without an identity")
+	}
+	if members[0] != (Member{Identity: "host1:11211", Region: "us-east", Zone: "us-east-1a"}) || members[1] != (Member{Identity: "host2:11211", Region: "us-west"}) {
+		panic("file discovery should parse the labeled members")
+	}
+}
+
+func TestMemcachedMembership(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	membership := NewMemcachedMembership(MembershipKey("MEMCACHED_HOT_KEYS"), 100*time.Millisecond, memcache.New(fake.Addr()))
+
+	if members, err := membership.Discover(); err != nil || len(members) != 0 {
+		panic("membership should be empty before any announcement")
+	}
+	if membership.Announce(Member{Identity: "host1:11211"}) != nil {
+		panic("announcement should add the membership")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if membership.Announce(Member{Identity: "host2:11211", Region: "us-east", Zone: "us-east-1a"}) != nil || membership.Announce(Member{Identity: "host3:11211"}) != nil {
+		panic("announcements should swap the membership")
+	}
+	members, err := membership.Discover()
+	if err != nil || len(members) != 2 || members[0] != (Member{Identity: "host2:11211", Region: "us-east", Zone: "us-east-1a"}) || members[1].Identity != "host3:11211" {
+		panic("membership should keep the members announced within the ttl")
+	}
+}
+
+func TestConsulDiscovery(t *testing.T) {
+
+	fake := newFakeConsul()
+	defer fake.Close()
+	client := fake.Client("")
+
+	if _, err := RegisterConsulService(client, "mc_hotkeys", Member{Identity: "host1:11211", Region: "us-east", Zone: "us-east-1a"}, "http://host1:8990/health", time.Second); err != nil {
+		panic("reporter should be registered")
+	}
+	client.Agent().ServiceRegister(&consul.AgentServiceRegistration{
+		ID:      "legacy",
+		Name:    "mc_hotkeys",
+		Address: "host2",
+		Port:    11211,
+		Check:   &consul.AgentServiceCheck{HTTP: "http://host2:8990/health", Interval: "1s"},
+	})
+
+	members, err := NewConsulDiscovery("mc_hotkeys", client).Discover()
+	if err != nil || len(members) != 2 {
+		panic("consul discovery should find the registered reporters")
+	}
+	identities := map[string]Member{}
+	for _, member := range members {
+		identities[member.Identity] = member
+	}
+	if identities["host1:11211"].Zone != "us-east-1a" || identities["host2:11211"].Identity == "" {
+		panic("identities and labels should come from the metadata, or the service address and port")
+	}
+}
+
+func TestAggregateConsulLeader(t *testing.T) {
+
+	fakeConsul := newFakeConsul()
+	defer fakeConsul.Close()
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	publisher, err := NewResilientPublisher(&memcache.ServerList{}, time.Hour, fake.Addr())
+	if err != nil {
+		panic("publisher should be initialized with fallback")
+	}
+	codec := NewValueCodec(NoCompression, 0)
+	client := fakeConsul.Client("")
+	serviceIDs := []string{}
+	for i, identity := range []string{"host1:11211", "host2:11211"} {
+		serviceID, err := RegisterConsulService(client, "mc_hotkeys", Member{Identity: identity}, "http://"+identity+"/health", time.Second)
+		if err != nil {
+			panic("reporter should be registered")
+		}
+		serviceIDs = append(serviceIDs, serviceID)
+		reporter := NewMemcachedHotKeyReporter(identity, "MEMCACHED_HOT_KEYS", 2, time.Minute, codec, publisher)
+		reporter.Report(map[string]uint64{string(rune('a' + i)): 10}, WindowsMetadata{Width: 10, TopN: 2})
+	}
+
+	elector, err := NewConsulElector(LeaderKey("mc_hotkeys", "MEMCACHED_HOT_KEYS"), func() (*consul.Client, error) {
+		return fakeConsul.Client(""), nil
+	}, nil)
+	if err != nil {
+		panic("consul elector should be initialized")
+	}
+	selector := &memcache.ServerList{}
+	selector.SetServers(fake.Addr())
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := NewMemcachedHotKeyAggregator(ctx, "mc_hotkeys", "MEMCACHED_HOT_KEYS", AggregatorOptions{
+		TopN:      2,
+		MergeMode: MergeMax,
+		Exact:     true,
+	}, selector, NewConsulDiscovery("mc_hotkeys", client), elector, codec, publisher); err != ErrExactMergeMode {
+		panic("the exact rounds shouldn't merge by anything but sum")
+	}
+	aggregator, err := NewMemcachedHotKeyAggregator(ctx, "mc_hotkeys", "MEMCACHED_HOT_KEYS", AggregatorOptions{
+		TopN:           2,
+		Interval:       20 * time.Millisecond,
+		ReportInterval: time.Minute,
+	}, selector, NewConsulDiscovery("mc_hotkeys", client), elector, codec, publisher)
+	if err != nil {
+		panic("the aggregator should be initialized")
+	}
+
+	aggregated := func(reporters int) *AggregatedHotKeys {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+			rawBytes, ok := fake.Value("MEMCACHED_HOT_KEYS")
+			view := &AggregatedHotKeys{}
+			if ok && json.Unmarshal(rawBytes, view) == nil && len(view.Reporters) == reporters {
+				return view
+			}
+		}
+		panic("the leader should aggregate the reporters discovered in consul")
+	}
+	if view := aggregated(2); len(view.HotKeys) != 2 || view.Reporters["host2:11211"] != ReporterReported {
+		panic("the hot keys of every registered reporter should be aggregated")
+	}
+	if fakeConsul.Holder(LeaderKey("mc_hotkeys", "MEMCACHED_HOT_KEYS")) == "" {
+		panic("the aggregator should hold the consul lock")
+	}
+
+	// a reporter leaving deregisters, and is no longer waited for
+	if DeregisterConsulService(client, serviceIDs[1]) != nil {
+		panic("reporter should be deregistered")
+	}
+	if view := aggregated(1); view.Reporters["host1:11211"] != ReporterReported {
+		panic("a deregistered reporter shouldn't be aggregated")
+	}
+
+	cancel()
+	<-aggregator.Done()
+	if fakeConsul.Holder(LeaderKey("mc_hotkeys", "MEMCACHED_HOT_KEYS")) != "" {
+		panic("a stopped aggregator should release the lock")
+	}
+}
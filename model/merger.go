@@ -0,0 +1,126 @@
+package model
+
+import (
+	"container/heap"
+	"errors"
+)
+
+// MergeMode is how the scores of the same key from different reports are merged
+type MergeMode string
+
+const (
+	// MergeSum adds the scores up, a key moderately hot everywhere beats one extremely hot on a single host
+	MergeSum MergeMode = "sum"
+	// MergeMax takes the highest score, a key is as hot as it is on its hottest host
+	MergeMax MergeMode = "max"
+	// MergeNormalized adds up the scores per second of each report's window width, for reporters of different widths
+	MergeNormalized MergeMode = "normalized"
+)
+
+var (
+	// ErrUnknownMergeMode is an error of an unsupported merge mode
+	ErrUnknownMergeMode = errors.New("unknown merge mode")
+	// ErrExactMergeMode is an error of the exact rounds with a merge mode other than `MergeSum`, which they can't bound
+	ErrExactMergeMode = errors.New("exact rounds only merge by sum")
+)
+
+// ParseMergeMode validates the merge mode name
+func ParseMergeMode(name string) (MergeMode, error) {
+	switch mode := MergeMode(name); mode {
+	case MergeSum, MergeMax, MergeNormalized:
+		return mode, nil
+	case "":
+		return MergeSum, nil
+	default:
+		return MergeSum, ErrUnknownMergeMode
+	}
+}
+
+// HotKeyMerger merges the hot keys of many reports by key, and attributes each merged score to its reporters
+type HotKeyMerger struct {
+	mode    MergeMode
+	entries map[string]*HotKeyEntry
+	stats   map[string]*KeyStats
+}
+
+// Merge adds the hot keys of the report, and their stats
+func (hotKeyMerger *HotKeyMerger) Merge(report *HotKeyReport) {
+	for key, score := range report.HotKeys {
+		hotKeyMerger.MergeScore(key, report.Identity, score, report.Width)
+	}
+	hotKeyMerger.MergeStats(report)
+}
+
+// MergeStats adds up the stats of the report's hot keys, whichever way their scores are merged
+func (hotKeyMerger *HotKeyMerger) MergeStats(report *HotKeyReport) {
+	for key, stats := range report.Stats {
+		hotKeyMerger.mergeKeyStats(key, stats)
+	}
+}
+
+func (hotKeyMerger *HotKeyMerger) mergeKeyStats(key string, stats *KeyStats) {
+	if stats == nil {
+		return
+	}
+	merged, ok := hotKeyMerger.stats[key]
+	if !ok {
+		merged = &KeyStats{}
+		hotKeyMerger.stats[key] = merged
+	}
+	merged.Add(stats)
+}
+
+// AttachStats gives the entries the merged stats of their keys
+func (hotKeyMerger *HotKeyMerger) AttachStats(entries HotKeyEntries) {
+	for _, entry := range entries {
+		if stats, ok := hotKeyMerger.stats[entry.Key]; ok {
+			entry.Stats = stats
+		}
+	}
+}
+
+// MergeScore adds a single key's `score` of the reporter `identity` over a window of `width`
+func (hotKeyMerger *HotKeyMerger) MergeScore(key string, identity string, score uint64, width int) {
+	if hotKeyMerger.mode == MergeNormalized && width > 0 {
+		score /= uint64(width)
+	}
+	entry, ok := hotKeyMerger.entries[key]
+	if !ok {
+		entry = &HotKeyEntry{Key: key, Reporters: map[string]uint64{}}
+		hotKeyMerger.entries[key] = entry
+	}
+	entry.Reporters[identity] += score
+	switch hotKeyMerger.mode {
+	case MergeMax:
+		if entry.Reporters[identity] > entry.Score {
+			entry.Score = entry.Reporters[identity]
+		}
+	default:
+		entry.Score += score
+	}
+}
+
+// Top gives the `n` highest merged entries, from the highest to the lowest
+func (hotKeyMerger *HotKeyMerger) Top(n int) HotKeyEntries {
+	hotKeyEntries := make(HotKeyEntries, 0, len(hotKeyMerger.entries))
+	for _, entry := range hotKeyMerger.entries {
+		hotKeyEntries = append(hotKeyEntries, entry)
+	}
+	heap.Init(&hotKeyEntries)
+	cutN := HotKeyEntries(make([]*HotKeyEntry, 0, n))
+	for t := 0; t < n && hotKeyEntries.Len() > 0; t++ {
+		if top, ok := heap.Pop(&hotKeyEntries).(*HotKeyEntry); ok {
+			cutN = append(cutN, top)
+		}
+	}
+	return cutN
+}
+
+// NewHotKeyMerger initializes an empty `HotKeyMerger` of the merge `mode`
+func NewHotKeyMerger(mode MergeMode) *HotKeyMerger {
+	return &HotKeyMerger{
+		mode:    mode,
+		entries: map[string]*HotKeyEntry{},
+		stats:   map[string]*KeyStats{},
+	}
+}
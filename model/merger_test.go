@@ -0,0 +1,69 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mergerReports() []*HotKeyReport {
+	return []*HotKeyReport{
+		{Identity: "host1:11211", Width: 10, HotKeys: map[string]uint64{"everywhere": 600, "single_host": 1500}},
+		{Identity: "host2:11211", Width: 10, HotKeys: map[string]uint64{"everywhere": 600}},
+		{Identity: "host3:11211", Width: 5, HotKeys: map[string]uint64{"everywhere": 600}},
+	}
+}
+
+func TestHotKeyMergerSum(t *testing.T) {
+
+	merger := NewHotKeyMerger(MergeSum)
+	for _, report := range mergerReports() {
+		merger.Merge(report)
+	}
+	top := merger.Top(1)
+	if len(top) != 1 || top[0].Key != "everywhere" || top[0].Score != 1800 {
+		panic("sum should favor a key moderately hot everywhere")
+	}
+	if !reflect.DeepEqual(top[0].Reporters, map[string]uint64{"host1:11211": 600, "host2:11211": 600, "host3:11211": 600}) {
+		panic("merged score should be attributed to its reporters")
+	}
+	if len(merger.Top(10)) != 2 {
+		panic("the same key should appear once")
+	}
+}
+
+func TestHotKeyMergerMax(t *testing.T) {
+
+	merger := NewHotKeyMerger(MergeMax)
+	for _, report := range mergerReports() {
+		merger.Merge(report)
+	}
+	top := merger.Top(2)
+	if top[0].Key != "single_host" || top[0].Score != 1500 || top[1].Key != "everywhere" || top[1].Score != 600 {
+		panic("max should take the hottest host's score")
+	}
+}
+
+func TestHotKeyMergerNormalized(t *testing.T) {
+
+	merger := NewHotKeyMerger(MergeNormalized)
+	for _, report := range mergerReports() {
+		merger.Merge(report)
+	}
+	top := merger.Top(2)
+	if top[0].Key != "everywhere" || top[0].Score != 60+60+120 || top[1].Score != 150 {
+		panic("normalized should sum the scores per second of each window width")
+	}
+	if top[0].Reporters["host3:11211"] != 120 {
+		panic("normalized attribution should be per second")
+	}
+}
+
+func TestParseMergeMode(t *testing.T) {
+
+	if mode, err := ParseMergeMode("normalized"); err != nil || mode != MergeNormalized {
+		panic("normalized should be supported")
+	}
+	if _, err := ParseMergeMode("avg"); err != ErrUnknownMergeMode {
+		panic("avg is not supported")
+	}
+}
@@ -0,0 +1,266 @@
+package model
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	// DefaultMitigationRounds is the number of aggregations in a row a key must be hot in before it's mitigated
+	DefaultMitigationRounds = 3
+	// DefaultMitigationMaxKeys caps the keys mitigated at once
+	DefaultMitigationMaxKeys = 20
+	// DefaultMitigationCooldown is how long a mitigated key stays mitigated after it's no longer hot
+	DefaultMitigationCooldown = 5 * time.Minute
+	// DefaultMitigationInterval is the least time between two writes of the fragment
+	DefaultMitigationInterval = time.Minute
+)
+
+// FragmentStore is where the mitigation fragment is written, and where mcrouter watches it, it must be shared by every aggregator
+// which may lead and every mcrouter, or the fragments of former leaders never cool down
+type FragmentStore interface {
+	Read() ([]byte, error)
+	Write(fragment []byte) error
+}
+
+// ConsulFragmentStore stores the fragment at a consul KV key, e.g. rendered into mcrouter's config by consul-template
+type ConsulFragmentStore struct {
+	key       string
+	newClient func() (*consul.Client, error)
+}
+
+// Read gets the fragment, a missing key is no fragment
+func (consulFragmentStore *ConsulFragmentStore) Read() ([]byte, error) {
+	client, err := consulFragmentStore.newClient()
+	if err != nil {
+		return nil, err
+	}
+	pair, _, err := client.KV().Get(consulFragmentStore.key, nil)
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	return pair.Value, nil
+}
+
+// Write puts the fragment
+func (consulFragmentStore *ConsulFragmentStore) Write(fragment []byte) error {
+	client, err := consulFragmentStore.newClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.KV().Put(&consul.KVPair{Key: consulFragmentStore.key, Value: fragment}, nil)
+	return err
+}
+
+// NewConsulFragmentStore initializes a `ConsulFragmentStore` at the KV `key`, every read and write uses a client of `newClient`,
+// which picks up the rotated tokens
+func NewConsulFragmentStore(key string, newClient func() (*consul.Client, error)) *ConsulFragmentStore {
+	return &ConsulFragmentStore{key: key, newClient: newClient}
+}
+
+// MitigationOptions tunes which keys are mitigated and how often the fragment changes
+type MitigationOptions struct {
+	// Target gives the route a mitigated key is sent to, e.g. the `ReplicatedTarget` of its original route
+	Target func(key string) interface{}
+	// Wildcard is the route of every other key, the fragment replaces the whole routing,
+	// so it must route them as the original config does, e.g. its `PrefixSelectorRoute` of every prefix
+	Wildcard interface{}
+	// Rounds is the number of aggregations in a row a key must be hot in
+	Rounds int
+	// MinScore is the least score of a key to count as hot
+	MinScore uint64
+	// MaxKeys caps the mitigated keys, the hottest are mitigated first
+	MaxKeys int
+	// Cooldown is how long a key stays mitigated after it was last hot
+	Cooldown time.Duration
+	// Interval is the least time between two writes of the fragment
+	Interval time.Duration
+}
+
+// ReplicatedTarget is a target reading from the fastest of the replicated `pools`, and writing to all of them and the `original` route,
+// so that the pool owning a key never serves a stale value once the key cools down and is routed back to it,
+// a nil `original` is a key no route took
+func ReplicatedTarget(original interface{}, pools ...string) interface{} {
+	readers := make([]interface{}, 0, len(pools))
+	for _, pool := range pools {
+		readers = append(readers, "PoolRoute|"+pool)
+	}
+	writers := readers
+	if original != nil {
+		writers = append([]interface{}{original}, readers...)
+	}
+	return map[string]interface{}{
+		"type":           "OperationSelectorRoute",
+		"default_policy": map[string]interface{}{"type": "AllSyncRoute", "children": writers},
+		"operation_policies": map[string]interface{}{
+			"get":  map[string]interface{}{"type": "AllFastestRoute", "children": readers},
+			"gets": map[string]interface{}{"type": "AllFastestRoute", "children": readers},
+		},
+	}
+}
+
+// mitigationFragment is the route mcrouter imports, the mitigated keys are matched as prefixes,
+// which may catch longer keys sharing them as well
+type mitigationFragment struct {
+	Type     string                 `json:"type"`
+	Policies map[string]interface{} `json:"policies"`
+	Wildcard interface{}            `json:"wildcard"`
+}
+
+// MitigationController turns the keys which stay hot into a mcrouter `PrefixSelectorRoute` sending them to the target,
+// and drops them after they cool down
+type MitigationController struct {
+	m         sync.Mutex
+	options   MitigationOptions
+	store     FragmentStore
+	streaks   map[string]int
+	lastHot   map[string]time.Time
+	mitigated map[string]bool
+	restored  bool
+	written   time.Time
+	dirty     bool
+}
+
+// restore picks up the keys mitigated by the fragment in the store, e.g. by the previous leader, as just hot
+func (controller *MitigationController) restore(now time.Time) error {
+	b, err := controller.store.Read()
+	if err != nil {
+		return err
+	}
+	controller.restored = true
+	fragment := &mitigationFragment{}
+	if len(b) == 0 || json.Unmarshal(b, fragment) != nil {
+		return nil
+	}
+	for key := range fragment.Policies {
+		controller.mitigated[key] = true
+		controller.lastHot[key] = now
+	}
+	return nil
+}
+
+// restart forgets the streaks and the mitigated keys, which are restored from the store on the next observation,
+// as another leader may have changed them meanwhile
+func (controller *MitigationController) restart() {
+	controller.m.Lock()
+	defer controller.m.Unlock()
+	controller.streaks = map[string]int{}
+	controller.lastHot = map[string]time.Time{}
+	controller.mitigated = map[string]bool{}
+	controller.restored, controller.dirty = false, false
+}
+
+// Observe counts the streaks of the hot keys of an aggregated view, mitigates and cools down keys, and writes the fragment
+// if it changed and the last write isn't too recent
+func (controller *MitigationController) Observe(view *AggregatedHotKeys) error {
+	controller.m.Lock()
+	defer controller.m.Unlock()
+	now := time.Now()
+	if !controller.restored {
+		// without the keys mitigated so far, a write would drop them all
+		if err := controller.restore(now); err != nil {
+			return err
+		}
+	}
+
+	hot := map[string]bool{}
+	candidates := HotKeyEntries{}
+	for _, entry := range view.HotKeys {
+		if entry.Score < controller.options.MinScore {
+			continue
+		}
+		hot[entry.Key] = true
+		controller.streaks[entry.Key]++
+		controller.lastHot[entry.Key] = now
+		if !controller.mitigated[entry.Key] && controller.streaks[entry.Key] >= controller.options.Rounds {
+			candidates = append(candidates, entry)
+		}
+	}
+	for key := range controller.streaks {
+		if !hot[key] {
+			delete(controller.streaks, key)
+		}
+	}
+	for key := range controller.mitigated {
+		if now.Sub(controller.lastHot[key]) > controller.options.Cooldown {
+			log.Infof("<mitigation> %s cooled down\n", key)
+			delete(controller.mitigated, key)
+			delete(controller.lastHot, key)
+			controller.dirty = true
+		}
+	}
+	for key := range controller.lastHot {
+		if !controller.mitigated[key] && !hot[key] {
+			delete(controller.lastHot, key)
+		}
+	}
+	sort.Sort(candidates)
+	for _, entry := range candidates {
+		if len(controller.mitigated) >= controller.options.MaxKeys {
+			log.Warningf("<mitigation> cannot mitigate %s beyond the cap of %d keys\n", entry.Key, controller.options.MaxKeys)
+			break
+		}
+		log.Infof("<mitigation> mitigates %s hot for %d rounds\n", entry.Key, controller.streaks[entry.Key])
+		controller.mitigated[entry.Key] = true
+		controller.dirty = true
+	}
+
+	if !controller.dirty || now.Sub(controller.written) < controller.options.Interval {
+		return nil
+	}
+	policies := make(map[string]interface{}, len(controller.mitigated))
+	for key := range controller.mitigated {
+		policies[key] = controller.options.Target(key)
+	}
+	fragment, err := json.MarshalIndent(&mitigationFragment{Type: "PrefixSelectorRoute", Policies: policies, Wildcard: controller.options.Wildcard}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = controller.store.Write(fragment); err != nil {
+		return err
+	}
+	controller.written, controller.dirty = now, false
+	log.Infof("<mitigation> wrote the fragment of %d keys\n", len(policies))
+	return nil
+}
+
+// Mitigated gives the mitigated keys in order
+func (controller *MitigationController) Mitigated() []string {
+	controller.m.Lock()
+	defer controller.m.Unlock()
+	keys := make([]string, 0, len(controller.mitigated))
+	for key := range controller.mitigated {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NewMitigationController initializes a `MitigationController` writing to the `store`, the zero options take the defaults
+func NewMitigationController(options MitigationOptions, store FragmentStore) *MitigationController {
+	if options.Rounds <= 0 {
+		options.Rounds = DefaultMitigationRounds
+	}
+	if options.MaxKeys <= 0 {
+		options.MaxKeys = DefaultMitigationMaxKeys
+	}
+	if options.Cooldown <= 0 {
+		options.Cooldown = DefaultMitigationCooldown
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultMitigationInterval
+	}
+	return &MitigationController{
+		m:         sync.Mutex{},
+		options:   options,
+		store:     store,
+		streaks:   map[string]int{},
+		lastHot:   map[string]time.Time{},
+		mitigated: map[string]bool{},
+	}
+}
@@ -0,0 +1,105 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func TestMitigationController(t *testing.T) {
+
+	fake := newFakeConsul()
+	defer fake.Close()
+	store := NewConsulFragmentStore("mcrouter/hotkeys", func() (*consul.Client, error) { return fake.Client(""), nil })
+	originals := map[string]interface{}{"a": "PoolRoute|main", "b": "PoolRoute|main", "x": "PoolRoute|other"}
+	wildcard := map[string]interface{}{"type": "PrefixSelectorRoute", "policies": map[string]interface{}{"x": "PoolRoute|other"}, "wildcard": "PoolRoute|main"}
+	options := MitigationOptions{
+		Target: func(key string) interface{} {
+			return ReplicatedTarget(originals[key], "replicated-a", "replicated-b")
+		},
+		Wildcard: wildcard,
+		Rounds:   2,
+		MinScore: 10,
+		MaxKeys:  1,
+		Cooldown: 50 * time.Millisecond,
+		Interval: time.Nanosecond,
+	}
+	controller := NewMitigationController(options, store)
+	view := func(entries ...*HotKeyEntry) *AggregatedHotKeys {
+		return &AggregatedHotKeys{HotKeys: entries}
+	}
+	fragment := func() *mitigationFragment {
+		b, _ := store.Read()
+		parsed := &mitigationFragment{}
+		if json.Unmarshal(b, parsed) != nil {
+			panic("the fragment should be written")
+		}
+		return parsed
+	}
+
+	controller.Observe(view(&HotKeyEntry{Key: "a", Score: 100}, &HotKeyEntry{Key: "b", Score: 50}, &HotKeyEntry{Key: "c", Score: 5}))
+	if len(controller.Mitigated()) != 0 {
+		panic("a key hot only once shouldn't be mitigated")
+	}
+	controller.Observe(view(&HotKeyEntry{Key: "a", Score: 100}, &HotKeyEntry{Key: "b", Score: 50}, &HotKeyEntry{Key: "c", Score: 5}))
+	if !reflect.DeepEqual(controller.Mitigated(), []string{"a"}) {
+		panic("only the hottest key should be mitigated within the cap")
+	}
+	written := fragment()
+	if written.Type != "PrefixSelectorRoute" || written.Policies["a"] == nil || !reflect.DeepEqual(written.Wildcard, wildcard) {
+		panic("the fragment should route the mitigated key to its target, and every other key as the original routing")
+	}
+	target := written.Policies["a"].(map[string]interface{})
+	writers := target["default_policy"].(map[string]interface{})["children"].([]interface{})
+	readers := target["operation_policies"].(map[string]interface{})["get"].(map[string]interface{})["children"].([]interface{})
+	if !reflect.DeepEqual(writers, []interface{}{"PoolRoute|main", "PoolRoute|replicated-a", "PoolRoute|replicated-b"}) ||
+		!reflect.DeepEqual(readers, []interface{}{"PoolRoute|replicated-a", "PoolRoute|replicated-b"}) {
+		panic("the mitigated key should be read from the replicated pools, and written to its own pool as well")
+	}
+
+	// another leader picks up the mitigated keys from the fragment
+	successor := NewMitigationController(options, store)
+	successor.Observe(view())
+	if !reflect.DeepEqual(successor.Mitigated(), []string{"a"}) {
+		panic("the mitigated keys should be restored from the fragment")
+	}
+	time.Sleep(60 * time.Millisecond)
+	successor.Observe(view())
+	if len(successor.Mitigated()) != 0 || len(fragment().Policies) != 0 {
+		panic("a key should be dropped once it cools down")
+	}
+	// the key is routed back to the pool which took every write and delete of it while it was mitigated
+	if cooled := fragment().Wildcard.(map[string]interface{}); cooled["wildcard"] != writers[0] {
+		panic("a key cooled down should be routed back to the pool kept up to date")
+	}
+
+	limited := NewMitigationController(MitigationOptions{Target: options.Target, Rounds: 1, Interval: time.Hour}, store)
+	limited.Observe(view(&HotKeyEntry{Key: "x", Score: 1}))
+	limited.Observe(view(&HotKeyEntry{Key: "x", Score: 1}, &HotKeyEntry{Key: "y", Score: 1}))
+	policies := fragment().Policies
+	if len(policies) != 1 || policies["x"] == nil {
+		panic("the fragment shouldn't be written again within the interval")
+	}
+	if target := policies["x"].(map[string]interface{}); target["default_policy"].(map[string]interface{})["children"].([]interface{})[0] != "PoolRoute|other" {
+		panic("the mitigated key should be written to the pool of its own prefix")
+	}
+}
+
+func TestConsulFragmentStore(t *testing.T) {
+
+	fake := newFakeConsul()
+	defer fake.Close()
+	store := NewConsulFragmentStore("mcrouter/hotkeys", func() (*consul.Client, error) { return fake.Client(""), nil })
+	if b, err := store.Read(); err != nil || b != nil {
+		panic("a missing key should be no fragment")
+	}
+	if store.Write([]byte(`{"type":"PrefixSelectorRoute"}`)) != nil {
+		panic("the fragment should be put")
+	}
+	if b, _ := store.Read(); string(b) != `{"type":"PrefixSelectorRoute"}` {
+		panic("the fragment should be read back")
+	}
+}
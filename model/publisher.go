@@ -0,0 +1,316 @@
+package model
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	log "github.com/golang/glog"
+)
+
+// ErrNoRoute is an error when neither a registered mcrouter nor a fallback server could take an item
+var ErrNoRoute = errors.New("no route to publish")
+
+const (
+	// DefaultPublishRetries is the number of retries of each destination before giving up on it
+	DefaultPublishRetries = 2
+	// DefaultPublishBackoff is the base of the exponential backoff between retries
+	DefaultPublishBackoff = 20 * time.Millisecond
+	// DefaultBreakerFailures is the number of consecutive failures that opens the circuit of a destination
+	DefaultBreakerFailures = 3
+	// DefaultBreakerCooldown is how long an open circuit rejects before it lets a probing publish through
+	DefaultBreakerCooldown = 10 * time.Second
+)
+
+// circuitBreaker guards a single destination, it opens after `threshold` consecutive failures,
+// and half opens after `cooldown` to let a single publish probe the destination
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+	threshold int
+	cooldown  time.Duration
+}
+
+func (breaker *circuitBreaker) allow(now time.Time) bool {
+	return !now.Before(breaker.openUntil)
+}
+
+func (breaker *circuitBreaker) succeed() {
+	breaker.failures = 0
+	breaker.openUntil = time.Time{}
+}
+
+func (breaker *circuitBreaker) fail(now time.Time) {
+	breaker.failures++
+	if breaker.failures >= breaker.threshold {
+		breaker.openUntil = now.Add(breaker.cooldown)
+	}
+}
+
+// ResilientPublisher publishes to the mcrouters of the registry, or the static fallback servers when there's none,
+// each destination is retried with jittered backoff and guarded by its own circuit breaker,
+// the latest value of each key that couldn't be published is kept and published once a route exists
+type ResilientPublisher struct {
+	m          sync.Mutex
+	publishing sync.Mutex
+	selectors  []memcache.ServerSelector
+	clients    map[string]*memcache.Client
+	breakers   map[string]*circuitBreaker
+	pending    map[string][]*memcache.Item
+	retries    int
+	backoff    time.Duration
+}
+
+// Publish sets the item to the first destination that takes it, otherwise buffers it till the next flush
+func (resilientPublisher *ResilientPublisher) Publish(item *memcache.Item) error {
+	return resilientPublisher.PublishItems([]*memcache.Item{item})
+}
+
+// PublishItems publishes the items of an encoded value in order, and stops at the first failure,
+// otherwise buffers them till the next flush in place of any older value of the same key, which is the last item's,
+// so the chunks of the failed values, whose keys differ by generation, never pile up
+func (resilientPublisher *ResilientPublisher) PublishItems(items []*memcache.Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	resilientPublisher.publishing.Lock()
+	defer resilientPublisher.publishing.Unlock()
+
+	err := resilientPublisher.publishAll(items)
+	key := items[len(items)-1].Key
+	resilientPublisher.m.Lock()
+	defer resilientPublisher.m.Unlock()
+	if err != nil {
+		resilientPublisher.pending[key] = items
+	} else {
+		delete(resilientPublisher.pending, key)
+	}
+	return err
+}
+
+// Pending gives the number of keys whose latest value is not yet published
+func (resilientPublisher *ResilientPublisher) Pending() int {
+	resilientPublisher.m.Lock()
+	defer resilientPublisher.m.Unlock()
+	return len(resilientPublisher.pending)
+}
+
+func (resilientPublisher *ResilientPublisher) publishAll(items []*memcache.Item) error {
+	for _, item := range items {
+		if err := resilientPublisher.publish(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (resilientPublisher *ResilientPublisher) publish(item *memcache.Item) error {
+	err := ErrNoRoute
+	for _, addr := range resilientPublisher.destinations(item.Key) {
+		client, breaker := resilientPublisher.destination(addr)
+		resilientPublisher.m.Lock()
+		allowed := breaker.allow(time.Now())
+		resilientPublisher.m.Unlock()
+		if !allowed {
+			continue
+		}
+		for attempt := 0; attempt <= resilientPublisher.retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(jitter(resilientPublisher.backoff << uint(attempt-1)))
+			}
+			if err = client.Set(item); err == nil {
+				break
+			}
+		}
+		resilientPublisher.m.Lock()
+		if err == nil {
+			breaker.succeed()
+		} else {
+			breaker.fail(time.Now())
+		}
+		resilientPublisher.m.Unlock()
+		if err == nil {
+			return nil
+		}
+		log.Warningf("<publisher> %s failed to take %s:%v\n", addr, item.Key, err)
+	}
+	return err
+}
+
+// destinations picks a server of every selector in order, selectors without a server are skipped
+func (resilientPublisher *ResilientPublisher) destinations(key string) []string {
+	destinations := make([]string, 0, len(resilientPublisher.selectors))
+	for _, selector := range resilientPublisher.selectors {
+		if addr, err := selector.PickServer(key); err == nil {
+			destinations = append(destinations, addr.String())
+		}
+	}
+	return destinations
+}
+
+// Selector picks the servers the published items are read from, the same route they're published through
+func (resilientPublisher *ResilientPublisher) Selector() memcache.ServerSelector {
+	return FallbackSelector(resilientPublisher.selectors)
+}
+
+func (resilientPublisher *ResilientPublisher) destination(addr string) (*memcache.Client, *circuitBreaker) {
+	resilientPublisher.m.Lock()
+	defer resilientPublisher.m.Unlock()
+
+	client, ok := resilientPublisher.clients[addr]
+	if !ok {
+		client = memcache.New(addr)
+		resilientPublisher.clients[addr] = client
+		resilientPublisher.breakers[addr] = &circuitBreaker{
+			threshold: DefaultBreakerFailures,
+			cooldown:  DefaultBreakerCooldown,
+		}
+	}
+	return client, resilientPublisher.breakers[addr]
+}
+
+// prune drops the clients and breakers of the destinations no selector has any longer, e.g. the mcrouters gone from the registry
+func (resilientPublisher *ResilientPublisher) prune() {
+	selected := map[string]bool{}
+	FallbackSelector(resilientPublisher.selectors).Each(func(addr net.Addr) error {
+		selected[addr.String()] = true
+		return nil
+	})
+	resilientPublisher.m.Lock()
+	defer resilientPublisher.m.Unlock()
+	for addr, client := range resilientPublisher.clients {
+		if !selected[addr] {
+			client.Close()
+			delete(resilientPublisher.clients, addr)
+			delete(resilientPublisher.breakers, addr)
+		}
+	}
+}
+
+// flush retries the buffered values, it's a noop till a route exists
+func (resilientPublisher *ResilientPublisher) flush() {
+	resilientPublisher.m.Lock()
+	pending := make([][]*memcache.Item, 0, len(resilientPublisher.pending))
+	for _, items := range resilientPublisher.pending {
+		pending = append(pending, items)
+	}
+	resilientPublisher.m.Unlock()
+
+	for _, items := range pending {
+		last := items[len(items)-1]
+		if len(resilientPublisher.destinations(last.Key)) == 0 {
+			continue
+		}
+		resilientPublisher.publishing.Lock()
+		resilientPublisher.m.Lock()
+		// a newer value might have been published or buffered meanwhile
+		latest, ok := resilientPublisher.pending[last.Key]
+		resilientPublisher.m.Unlock()
+		if ok && latest[len(latest)-1] == last {
+			if err := resilientPublisher.publishAll(items); err == nil {
+				resilientPublisher.m.Lock()
+				if latest, ok := resilientPublisher.pending[last.Key]; ok && latest[len(latest)-1] == last {
+					delete(resilientPublisher.pending, last.Key)
+				}
+				resilientPublisher.m.Unlock()
+				log.Infof("<publisher> published buffered %s\n", last.Key)
+			}
+		}
+		resilientPublisher.publishing.Unlock()
+	}
+}
+
+// FallbackSelector picks a server of the first selector which has any, e.g. the mcrouter registry, and then the fallback servers
+type FallbackSelector []memcache.ServerSelector
+
+// PickServer picks the server of the `key` from the first selector which has a server
+func (fallbackSelector FallbackSelector) PickServer(key string) (net.Addr, error) {
+	err := memcache.ErrNoServers
+	for _, selector := range fallbackSelector {
+		var addr net.Addr
+		if addr, err = selector.PickServer(key); err == nil {
+			return addr, nil
+		}
+	}
+	return nil, err
+}
+
+// Each iterates the servers of every selector
+func (fallbackSelector FallbackSelector) Each(f func(net.Addr) error) error {
+	for _, selector := range fallbackSelector {
+		if err := selector.Each(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FanoutPublisher publishes every item to all of its publishers, e.g. the memcached pool of every cluster
+type FanoutPublisher []Publisher
+
+// Publish publishes the item to every publisher, even if some fail, and gives the first failure
+func (fanoutPublisher FanoutPublisher) Publish(item *memcache.Item) error {
+	var first error
+	for _, publisher := range fanoutPublisher {
+		if err := publisher.Publish(item); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// PublishItems publishes the items of an encoded value to every publisher as a whole, even if some fail, and gives the first failure
+func (fanoutPublisher FanoutPublisher) PublishItems(items []*memcache.Item) error {
+	var first error
+	for _, publisher := range fanoutPublisher {
+		if err := publishItems(publisher, items); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// jitter randomizes `d` within [d/2, d) so that retries from different hosts scatter
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// NewResilientPublisher initializes a `ResilientPublisher` publishing through the `registry`,
+// or through the static `fallbackServers` when the registry has no mcrouter, buffered items are flushed every `flushInterval`
+func NewResilientPublisher(registry memcache.ServerSelector, flushInterval time.Duration, fallbackServers ...string) (*ResilientPublisher, error) {
+
+	selectors := []memcache.ServerSelector{registry}
+	if len(fallbackServers) > 0 {
+		fallback := &memcache.ServerList{}
+		if err := fallback.SetServers(fallbackServers...); err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, fallback)
+	}
+
+	publisher := &ResilientPublisher{
+		m:          sync.Mutex{},
+		publishing: sync.Mutex{},
+		selectors:  selectors,
+		clients:    map[string]*memcache.Client{},
+		breakers:   map[string]*circuitBreaker{},
+		pending:    map[string][]*memcache.Item{},
+		retries:    DefaultPublishRetries,
+		backoff:    DefaultPublishBackoff,
+	}
+
+	ticker := time.NewTicker(flushInterval)
+	go func() {
+		for range ticker.C {
+			publisher.prune()
+			publisher.flush()
+		}
+	}()
+	return publisher, nil
+}
@@ -0,0 +1,167 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/inexplicable/mc_hotkeys/internal/memcachedtest"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+
+	now := time.Now()
+	breaker := &circuitBreaker{threshold: 2, cooldown: time.Second}
+	if !breaker.allow(now) {
+		panic("breaker should start closed")
+	}
+	breaker.fail(now)
+	if !breaker.allow(now) {
+		panic("breaker should stay closed below the threshold")
+	}
+	breaker.fail(now)
+	if breaker.allow(now) {
+		panic("breaker should open at the threshold")
+	}
+	if !breaker.allow(now.Add(time.Second)) {
+		panic("breaker should half open after the cooldown")
+	}
+	breaker.fail(now.Add(time.Second))
+	if breaker.allow(now.Add(time.Second)) {
+		panic("breaker should reopen when the probe fails")
+	}
+	breaker.succeed()
+	if !breaker.allow(now) {
+		panic("breaker should close after a success")
+	}
+}
+
+func TestResilientPublisherWithoutRoute(t *testing.T) {
+
+	registry := NewMcrouterRegistry(8990)
+	publisher, err := NewResilientPublisher(registry, time.Hour)
+	if err != nil {
+		panic("publisher should be initialized without fallback")
+	}
+
+	if publisher.Publish(&memcache.Item{Key: "some_key", Value: []byte("1")}) != ErrNoRoute {
+		panic("publish should fail without any route")
+	}
+	if publisher.Publish(&memcache.Item{Key: "some_key", Value: []byte("2")}) != ErrNoRoute || publisher.Pending() != 1 {
+		panic("only the latest item of a key should be buffered")
+	}
+
+	codec := NewValueCodec(NoCompression, 4)
+	for i := 0; i < 3; i++ {
+		if publishView(publisher, codec, "some_key", []byte(`{"hot_keys":["some_hot_key"]}`), time.Second) != ErrNoRoute {
+			panic("chunked publish should fail without any route")
+		}
+	}
+	if publisher.Pending() != 1 || len(publisher.pending["some_key"]) < 2 {
+		panic("only the latest chunked value of a key should be buffered, as a whole")
+	}
+}
+
+func TestResilientPublisherFallback(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+
+	registry := NewMcrouterRegistry(8990)
+	publisher, err := NewResilientPublisher(registry, 50*time.Millisecond, fake.Addr())
+	if err != nil {
+		panic("publisher should be initialized with fallback")
+	}
+
+	if publisher.Publish(&memcache.Item{Key: "some_key", Value: []byte("1")}) != nil || publisher.Pending() != 0 {
+		panic("publish should go to the fallback server")
+	}
+	if value, ok := fake.Value("some_key"); !ok || string(value) != "1" {
+		panic("fallback server should have the item")
+	}
+	if item, err := memcache.NewFromSelector(publisher.Selector()).Get("some_key"); err != nil || string(item.Value) != "1" {
+		panic("the item published to the fallback server should be read from there")
+	}
+
+	fake.Close()
+	if publisher.Publish(&memcache.Item{Key: "some_key", Value: []byte("2")}) == nil || publisher.Pending() != 1 {
+		panic("publish should be buffered when the fallback is down")
+	}
+}
+
+func TestResilientPublisherFlush(t *testing.T) {
+
+	down := memcachedtest.NewServer()
+	addr := down.Addr()
+	down.Close()
+
+	publisher, err := NewResilientPublisher(&memcache.ServerList{}, 50*time.Millisecond, addr)
+	if err != nil {
+		panic("publisher should be initialized with fallback")
+	}
+	if publisher.Publish(&memcache.Item{Key: "some_key", Value: []byte("1")}) == nil {
+		panic("publish should fail when the destination is down")
+	}
+
+	// the route is back at the same address
+	up := memcachedtest.NewServerAt(addr)
+	defer up.Close()
+	// the failed publish, and any flush before the route came back, count against the breaker, skip the cooldown they might have opened
+	publisher.m.Lock()
+	for _, breaker := range publisher.breakers {
+		breaker.succeed()
+	}
+	publisher.m.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+	if value, ok := up.Value("some_key"); !ok || string(value) != "1" || publisher.Pending() != 0 {
+		panic("buffered item should be flushed once a route exists")
+	}
+}
+
+func TestResilientPublisherPrune(t *testing.T) {
+
+	pools := []*memcachedtest.Server{memcachedtest.NewServer(), memcachedtest.NewServer()}
+	for _, pool := range pools {
+		defer pool.Close()
+	}
+	selector := &memcache.ServerList{}
+	selector.SetServers(pools[0].Addr())
+	publisher, err := NewResilientPublisher(selector, time.Hour)
+	if err != nil {
+		panic("publisher should be initialized without fallback")
+	}
+	publisher.Publish(&memcache.Item{Key: "some_key", Value: []byte("1")})
+
+	// the first pool is gone, e.g. its mcrouter left the registry
+	selector.SetServers(pools[1].Addr())
+	publisher.Publish(&memcache.Item{Key: "some_key", Value: []byte("2")})
+	publisher.prune()
+	publisher.m.Lock()
+	defer publisher.m.Unlock()
+	if _, ok := publisher.clients[pools[0].Addr()]; ok || len(publisher.clients) != 1 || len(publisher.breakers) != 1 {
+		panic("the destinations no longer selected should be dropped")
+	}
+}
+
+func TestFanoutPublisher(t *testing.T) {
+
+	pools := []*memcachedtest.Server{memcachedtest.NewServer(), memcachedtest.NewServer()}
+	publishers := FanoutPublisher{}
+	for _, pool := range pools {
+		defer pool.Close()
+		publisher, err := NewResilientPublisher(&memcache.ServerList{}, time.Hour, pool.Addr())
+		if err != nil {
+			panic("publisher should be initialized with fallback")
+		}
+		publishers = append(publishers, publisher)
+	}
+	if publishers.Publish(&memcache.Item{Key: "MEMCACHED_HOT_KEYS", Value: []byte("[]")}) != nil {
+		panic("every pool should take the item")
+	}
+	for _, pool := range pools {
+		if value, ok := pool.Value("MEMCACHED_HOT_KEYS"); !ok || string(value) != "[]" {
+			panic("the item should be published to every pool")
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+// ReportSchemaVersion is the version of `HotKeyReport`, it's bumped on every incompatible change of the envelope
+const ReportSchemaVersion = 1
+
+var (
+	// ErrIncompatibleReport is an error when a report has a different schema version or comes from an unexpected reporter
+	ErrIncompatibleReport = errors.New("incompatible hot key report")
+	// ErrStaleReport is an error when a report was generated too long ago
+	ErrStaleReport = errors.New("stale hot key report")
+)
+
+// HotKeyReport is the envelope of the hot keys a `MemcachedHotKeyReporter` writes to memcached
+type HotKeyReport struct {
+	Version   int               `json:"version"`
+	Identity  string            `json:"identity"`
+	Region    string            `json:"region,omitempty"`
+	Zone      string            `json:"zone,omitempty"`
+	Sequence  uint64            `json:"sequence"`
+	Timestamp int64             `json:"timestamp"` // unix milliseconds of the generation
+	Width     int               `json:"width"`
+	TopN      int               `json:"top_n"`
+	Threshold uint64            `json:"threshold"`
+	Total     uint64            `json:"total"`
+	HotKeys   map[string]uint64 `json:"hot_keys"`
+	Summary   *HotKeySummary    `json:"summary,omitempty"`
+	// Stats are the outcomes of the hot keys' fetches, when the reporter proxies them
+	Stats map[string]*KeyStats `json:"stats,omitempty"`
+}
+
+// NewHotKeyReport wraps the `hotKeys` of a roll and its `metadata` in an envelope
+func NewHotKeyReport(identity string, sequence uint64, hotKeys map[string]uint64, metadata WindowsMetadata) *HotKeyReport {
+	return &HotKeyReport{
+		Version:   ReportSchemaVersion,
+		Identity:  identity,
+		Sequence:  sequence,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Width:     metadata.Width,
+		TopN:      metadata.TopN,
+		Threshold: metadata.Threshold,
+		Total:     metadata.Total,
+		HotKeys:   hotKeys,
+		Summary:   metadata.Summary,
+		Stats:     metadata.Stats,
+	}
+}
+
+// Heartbeat tells if the report carries no hot key, and only proves its reporter is alive
+func (report *HotKeyReport) Heartbeat() bool {
+	return len(report.HotKeys) == 0
+}
+
+// Generated is the time when the report was generated
+func (report *HotKeyReport) Generated() time.Time {
+	return time.Unix(0, report.Timestamp*int64(time.Millisecond))
+}
+
+// Validate checks that the report is of the current schema, written by `identity` and no older than `staleness`
+func (report *HotKeyReport) Validate(identity string, now time.Time, staleness time.Duration) error {
+	if report.Version != ReportSchemaVersion || report.Identity != identity || report.Width <= 0 {
+		return ErrIncompatibleReport
+	}
+	if now.Sub(report.Generated()) > staleness {
+		return ErrStaleReport
+	}
+	return nil
+}
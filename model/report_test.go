@@ -0,0 +1,49 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHotKeyReport(t *testing.T) {
+
+	metadata := WindowsMetadata{Width: 10, TopN: 2, Threshold: 1, Total: 3}
+	report := NewHotKeyReport("localhost:11211", 1, map[string]uint64{"some_key": 2}, metadata)
+	if report.Version != ReportSchemaVersion || report.Width != 10 || report.TopN != 2 || report.Total != 3 {
+		panic("report envelope initialized incorrectly")
+	}
+
+	rawBytes, err := json.Marshal(report)
+	if err != nil {
+		panic("report should be marshalled")
+	}
+	unmarshalled := &HotKeyReport{}
+	if err = json.Unmarshal(rawBytes, unmarshalled); err != nil || !reflect.DeepEqual(report, unmarshalled) {
+		panic("report should survive a json round trip")
+	}
+
+	if report.Heartbeat() {
+		panic("report with hot keys is not a heartbeat")
+	}
+	if !NewHotKeyReport("localhost:11211", 2, map[string]uint64{}, metadata).Heartbeat() {
+		panic("report without hot keys is a heartbeat")
+	}
+
+	now := time.Now()
+	if report.Validate("localhost:11211", now, time.Second) != nil {
+		panic("fresh report should be valid")
+	}
+	if report.Validate("otherhost:11211", now, time.Second) != ErrIncompatibleReport {
+		panic("report of another identity should be incompatible")
+	}
+	if report.Validate("localhost:11211", now.Add(2*time.Second), time.Second) != ErrStaleReport {
+		panic("old report should be stale")
+	}
+
+	report.Version = ReportSchemaVersion + 1
+	if report.Validate("localhost:11211", now, time.Second) != ErrIncompatibleReport {
+		panic("report of another schema version should be incompatible")
+	}
+}
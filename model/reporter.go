@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
@@ -12,56 +14,139 @@ import (
 
 // logHotKeyReporter reports to the console
 type logHotKeyReporter struct {
-	rollingWindows RollingWindows
 }
 
 // Report does the reporting
-func (consoleGetKeyCountReporter *logHotKeyReporter) Report(content map[string]uint64) {
-	log.Infof("<report> start: %v\n", time.Now())
+func (consoleGetKeyCountReporter *logHotKeyReporter) Report(content map[string]uint64, metadata WindowsMetadata) {
+	log.Infof("<report> start: %v, total:%d\n", time.Now(), metadata.Total)
 	for k, score := range content {
 		log.Infof("<report> %s:%d\n", k, score)
 	}
 }
 
-// NewlogHotKeyReporter initializes the `ConsoleGetKeyReporter` and the `ticker` at every 1s
-func NewlogHotKeyReporter(rollingWindows RollingWindows) *logHotKeyReporter {
-	reporter := &logHotKeyReporter{
-		rollingWindows: rollingWindows,
-	}
+// NewLoggingHotKeyReporter initializes the `logHotKeyReporter`, which is to be subscribed to a `RollScheduler`
+func NewLoggingHotKeyReporter() HotKeyReporter {
+	return &logHotKeyReporter{}
+}
 
-	ticker := time.NewTicker(1 * time.Second)
-	go func() {
-		// roll & report every 1 second
-		for range ticker.C {
-			reporter.Report(rollingWindows.Roll())
-		}
-	}()
-	return reporter
+// DefaultReportInterval is how often a `MemcachedHotKeyReporter` writes its report
+const DefaultReportInterval = 1 * time.Second
+
+// ReportTTL is the memcached expiration (seconds) of a report written every `interval`,
+// a report outlives 2 missed intervals, and then disappears with its dead reporter
+func ReportTTL(interval time.Duration) int32 {
+	ttl := int32((3*interval + time.Second - 1) / time.Second)
+	if ttl < 2 {
+		return 2
+	}
+	return ttl
 }
 
 // MemcachedHotKeyReporter reports the topN keys to memcached key
 type MemcachedHotKeyReporter struct {
-	identity       string
-	rollingWindows RollingWindows
-	reportKey      string
-	topN           int
-	client         *memcache.Client
+	identity  string
+	region    string
+	zone      string
+	reportKey string
+	topN      int
+	ttl       int32
+	sequence  uint64
+	// reported is the unix nanoseconds of the last report published, or of the start till the first
+	reported  int64
+	codec     *ValueCodec
+	publisher Publisher
+	responder *tputResponder
 }
 
-// Report does the report and uses json
-func (memcachedGetKeyCountReporter *MemcachedHotKeyReporter) Report(updates map[string]uint64) {
+// Report wraps the updates in a `HotKeyReport` envelope and writes it as json with a ttl,
+// when there's no hot key, the envelope is still written as a heartbeat of this reporter
+func (memcachedGetKeyCountReporter *MemcachedHotKeyReporter) Report(updates map[string]uint64, metadata WindowsMetadata) {
 
-	if rawBytes, err := json.Marshal(updates); err == nil {
-		item := &memcache.Item{
-			Key:   fmt.Sprintf("%s:%s", memcachedGetKeyCountReporter.reportKey, memcachedGetKeyCountReporter.identity),
-			Value: rawBytes,
-		}
-		if err = memcachedGetKeyCountReporter.client.Set(item); err != nil {
+	sequence := atomic.AddUint64(&memcachedGetKeyCountReporter.sequence, 1)
+	report := NewHotKeyReport(memcachedGetKeyCountReporter.identity, sequence, updates, metadata)
+	report.Region, report.Zone = memcachedGetKeyCountReporter.region, memcachedGetKeyCountReporter.zone
+	if rawBytes, err := json.Marshal(report); err == nil {
+		key := fmt.Sprintf("%s:%s", memcachedGetKeyCountReporter.reportKey, memcachedGetKeyCountReporter.identity)
+		if err = publishEncoded(memcachedGetKeyCountReporter.publisher, memcachedGetKeyCountReporter.codec, key, rawBytes, memcachedGetKeyCountReporter.ttl); err != nil {
 			log.Warningf("<memcached report:%s> error :%v\n", memcachedGetKeyCountReporter.identity, err)
 		} else {
-			log.Infof("<memcached report:%s> done :%v\n", memcachedGetKeyCountReporter.identity, updates)
+			atomic.StoreInt64(&memcachedGetKeyCountReporter.reported, time.Now().UnixNano())
+			if report.Heartbeat() {
+				log.Infof("<memcached report:%s> heartbeat :%d\n", memcachedGetKeyCountReporter.identity, sequence)
+			} else {
+				log.Infof("<memcached report:%s> done :%v\n", memcachedGetKeyCountReporter.identity, updates)
+			}
 		}
 	}
+	if responder := memcachedGetKeyCountReporter.responder; responder != nil {
+		responder.remember(sequence, metadata.Scores)
+		responder.respond(memcachedGetKeyCountReporter)
+	}
+}
+
+// Healthy tells if the reporter published a report within the ttl of its reports, a reporter is given the ttl to publish its first
+func (memcachedGetKeyCountReporter *MemcachedHotKeyReporter) Healthy() bool {
+	reported := atomic.LoadInt64(&memcachedGetKeyCountReporter.reported)
+	return time.Since(time.Unix(0, reported)) < time.Duration(memcachedGetKeyCountReporter.ttl)*time.Second
+}
+
+// Label places the reporter in the `zone` of the `region`, a labeled reporter answers the exact rounds of its zone leader
+func (memcachedGetKeyCountReporter *MemcachedHotKeyReporter) Label(region string, zone string) {
+	memcachedGetKeyCountReporter.region, memcachedGetKeyCountReporter.zone = region, zone
+}
+
+// exactKey is the key the exact rounds of the reporter's zone leader are written under, or of the flat leader if it's not labeled
+func (memcachedGetKeyCountReporter *MemcachedHotKeyReporter) exactKey() string {
+	if memcachedGetKeyCountReporter.region == "" {
+		return memcachedGetKeyCountReporter.reportKey
+	}
+	return ScopeKey(memcachedGetKeyCountReporter.reportKey, ZoneScope(memcachedGetKeyCountReporter.region, memcachedGetKeyCountReporter.zone))
+}
+
+// EnableExact makes the reporter keep the scores of its last `history` rolls, and answer the aggregator's exact rounds,
+// the rolling windows must retain their scores, and it must be enabled before the reporter is subscribed
+func (memcachedGetKeyCountReporter *MemcachedHotKeyReporter) EnableExact(client *memcache.Client, history int) {
+	memcachedGetKeyCountReporter.responder = &tputResponder{
+		m:           sync.Mutex{},
+		client:      client,
+		history:     map[uint64]map[string]uint64{},
+		historySize: history,
+	}
+}
+
+// publishEncoded encodes the value and publishes its items in order, it stops at the first failure
+// so that a manifest is never published without all of its chunks
+func publishEncoded(publisher Publisher, codec *ValueCodec, key string, value []byte, expiration int32) error {
+	items, err := codec.Encode(key, value, expiration)
+	if err != nil {
+		return err
+	}
+	return publishItems(publisher, items)
+}
+
+// publishView publishes a value which never expires but is republished every `interval`, e.g. the aggregated view,
+// every publish writes a new generation of chunks, so they expire a few intervals later instead of piling up in the slab
+func publishView(publisher Publisher, codec *ValueCodec, key string, value []byte, interval time.Duration) error {
+	items, err := codec.Encode(key, value, 0)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range items[:len(items)-1] {
+		chunk.Expiration = ReportTTL(interval)
+	}
+	return publishItems(publisher, items)
+}
+
+func publishItems(publisher Publisher, items []*memcache.Item) error {
+	if itemsPublisher, ok := publisher.(ItemsPublisher); ok {
+		return itemsPublisher.PublishItems(items)
+	}
+	for _, item := range items {
+		if err := publisher.Publish(item); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // ReporterIdentity is the default identity string of a reporter constructed from hostname and port
@@ -72,24 +157,17 @@ func ReporterIdentity(host string, port int) string {
 	return fmt.Sprintf("%s:%d", host, port)
 }
 
-// NewMemcachedHotKeyReporter initializes the `MemcachedGetKeyCountReporter` using the given `memcached` hosts list
-func NewMemcachedHotKeyReporter(rollingWindows RollingWindows, identity string, reportKey string, topN int, registry McrouterRegistry) *MemcachedHotKeyReporter {
+// NewMemcachedHotKeyReporter initializes the `MemcachedGetKeyCountReporter` using the given `publisher`,
+// its reports expire after 2 missed `interval`s, which is the interval it's subscribed to a `RollScheduler`
+func NewMemcachedHotKeyReporter(identity string, reportKey string, topN int, interval time.Duration, codec *ValueCodec, publisher Publisher) *MemcachedHotKeyReporter {
 
-	reporter := &MemcachedHotKeyReporter{
-		identity:       identity,
-		rollingWindows: rollingWindows,
-		reportKey:      reportKey,
-		topN:           topN,
-		client:         memcache.NewFromSelector(registry),
+	return &MemcachedHotKeyReporter{
+		identity:  identity,
+		reportKey: reportKey,
+		topN:      topN,
+		ttl:       ReportTTL(interval),
+		reported:  time.Now().UnixNano(),
+		codec:     codec,
+		publisher: publisher,
 	}
-
-	ticker := time.NewTicker(1 * time.Second)
-	go func() {
-		// roll & report every 1 second
-		for range ticker.C {
-			log.Infof("<memcached report> start:%v\n", time.Now())
-			reporter.Report(rollingWindows.Roll())
-		}
-	}()
-	return reporter
 }
@@ -12,12 +12,17 @@ func TestConsoleReporter(t *testing.T) {
 	rollingWindows := NewSimpleRollingWindows(scorer, func() GetKeyCounter {
 		return NewBucketGetKeyCounter(1)
 	}, 4, 2, 1)
-	reporter := NewLoggingHotKeyReporter(rollingWindows)
+	reporter := NewLoggingHotKeyReporter()
 
-	if reporter == nil || reporter.rollingWindows == nil {
+	if reporter == nil {
 		panic("reporter not initialized correctly")
 	}
 
+	scheduler := NewRollScheduler(rollingWindows, RollInterval)
+	scheduler.Subscribe(reporter, RollInterval)
+	scheduler.Start()
+	defer scheduler.Stop()
+
 	for tick := 0; tick < 3; tick++ {
 		rollingWindows.Increment("some_key", uint64(1))
 		rollingWindows.Increment("some_key", uint64(1))
@@ -25,3 +30,16 @@ func TestConsoleReporter(t *testing.T) {
 		time.Sleep(1 * time.Second)
 	}
 }
+
+func TestReportTTL(t *testing.T) {
+
+	if ReportTTL(1*time.Second) != 3 {
+		panic("report should outlive 2 missed intervals")
+	}
+	if ReportTTL(100*time.Millisecond) != 2 {
+		panic("report ttl should be at least 2 seconds")
+	}
+	if ReportTTL(1500*time.Millisecond) != 5 {
+		panic("report ttl should round up to seconds")
+	}
+}
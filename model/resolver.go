@@ -0,0 +1,314 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	// ErrParseCIDRRule is an error when a cidr rule isn't `<cidr>=<port>[,<port>...]`
+	ErrParseCIDRRule = errors.New("cidr rule parse error")
+	// ErrParseMcrouterMapping is an error when a line of a mapping file isn't `<remote ip> <mcrouter address>[,<mcrouter address>...]`
+	ErrParseMcrouterMapping = errors.New("mcrouter mapping parse error")
+)
+
+// remoteHost is the host of a connection's `remote` address
+func remoteHost(remote string) (string, error) {
+	host, port, err := net.SplitHostPort(remote)
+	if err != nil {
+		return "", ErrParseMcrouter
+	}
+	if _, err = strconv.Atoi(port); err != nil {
+		return "", ErrParseMcrouter
+	}
+	return host, nil
+}
+
+func hostPorts(host string, ports []int) []string {
+	candidates := make([]string, 0, len(ports))
+	for _, port := range ports {
+		candidates = append(candidates, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return candidates
+}
+
+func parsePorts(ports string) ([]int, error) {
+	parsed := []int{}
+	for _, port := range strings.Split(ports, ",") {
+		if port = strings.TrimSpace(port); port == "" {
+			continue
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// PortResolver assumes the mcrouter listens at the same known port on the host it connects from
+type PortResolver struct {
+	port int
+}
+
+// Resolve gives the remote host at the known port
+func (portResolver *PortResolver) Resolve(remote string) ([]string, error) {
+	host, err := remoteHost(remote)
+	if err != nil {
+		return nil, err
+	}
+	return hostPorts(host, []int{portResolver.port}), nil
+}
+
+// NewPortResolver initializes a `PortResolver` of the known mcrouter `port`
+func NewPortResolver(port int) *PortResolver {
+	return &PortResolver{port: port}
+}
+
+// CIDRRule maps the remote hosts in a network to the ports their mcrouters listen at
+type CIDRRule struct {
+	Network *net.IPNet
+	Ports   []int
+}
+
+// CIDRResolver resolves by the first rule whose network contains the remote host
+type CIDRResolver struct {
+	rules []CIDRRule
+}
+
+// Resolve gives the remote host at the ports of the first matching rule
+func (cidrResolver *CIDRResolver) Resolve(remote string) ([]string, error) {
+	host, err := remoteHost(remote)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, nil
+	}
+	for _, rule := range cidrResolver.rules {
+		if rule.Network.Contains(ip) {
+			return hostPorts(host, rule.Ports), nil
+		}
+	}
+	return nil, nil
+}
+
+// ParseCIDRRules parses rules like `10.0.0.0/8=5000,5001;192.168.0.0/16=8989`, the first matching rule wins
+func ParseCIDRRules(rules string) ([]CIDRRule, error) {
+	parsed := []CIDRRule{}
+	for _, rule := range strings.Split(rules, ";") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, ErrParseCIDRRule
+		}
+		_, network, err := net.ParseCIDR(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, ErrParseCIDRRule
+		}
+		ports, err := parsePorts(parts[1])
+		if err != nil || len(ports) == 0 {
+			return nil, ErrParseCIDRRule
+		}
+		parsed = append(parsed, CIDRRule{Network: network, Ports: ports})
+	}
+	return parsed, nil
+}
+
+// NewCIDRResolver initializes a `CIDRResolver` of the `rules`
+func NewCIDRResolver(rules []CIDRRule) *CIDRResolver {
+	return &CIDRResolver{rules: rules}
+}
+
+// FileResolver resolves by an explicit mapping file, one `<remote ip> <mcrouter address>[,<mcrouter address>...]` per line,
+// e.g. the address a NAT rewrites a mcrouter to, blank lines and `#` comments are ignored, and the file is reloaded whenever it changes
+type FileResolver struct {
+	m        sync.RWMutex
+	path     string
+	modified time.Time
+	mapping  map[string][]string
+}
+
+// Resolve gives the mcrouter addresses the remote host is mapped to
+func (fileResolver *FileResolver) Resolve(remote string) ([]string, error) {
+	host, err := remoteHost(remote)
+	if err != nil {
+		return nil, err
+	}
+	if err := fileResolver.reload(); err != nil {
+		log.Errorf("<discovery> unable to reload mcrouter mapping from %s: %v", fileResolver.path, err)
+	}
+	fileResolver.m.RLock()
+	defer fileResolver.m.RUnlock()
+	return fileResolver.mapping[host], nil
+}
+
+func (fileResolver *FileResolver) reload() error {
+	info, err := os.Stat(fileResolver.path)
+	if err != nil {
+		return err
+	}
+	fileResolver.m.RLock()
+	unchanged := info.ModTime().Equal(fileResolver.modified)
+	fileResolver.m.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(fileResolver.path)
+	if err != nil {
+		return err
+	}
+	mapping := map[string][]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || net.ParseIP(fields[0]) == nil {
+			return ErrParseMcrouterMapping
+		}
+		for _, address := range strings.Split(fields[1], ",") {
+			if _, err := remoteHost(address); err != nil {
+				return ErrParseMcrouterMapping
+			}
+			mapping[fields[0]] = append(mapping[fields[0]], address)
+		}
+	}
+
+	fileResolver.m.Lock()
+	defer fileResolver.m.Unlock()
+	fileResolver.modified = info.ModTime()
+	fileResolver.mapping = mapping
+	log.Infof("<discovery> reloaded %d mcrouter mappings from %s\n", len(mapping), fileResolver.path)
+	return nil
+}
+
+// NewFileResolver initializes a `FileResolver` of the mapping file at `path`
+func NewFileResolver(path string) (*FileResolver, error) {
+	fileResolver := &FileResolver{
+		m:       sync.RWMutex{},
+		path:    path,
+		mapping: map[string][]string{},
+	}
+	return fileResolver, fileResolver.reload()
+}
+
+// AdminResolver asks the remote host's mcrouter for the ports it listens at, with the `get __mcrouter__.options` admin command
+// sent to any of the admin ports the mcrouters are known to answer at
+type AdminResolver struct {
+	ports   []int
+	timeout time.Duration
+}
+
+// Resolve gives the remote host at the `ports` (or `port`) option of the first mcrouter answering the admin command
+func (adminResolver *AdminResolver) Resolve(remote string) ([]string, error) {
+	host, err := remoteHost(remote)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, admin := range hostPorts(host, adminResolver.ports) {
+		options, err := mcrouterOptions(admin, adminResolver.timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, option := range []string{"ports", "port"} {
+			if ports, err := parsePorts(options[option]); err == nil && len(ports) > 0 {
+				return hostPorts(host, ports), nil
+			}
+		}
+		lastErr = fmt.Errorf("%s lists no listening ports", admin)
+	}
+	return nil, lastErr
+}
+
+// mcrouterOptions gets the `name value` lines of the `__mcrouter__.options` admin command
+func mcrouterOptions(address string, timeout time.Duration) (map[string]string, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write([]byte("get __mcrouter__.options\r\n")); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	// VALUE __mcrouter__.options 0 <bytes>
+	fields := strings.Fields(header)
+	if len(fields) != 4 || fields[0] != "VALUE" {
+		return nil, fmt.Errorf("%s doesn't answer the admin command: %q", address, strings.TrimSpace(header))
+	}
+	size, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, size)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	options := map[string]string{}
+	for _, line := range strings.Split(string(body), "\n") {
+		if parts := strings.Fields(line); len(parts) == 2 {
+			options[parts[0]] = parts[1]
+		}
+	}
+	return options, nil
+}
+
+// NewAdminResolver initializes an `AdminResolver` of the admin `ports`, each of which is given up after `timeout`
+func NewAdminResolver(ports []int, timeout time.Duration) *AdminResolver {
+	return &AdminResolver{ports: ports, timeout: timeout}
+}
+
+// ResolverChain gives the candidates of all its resolvers in order, the registry registers the first one which is a mcrouter
+type ResolverChain []McrouterResolver
+
+// Resolve gives the deduplicated candidates of every resolver, a resolver's error is given only if no candidate is found
+func (resolverChain ResolverChain) Resolve(remote string) ([]string, error) {
+	candidates, seen := []string{}, map[string]bool{}
+	var lastErr error
+	for _, resolver := range resolverChain {
+		resolved, err := resolver.Resolve(remote)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, candidate := range resolved {
+			if !seen[candidate] {
+				seen[candidate] = true
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, lastErr
+	}
+	return candidates, nil
+}
@@ -0,0 +1,113 @@
+package model
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeMcrouterAdmin answers `version` as a mcrouter, and the admin command with the listening `ports` option
+func fakeMcrouterAdmin(ports string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("cannot start fake mcrouter")
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				command, _ := bufio.NewReader(conn).ReadString('\n')
+				if strings.HasPrefix(command, "get __mcrouter__.options") {
+					body := fmt.Sprintf("num_proxies 1\nports %s\nssl_ports 0", ports)
+					fmt.Fprintf(conn, "VALUE __mcrouter__.options 0 %d\r\n%s\r\nEND\r\n", len(body), body)
+				} else {
+					conn.Write([]byte("VERSION 36.0.0-master mcrouter\r\n"))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestCIDRResolver(t *testing.T) {
+
+	if _, err := ParseCIDRRules("10.0.0.0/8"); err != ErrParseCIDRRule {
+		panic("a cidr rule should have ports")
+	}
+	rules, err := ParseCIDRRules("10.1.0.0/16=5000,5001; 10.0.0.0/8=8989")
+	if err != nil || len(rules) != 2 {
+		panic("cidr rules should be parsed")
+	}
+	resolver := NewCIDRResolver(rules)
+	if candidates, _ := resolver.Resolve("10.1.2.3:41234"); !reflect.DeepEqual(candidates, []string{"10.1.2.3:5000", "10.1.2.3:5001"}) {
+		panic("the first matching rule should resolve the ports")
+	}
+	if candidates, _ := resolver.Resolve("10.2.2.3:41234"); !reflect.DeepEqual(candidates, []string{"10.2.2.3:8989"}) {
+		panic("a broader rule should resolve the rest of the network")
+	}
+	if candidates, err := resolver.Resolve("192.168.1.1:41234"); err != nil || len(candidates) != 0 {
+		panic("a remote out of every network should have no candidate")
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "mcrouters")
+	if err != nil {
+		panic("cannot create the mapping file")
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# nat\n10.0.0.1 172.16.0.1:5000,172.16.0.1:5001\n\n")
+	file.Close()
+
+	resolver, err := NewFileResolver(file.Name())
+	if err != nil {
+		panic("mapping file should be loaded")
+	}
+	if candidates, _ := resolver.Resolve("10.0.0.1:41234"); !reflect.DeepEqual(candidates, []string{"172.16.0.1:5000", "172.16.0.1:5001"}) {
+		panic("a mapped remote should resolve to its mcrouters")
+	}
+	if candidates, _ := resolver.Resolve("10.0.0.2:41234"); len(candidates) != 0 {
+		panic("an unmapped remote should have no candidate")
+	}
+}
+
+func TestAdminResolverRegistry(t *testing.T) {
+
+	listening := fakeMcrouterAdmin("")
+	defer listening.Close()
+	port := listening.Addr().(*net.TCPAddr).Port
+	admin := fakeMcrouterAdmin(fmt.Sprintf("%d", port))
+	defer admin.Close()
+	adminPort := admin.Addr().(*net.TCPAddr).Port
+
+	resolver := NewAdminResolver([]int{adminPort}, time.Second)
+	if candidates, err := resolver.Resolve("127.0.0.1:41234"); err != nil || !reflect.DeepEqual(candidates, []string{fmt.Sprintf("127.0.0.1:%d", port)}) {
+		panic("the admin command should tell the listening ports")
+	}
+
+	// a static port nobody listens at is rejected before the port the admin command tells
+	registry := NewResolvedMcrouterRegistry(ResolverChain{NewPortResolver(1), resolver})
+	if registry.Register("127.0.0.1:41234") != nil {
+		panic("the mcrouter should be registered at the port the admin command tells")
+	}
+	if members := registry.Members(); len(members) != 1 || members[0].Address != fmt.Sprintf("127.0.0.1:%d", port) {
+		panic("the registered member should be the resolved address")
+	}
+	if rejections := registry.Rejections(); len(rejections) != 1 || rejections[0].Candidate != "127.0.0.1:1" || rejections[0].Reason == "" {
+		panic("the rejected candidate should be reported with the reason")
+	}
+	if registry.Register("not an address") == nil || registry.Rejections()[1].Candidate != "" {
+		panic("an unresolved remote should be rejected without a candidate")
+	}
+}
@@ -0,0 +1,128 @@
+package model
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// RollInterval is the width of each window of `RollingWindows`, so as how often they roll
+const RollInterval = 1 * time.Second
+
+// rolled is the outcome of a single `Roll`, shared readonly by all reporters
+type rolled struct {
+	hotKeys  map[string]uint64
+	metadata WindowsMetadata
+}
+
+// subscription delivers the rolls due at its `interval` to a reporter, only the latest roll is kept if the reporter lags
+type subscription struct {
+	reporter HotKeyReporter
+	interval time.Duration
+	pending  chan *rolled
+}
+
+func (sub *subscription) offer(r *rolled) {
+	for {
+		select {
+		case sub.pending <- r:
+			return
+		default:
+			// drop the roll the reporter hasn't picked up yet, the newer one supersedes it
+			select {
+			case <-sub.pending:
+			default:
+			}
+		}
+	}
+}
+
+func (sub *subscription) run() {
+	for r := range sub.pending {
+		sub.reporter.Report(r.hotKeys, r.metadata)
+	}
+}
+
+// RollScheduler is the single owner of `RollingWindows.Roll`, it rolls at every wall clock aligned `interval`
+// and fans the result out to any number of `HotKeyReporter`s, each at its own report interval
+type RollScheduler struct {
+	m              sync.Mutex
+	rollingWindows RollingWindows
+	interval       time.Duration
+	subscriptions  []*subscription
+	stop           chan struct{}
+}
+
+// Subscribe adds a reporter which gets reported every `interval`, the interval is rounded to the multiples of the roll interval
+func (rollScheduler *RollScheduler) Subscribe(reporter HotKeyReporter, interval time.Duration) {
+	rollScheduler.m.Lock()
+	defer rollScheduler.m.Unlock()
+
+	if interval < rollScheduler.interval {
+		interval = rollScheduler.interval
+	}
+	sub := &subscription{
+		reporter: reporter,
+		interval: interval.Round(rollScheduler.interval),
+		pending:  make(chan *rolled, 1),
+	}
+	rollScheduler.subscriptions = append(rollScheduler.subscriptions, sub)
+	go sub.run()
+}
+
+// Start rolls at the next wall clock boundary of the interval, and every interval after
+func (rollScheduler *RollScheduler) Start() {
+	go func() {
+		boundary := time.Now().Truncate(rollScheduler.interval)
+		for {
+			boundary = boundary.Add(rollScheduler.interval)
+			timer := time.NewTimer(time.Until(boundary))
+			select {
+			case <-rollScheduler.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			rollScheduler.roll(boundary)
+			if now := time.Now(); now.Sub(boundary) > rollScheduler.interval {
+				// fell behind for more than a roll, catch up with the wall clock instead of rolling in a burst
+				log.Warningf("<scheduler> roll at %v is late by %v\n", boundary, now.Sub(boundary))
+				boundary = now.Truncate(rollScheduler.interval)
+			}
+		}
+	}()
+}
+
+// Stop stops rolling, the reporters are left with the rolls they've got
+func (rollScheduler *RollScheduler) Stop() {
+	close(rollScheduler.stop)
+}
+
+func (rollScheduler *RollScheduler) roll(boundary time.Time) {
+	rollScheduler.m.Lock()
+	defer rollScheduler.m.Unlock()
+
+	// metadata must be read right after the roll it describes, under the same lock
+	r := &rolled{
+		hotKeys:  rollScheduler.rollingWindows.Roll(),
+		metadata: rollScheduler.rollingWindows.Metadata(),
+	}
+	for _, sub := range rollScheduler.subscriptions {
+		// reports of the same interval are due at the same wall clock seconds on every host
+		if boundary.UnixNano()%int64(sub.interval) == 0 {
+			sub.offer(r)
+		}
+	}
+}
+
+// NewRollScheduler initializes a `RollScheduler` of the `rollingWindows`, which rolls every `interval`
+func NewRollScheduler(rollingWindows RollingWindows, interval time.Duration) *RollScheduler {
+	return &RollScheduler{
+		m:              sync.Mutex{},
+		rollingWindows: rollingWindows,
+		interval:       interval,
+		subscriptions:  []*subscription{},
+		stop:           make(chan struct{}),
+	}
+}
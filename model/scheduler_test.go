@@ -0,0 +1,76 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+type recordingHotKeyReporter struct {
+	reports chan WindowsMetadata
+}
+
+func (recordingHotKeyReporter *recordingHotKeyReporter) Report(hotKeys map[string]uint64, metadata WindowsMetadata) {
+	recordingHotKeyReporter.reports <- metadata
+}
+
+type timingHotKeyReporter struct {
+	reported chan time.Time
+}
+
+func (timingHotKeyReporter *timingHotKeyReporter) Report(hotKeys map[string]uint64, metadata WindowsMetadata) {
+	timingHotKeyReporter.reported <- time.Now()
+}
+
+func TestRollScheduler(t *testing.T) {
+
+	scorer := &dumbKeyScorer{}
+
+	rollingWindows := NewSimpleRollingWindows(scorer, func() GetKeyCounter {
+		return NewBucketGetKeyCounter(1)
+	}, 4, 2, 1)
+
+	interval := 50 * time.Millisecond
+	scheduler := NewRollScheduler(rollingWindows, interval)
+	everyRoll := &recordingHotKeyReporter{reports: make(chan WindowsMetadata, 100)}
+	everyOtherRoll := &recordingHotKeyReporter{reports: make(chan WindowsMetadata, 100)}
+	scheduler.Subscribe(everyRoll, interval)
+	scheduler.Subscribe(everyOtherRoll, 2*interval)
+	scheduler.Start()
+
+	rollingWindows.Increment("some_key", uint64(1))
+	time.Sleep(10*interval + interval/2)
+	scheduler.Stop()
+	time.Sleep(interval)
+
+	rolls, others := len(everyRoll.reports), len(everyOtherRoll.reports)
+	if rolls < 8 || rolls > 11 {
+		panic("reporter should be reported at every roll")
+	}
+	if others < rolls/2-1 || others > rolls/2+1 {
+		panic("reporter should be reported at every other roll")
+	}
+	if metadata := <-everyRoll.reports; metadata.Width != 4 || metadata.TopN != 2 {
+		panic("reporter should be reported with the metadata of the roll")
+	}
+}
+
+func TestRollSchedulerAlignment(t *testing.T) {
+
+	scorer := &dumbKeyScorer{}
+
+	rollingWindows := NewSimpleRollingWindows(scorer, func() GetKeyCounter {
+		return NewBucketGetKeyCounter(1)
+	}, 4, 2, 1)
+
+	interval := 100 * time.Millisecond
+	scheduler := NewRollScheduler(rollingWindows, interval)
+	reported := make(chan time.Time, 10)
+	scheduler.Subscribe(&timingHotKeyReporter{reported: reported}, interval)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	at := <-reported
+	if offset := at.Sub(at.Truncate(interval)); offset > interval/2 {
+		panic("rolls should be aligned to the wall clock boundaries")
+	}
+}
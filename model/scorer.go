@@ -74,9 +74,10 @@ func NewSimpleKeyScorer(minBytes uint64, sweepInterval time.Duration) *SimpleKey
 		minBytes: minBytes,
 		trie:     trie.NewRuneTrie(),
 	}
+	// ask the sweeper to scatter at different time, the delay is drawn here as the random source isn't safe for the sweepers to share
+	delay := time.Duration(randomDelay.Int63n(int64(sweepInterval)))
 	go func() {
-		// ask the sweeper to scatter at different time
-		time.Sleep(time.Duration(randomDelay.Int63n(int64(sweepInterval))))
+		time.Sleep(delay)
 		ticker := time.NewTicker(sweepInterval)
 		for range ticker.C {
 			expired := scorer.sweep()
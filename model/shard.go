@@ -0,0 +1,92 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	log "github.com/golang/glog"
+)
+
+// OverloadFactor is how many times its fair share of the hot keys' score makes a server overloaded
+const OverloadFactor = 2.0
+
+// ServerLoad is how much of the hot keys' score of its pool a memcached server takes
+type ServerLoad struct {
+	Pool    string   `json:"pool"`
+	Server  string   `json:"server"`
+	Score   uint64   `json:"score"`
+	HotKeys []string `json:"hot_keys"`
+	// Share is the server's part of the score of its pool's hot keys
+	Share float64 `json:"share"`
+	// Overloaded servers take more than `OverloadFactor` times their fair share
+	Overloaded bool `json:"overloaded"`
+}
+
+// ServerLoadKey is where the load of the servers of the view published at `key` is
+func ServerLoadKey(key string) string {
+	return fmt.Sprintf("%s:servers", key)
+}
+
+// AttributeShards annotates every entry with its pool and server
+func AttributeShards(entries HotKeyEntries, shards ShardAttributor) {
+	for _, entry := range entries {
+		if pool, server, ok := shards.Attribute(entry.Key); ok {
+			entry.Pool, entry.Server = pool, server
+		}
+	}
+}
+
+// ServerLoads gives the load of every server taking annotated hot keys, from the highest to the lowest score
+func ServerLoads(entries HotKeyEntries, shards ShardAttributor) []*ServerLoad {
+	loads := map[string]*ServerLoad{}
+	totals := map[string]uint64{}
+	for _, entry := range entries {
+		if entry.Server == "" {
+			continue
+		}
+		id := entry.Pool + "/" + entry.Server
+		load, ok := loads[id]
+		if !ok {
+			load = &ServerLoad{Pool: entry.Pool, Server: entry.Server, HotKeys: []string{}}
+			loads[id] = load
+		}
+		load.Score += entry.Score
+		load.HotKeys = append(load.HotKeys, entry.Key)
+		totals[entry.Pool] += entry.Score
+	}
+
+	servers := shards.Servers()
+	sorted := make([]*ServerLoad, 0, len(loads))
+	for _, load := range loads {
+		if total := totals[load.Pool]; total > 0 {
+			load.Share = float64(load.Score) / float64(total)
+		}
+		if n := servers[load.Pool]; n > 1 {
+			load.Overloaded = load.Share > OverloadFactor/float64(n)
+		}
+		sorted = append(sorted, load)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Score != sorted[j].Score {
+			return sorted[i].Score > sorted[j].Score
+		}
+		return sorted[i].Pool+sorted[i].Server < sorted[j].Pool+sorted[j].Server
+	})
+	return sorted
+}
+
+// publishServerLoads publishes the load of the servers the hot keys published at `key` are attributed to, and warns of the overloaded ones
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) publishServerLoads(key string, entries HotKeyEntries) error {
+	loads := ServerLoads(entries, memcachedHotKeyAggregator.options.Shards)
+	for _, load := range loads {
+		if load.Overloaded {
+			log.Warningf("<memcached aggregator> %s of pool %s is overloaded by %d hot keys, share:%.2f\n", load.Server, load.Pool, len(load.HotKeys), load.Share)
+		}
+	}
+	rawBytes, err := json.Marshal(loads)
+	if err != nil {
+		return err
+	}
+	return publishView(memcachedHotKeyAggregator.publisher, memcachedHotKeyAggregator.codec, ServerLoadKey(key), rawBytes, memcachedHotKeyAggregator.options.Interval)
+}
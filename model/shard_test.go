@@ -0,0 +1,33 @@
+package model
+
+import (
+	"testing"
+)
+
+type fakeShards map[string]string
+
+func (shards fakeShards) Attribute(key string) (string, string, bool) {
+	server, ok := shards[key]
+	return "main", server, ok
+}
+
+func (shards fakeShards) Servers() map[string]int {
+	return map[string]int{"main": 4}
+}
+
+func TestServerLoads(t *testing.T) {
+
+	shards := fakeShards{"a": "m1", "b": "m1", "c": "m2"}
+	entries := HotKeyEntries{{Key: "a", Score: 60}, {Key: "b", Score: 30}, {Key: "c", Score: 10}, {Key: "unknown", Score: 5}}
+	AttributeShards(entries, shards)
+	if entries[0].Server != "m1" || entries[0].Pool != "main" || entries[3].Server != "" {
+		panic("every known key should be annotated with its server")
+	}
+	loads := ServerLoads(entries, shards)
+	if len(loads) != 2 || loads[0].Server != "m1" || loads[0].Score != 90 || len(loads[0].HotKeys) != 2 {
+		panic("the load of a server should sum up its hot keys")
+	}
+	if !loads[0].Overloaded || loads[1].Overloaded || loads[1].Share != 0.1 {
+		panic("a server taking beyond twice its fair share should be overloaded")
+	}
+}
@@ -0,0 +1,142 @@
+package model
+
+import (
+	"container/heap"
+)
+
+// SummaryCounter is the estimated score of a key in a `HotKeySummary`,
+// the `Count` overestimates the real score by no more than its `Error`
+type SummaryCounter struct {
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// HotKeySummary is a mergeable Space-Saving summary of the scores of a reporter's windows,
+// it keeps at most `Capacity` counters, and any key without a counter scores no more than `Floor`,
+// merging summaries of `m` reporters bounds the error of each key by the sum of their floors
+type HotKeySummary struct {
+	Capacity int                       `json:"capacity"`
+	Floor    uint64                    `json:"floor"`
+	Counters map[string]SummaryCounter `json:"counters"`
+}
+
+// NewHotKeySummary summarizes the exact `scores` of all keys into at most `capacity` counters
+func NewHotKeySummary(capacity int, scores map[string]uint64) *HotKeySummary {
+	summary := &HotKeySummary{
+		Capacity: capacity,
+		Counters: make(map[string]SummaryCounter, len(scores)),
+	}
+	for key, score := range scores {
+		summary.Counters[key] = SummaryCounter{Count: score}
+	}
+	summary.prune()
+	return summary
+}
+
+// estimate gives the counter of the key, keys without a counter are estimated at the floor
+func (summary *HotKeySummary) estimate(key string) SummaryCounter {
+	if counter, ok := summary.Counters[key]; ok {
+		return counter
+	}
+	return SummaryCounter{Count: summary.Floor, Error: summary.Floor}
+}
+
+// Merge adds the `other` summary, for every key it adds up the estimates of both summaries
+func (summary *HotKeySummary) Merge(other *HotKeySummary) {
+	merged := make(map[string]SummaryCounter, len(summary.Counters)+len(other.Counters))
+	for key := range summary.Counters {
+		merged[key] = SummaryCounter{}
+	}
+	for key := range other.Counters {
+		merged[key] = SummaryCounter{}
+	}
+	for key := range merged {
+		mine, theirs := summary.estimate(key), other.estimate(key)
+		merged[key] = SummaryCounter{Count: mine.Count + theirs.Count, Error: mine.Error + theirs.Error}
+	}
+	summary.Counters = merged
+	summary.Floor += other.Floor
+	if other.Capacity > summary.Capacity {
+		summary.Capacity = other.Capacity
+	}
+	summary.prune()
+}
+
+// prune keeps the `Capacity` highest counters, the floor rises to the highest pruned count
+func (summary *HotKeySummary) prune() {
+	if len(summary.Counters) <= summary.Capacity {
+		return
+	}
+	entries := summary.entries()
+	heap.Init(&entries)
+	for t := 0; t < summary.Capacity; t++ {
+		heap.Pop(&entries)
+	}
+	for _, pruned := range entries {
+		if pruned.Score > summary.Floor {
+			summary.Floor = pruned.Score
+		}
+		delete(summary.Counters, pruned.Key)
+	}
+}
+
+func (summary *HotKeySummary) entries() HotKeyEntries {
+	entries := make(HotKeyEntries, 0, len(summary.Counters))
+	for key, counter := range summary.Counters {
+		entries = append(entries, &HotKeyEntry{Key: key, Score: counter.Count, Error: counter.Error})
+	}
+	return entries
+}
+
+// Top gives the `n` highest estimated keys, from the highest to the lowest
+func (summary *HotKeySummary) Top(n int) HotKeyEntries {
+	entries := summary.entries()
+	heap.Init(&entries)
+	cutN := HotKeyEntries(make([]*HotKeyEntry, 0, n))
+	for t := 0; t < n && entries.Len() > 0; t++ {
+		if top, ok := heap.Pop(&entries).(*HotKeyEntry); ok {
+			cutN = append(cutN, top)
+		}
+	}
+	return cutN
+}
+
+// SummaryOf gives the summary a report carries, or summarizes its hot keys when it carries none,
+// a full report's lowest hot key bounds the keys it left out, otherwise the floor is unknown and taken as 0
+func SummaryOf(report *HotKeyReport) *HotKeySummary {
+	if report.Summary != nil {
+		return report.Summary
+	}
+	summary := NewHotKeySummary(len(report.HotKeys), report.HotKeys)
+	if len(report.HotKeys) >= report.TopN {
+		for _, score := range report.HotKeys {
+			if summary.Floor == 0 || score < summary.Floor {
+				summary.Floor = score
+			}
+		}
+	}
+	return summary
+}
+
+// MergeSummaries merges the summaries of the reporters, and gives the `n` highest keys attributed to the reporters that counted them
+func MergeSummaries(summaries map[string]*HotKeySummary, n int) HotKeyEntries {
+	// the global summary keeps every counter, pruning here would only add errors on top of the reporters'
+	capacity := 0
+	for _, summary := range summaries {
+		capacity += summary.Capacity
+	}
+	global := &HotKeySummary{Capacity: capacity, Counters: map[string]SummaryCounter{}}
+	for _, summary := range summaries {
+		global.Merge(summary)
+	}
+	top := global.Top(n)
+	for _, entry := range top {
+		entry.Reporters = map[string]uint64{}
+		for identity, summary := range summaries {
+			if counter, ok := summary.Counters[entry.Key]; ok {
+				entry.Reporters[identity] = counter.Count
+			}
+		}
+	}
+	return top
+}
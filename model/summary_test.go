@@ -0,0 +1,61 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestHotKeySummary(t *testing.T) {
+
+	summary := NewHotKeySummary(2, map[string]uint64{"a": 10, "b": 8, "c": 5, "d": 1})
+	if len(summary.Counters) != 2 || summary.Floor != 5 {
+		panic("summary should keep the capacity highest counters and floor at the highest pruned")
+	}
+	if summary.Counters["a"].Count != 10 || summary.Counters["a"].Error != 0 {
+		panic("summary of exact scores should have no error")
+	}
+}
+
+func TestMergeSummaries(t *testing.T) {
+
+	// `everywhere` ranks 3rd on every host, a top 2 of each host never sees it
+	summaries := map[string]*HotKeySummary{}
+	for _, identity := range []string{"host1:11211", "host2:11211", "host3:11211"} {
+		summaries[identity] = NewHotKeySummary(3, map[string]uint64{
+			identity + ":a": 100,
+			identity + ":b": 90,
+			"everywhere":    80,
+			identity + ":c": 1,
+		})
+	}
+
+	top := MergeSummaries(summaries, 1)
+	if len(top) != 1 || top[0].Key != "everywhere" || top[0].Score != 240 || top[0].Error != 0 {
+		panic("merged summaries should find the global top key")
+	}
+	if len(top[0].Reporters) != 3 || top[0].Reporters["host2:11211"] != 80 {
+		panic("merged top key should be attributed to its reporters")
+	}
+
+	// a host that pruned the key bounds the error by its floor
+	summaries["host4:11211"] = NewHotKeySummary(1, map[string]uint64{"other": 50, "everywhere": 20})
+	top = MergeSummaries(summaries, 1)
+	if top[0].Key != "everywhere" || top[0].Score != 240+20 || top[0].Error != 20 {
+		panic("merged estimate should overestimate by no more than the floors")
+	}
+}
+
+func TestSummaryOf(t *testing.T) {
+
+	full := &HotKeyReport{TopN: 2, HotKeys: map[string]uint64{"a": 10, "b": 8}}
+	if summary := SummaryOf(full); summary.Floor != 8 || len(summary.Counters) != 2 {
+		panic("a full report's lowest hot key should bound the keys it left out")
+	}
+	partial := &HotKeyReport{TopN: 3, HotKeys: map[string]uint64{"a": 10, "b": 8}}
+	if summary := SummaryOf(partial); summary.Floor != 0 {
+		panic("a partial report has no known floor")
+	}
+	carried := &HotKeySummary{Capacity: 1, Floor: 3, Counters: map[string]SummaryCounter{"a": {Count: 10}}}
+	if SummaryOf(&HotKeyReport{TopN: 1, Summary: carried}) != carried {
+		panic("a carried summary should be used as is")
+	}
+}
@@ -0,0 +1,181 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// ErrUnknownScope is an error when a scope is neither global, a region nor a zone
+var ErrUnknownScope = errors.New("unknown scope")
+
+// Tier is the level of a hierarchical aggregation
+type Tier int
+
+const (
+	// FlatTier aggregates every reporter at once, as a single global leader
+	FlatTier Tier = iota
+	// ZoneTier aggregates the reporters of a zone
+	ZoneTier
+	// RegionTier aggregates the zone views of a region
+	RegionTier
+	// GlobalTier aggregates the region views
+	GlobalTier
+)
+
+// Scope is what an aggregator aggregates, and what a client reads the hot keys of
+type Scope struct {
+	Tier   Tier
+	Region string
+	Zone   string
+}
+
+// GlobalScope is the scope of every reporter, aggregated by either the flat or the global tier
+var GlobalScope = Scope{Tier: GlobalTier}
+
+// ZoneScope is the scope of the reporters of a zone
+func ZoneScope(region string, zone string) Scope {
+	return Scope{Tier: ZoneTier, Region: region, Zone: zone}
+}
+
+// RegionScope is the scope of the zones of a region
+func RegionScope(region string) Scope {
+	return Scope{Tier: RegionTier, Region: region}
+}
+
+// String gives `global`, `region:<region>` or `zone:<region>:<zone>`, which `ParseScope` parses
+func (scope Scope) String() string {
+	switch scope.Tier {
+	case ZoneTier:
+		return fmt.Sprintf("zone:%s:%s", scope.Region, scope.Zone)
+	case RegionTier:
+		return fmt.Sprintf("region:%s", scope.Region)
+	}
+	return "global"
+}
+
+// Contains tells if the `member` is a reporter of the scope
+func (scope Scope) Contains(member Member) bool {
+	switch scope.Tier {
+	case ZoneTier:
+		return member.Region == scope.Region && member.Zone == scope.Zone
+	case RegionTier:
+		return member.Region == scope.Region
+	}
+	return true
+}
+
+// ParseScope parses the scope of a client, see `Scope.String`
+func ParseScope(scope string) (Scope, error) {
+	parts := strings.Split(scope, ":")
+	switch {
+	case scope == "" || scope == "global":
+		return GlobalScope, nil
+	case len(parts) == 2 && parts[0] == "region" && parts[1] != "":
+		return RegionScope(parts[1]), nil
+	case len(parts) == 3 && parts[0] == "zone" && parts[1] != "" && parts[2] != "":
+		return ZoneScope(parts[1], parts[2]), nil
+	}
+	return GlobalScope, ErrUnknownScope
+}
+
+// ScopeKey is the memcached key of the hot keys of the `scope`, the global hot keys stay at the `reportKey`
+func ScopeKey(reportKey string, scope Scope) string {
+	if scope.Tier == ZoneTier || scope.Tier == RegionTier {
+		return fmt.Sprintf("%s:%s", reportKey, scope)
+	}
+	return reportKey
+}
+
+// subScopes gives the scopes the views of which an upper tier aggregates, as found among the `members`
+func (scope Scope) subScopes(members []Member) []Scope {
+	seen := map[Scope]bool{}
+	scopes := []Scope{}
+	for _, member := range members {
+		if !scope.Contains(member) || member.Region == "" {
+			continue
+		}
+		sub := RegionScope(member.Region)
+		if scope.Tier == RegionTier {
+			if member.Zone == "" {
+				continue
+			}
+			sub = ZoneScope(member.Region, member.Zone)
+		}
+		if !seen[sub] {
+			seen[sub] = true
+			scopes = append(scopes, sub)
+		}
+	}
+	return scopes
+}
+
+// aggregateViews merges the views the lower tier published for each sub scope, the merged keys are attributed to the sub scopes,
+// a view older than 3 aggregate intervals is treated as no data
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) aggregateViews(ctx context.Context, members []Member) error {
+	subScopes := memcachedHotKeyAggregator.options.Scope.subScopes(members)
+	if len(subScopes) == 0 {
+		return nil
+	}
+	viewKeys := make([]string, 0, len(subScopes))
+	for _, sub := range subScopes {
+		viewKeys = append(viewKeys, ScopeKey(memcachedHotKeyAggregator.reportKey, sub))
+	}
+	views, err := memcachedHotKeyAggregator.memcachedClient.GetMulti(viewKeys)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	staleness := time.Duration(ReportTTL(memcachedHotKeyAggregator.options.Interval)) * time.Second
+	merger := NewHotKeyMerger(memcachedHotKeyAggregator.options.MergeMode)
+	statuses := make(map[string]ReporterStatus, len(subScopes))
+	exact := true
+	for i, sub := range subScopes {
+		name := sub.String()
+		item, ok := views[viewKeys[i]]
+		if !ok {
+			statuses[name], exact = ReporterMissing, false
+			continue
+		}
+		view := &AggregatedHotKeys{}
+		rawBytes, err := DecodeValue(item, memcachedHotKeyAggregator.memcachedClient.GetMulti)
+		if err == nil {
+			err = json.Unmarshal(rawBytes, view)
+		}
+		if err != nil || view.Version != ReportSchemaVersion {
+			log.Warningf("<memcached aggregator> skips incompatible view of %s:%v\n", name, err)
+			statuses[name], exact = ReporterIncompatible, false
+			continue
+		}
+		if now.Sub(view.Generated()) > staleness {
+			statuses[name], exact = ReporterStale, false
+			continue
+		}
+		if len(view.HotKeys) == 0 {
+			statuses[name] = ReporterHeartbeat
+		} else {
+			statuses[name] = ReporterReported
+		}
+		exact = exact && view.Exact
+		for _, entry := range view.HotKeys {
+			// a view's scores are already merged, normalized or not, by the lower tier
+			merger.MergeScore(entry.Key, name, entry.Score, 1)
+			merger.mergeKeyStats(entry.Key, entry.Stats)
+		}
+	}
+	cutN := merger.Top(memcachedHotKeyAggregator.options.TopN)
+	merger.AttachStats(cutN)
+	return memcachedHotKeyAggregator.publishAggregated(ctx, &AggregatedHotKeys{
+		Version:   ReportSchemaVersion,
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+		HotKeys:   cutN,
+		Reporters: statuses,
+		Exact:     exact,
+	})
+}
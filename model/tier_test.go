@@ -0,0 +1,87 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/inexplicable/mc_hotkeys/internal/memcachedtest"
+)
+
+func TestParseScope(t *testing.T) {
+
+	for _, scope := range []Scope{GlobalScope, RegionScope("us-east"), ZoneScope("us-east", "us-east-1a")} {
+		if parsed, err := ParseScope(scope.String()); err != nil || parsed != scope {
+			panic("scope should be parsed back from its string")
+		}
+	}
+	if _, err := ParseScope("zone:us-east"); err != ErrUnknownScope {
+		panic("zone scope should have both a region and a zone")
+	}
+	if ScopeKey("MEMCACHED_HOT_KEYS", ZoneScope("us-east", "us-east-1a")) != "MEMCACHED_HOT_KEYS:zone:us-east:us-east-1a" ||
+		ScopeKey("MEMCACHED_HOT_KEYS", RegionScope("us-east")) != "MEMCACHED_HOT_KEYS:region:us-east" ||
+		ScopeKey("MEMCACHED_HOT_KEYS", GlobalScope) != "MEMCACHED_HOT_KEYS" {
+		panic("every tier should be published under its own key, and the global one at the report key")
+	}
+}
+
+func TestHierarchicalAggregation(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	publisher, err := NewResilientPublisher(&memcache.ServerList{}, time.Hour, fake.Addr())
+	if err != nil {
+		panic("publisher should be initialized with fallback")
+	}
+	codec := NewValueCodec(NoCompression, 0)
+	discovery := NewStaticDiscovery("host1:11211@us-east/us-east-1a", "host2:11211@us-east/us-east-1b", "host3:11211@eu-west/eu-west-1a")
+	hotKeys := map[string]map[string]uint64{
+		"host1:11211": {"a": 10, "b": 5},
+		"host2:11211": {"a": 20},
+		"host3:11211": {"b": 40},
+	}
+	for _, member := range discovery.members {
+		reporter := NewMemcachedHotKeyReporter(member.Identity, "MEMCACHED_HOT_KEYS", 2, time.Second, codec, publisher)
+		reporter.Label(member.Region, member.Zone)
+		reporter.Report(hotKeys[member.Identity], WindowsMetadata{Width: 10, TopN: 2})
+	}
+
+	aggregate := func(scope Scope) *AggregatedHotKeys {
+		aggregator := &MemcachedHotKeyAggregator{
+			reportKey:       "MEMCACHED_HOT_KEYS",
+			options:         AggregatorOptions{TopN: 2, Interval: time.Second, ReportInterval: time.Second, Scope: scope},
+			staleness:       time.Minute,
+			memcachedClient: memcache.New(fake.Addr()),
+			codec:           codec,
+			publisher:       publisher,
+			discovery:       discovery,
+		}
+		if err := aggregator.Aggregate(); err != nil {
+			panic("aggregate should succeed")
+		}
+		rawBytes, _ := fake.Value(ScopeKey("MEMCACHED_HOT_KEYS", scope))
+		aggregated := &AggregatedHotKeys{}
+		if json.Unmarshal(rawBytes, aggregated) != nil {
+			panic("every tier should publish its view")
+		}
+		return aggregated
+	}
+
+	for _, member := range discovery.members {
+		if zone := aggregate(ZoneScope(member.Region, member.Zone)); len(zone.Reporters) != 1 {
+			panic("a zone should aggregate only its own reporters")
+		}
+	}
+	if region := aggregate(RegionScope("us-east")); region.HotKeys[0].Key != "a" || region.HotKeys[0].Score != 30 || len(region.Reporters) != 2 {
+		panic("a region should aggregate the views of its zones")
+	}
+	aggregate(RegionScope("eu-west"))
+	global := aggregate(GlobalScope)
+	if global.HotKeys[0].Key != "b" || global.HotKeys[0].Score != 45 || global.HotKeys[0].Reporters["region:eu-west"] != 40 {
+		panic("the global view should aggregate the regions attributed to each region")
+	}
+	if global.Reporters["region:us-east"] != ReporterReported || len(global.Reporters) != 2 {
+		panic("the global view should tell the status of every region")
+	}
+}
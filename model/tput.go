@@ -0,0 +1,330 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	log "github.com/golang/glog"
+)
+
+// DefaultScoresHistory is the number of rolls whose scores a reporter keeps to answer the aggregator's exact rounds
+const DefaultScoresHistory = 16
+
+// TputRequest asks every reporter for the exact scores of the `Candidates`, and of all keys scored no less than `Threshold`,
+// each reporter answers from the roll of its sequence, which is the roll its first phase report came from
+type TputRequest struct {
+	ID         int64             `json:"id"`
+	Threshold  uint64            `json:"threshold"`
+	Candidates []string          `json:"candidates"`
+	Sequences  map[string]uint64 `json:"sequences"`
+}
+
+// TputResponse is a reporter's answer to a `TputRequest`, a candidate missing from the `Scores` scored 0,
+// `Expired` tells the roll of the requested sequence is no longer kept
+type TputResponse struct {
+	ID       int64             `json:"id"`
+	Identity string            `json:"identity"`
+	Sequence uint64            `json:"sequence"`
+	Expired  bool              `json:"expired,omitempty"`
+	Scores   map[string]uint64 `json:"scores,omitempty"`
+}
+
+// TputRequestKey is where the aggregator writes its request
+func TputRequestKey(reportKey string) string {
+	return fmt.Sprintf("%s:tput", reportKey)
+}
+
+// TputResponseKey is where the reporter of `identity` writes its response
+func TputResponseKey(reportKey string, identity string) string {
+	return fmt.Sprintf("%s:tput:%s", reportKey, identity)
+}
+
+// tputResponder keeps the scores of the last rolls of a reporter, and answers the aggregator's requests with them
+type tputResponder struct {
+	m            sync.Mutex
+	client       *memcache.Client
+	history      map[uint64]map[string]uint64
+	historySize  int
+	lastAnswered int64
+}
+
+func (responder *tputResponder) remember(sequence uint64, scores map[string]uint64) {
+	if scores == nil {
+		// the rolling windows don't retain their scores, every request of this roll is answered as expired
+		return
+	}
+	responder.m.Lock()
+	defer responder.m.Unlock()
+	responder.history[sequence] = scores
+	delete(responder.history, sequence-uint64(responder.historySize))
+}
+
+func (responder *tputResponder) answer(request *TputRequest, identity string) *TputResponse {
+	responder.m.Lock()
+	defer responder.m.Unlock()
+
+	sequence := request.Sequences[identity]
+	response := &TputResponse{ID: request.ID, Identity: identity, Sequence: sequence}
+	scores, ok := responder.history[sequence]
+	if !ok {
+		response.Expired = true
+		return response
+	}
+	response.Scores = map[string]uint64{}
+	for _, candidate := range request.Candidates {
+		if score, ok := scores[candidate]; ok {
+			response.Scores[candidate] = score
+		}
+	}
+	for key, score := range scores {
+		if score >= request.Threshold {
+			response.Scores[key] = score
+		}
+	}
+	return response
+}
+
+// respond answers the pending request once, requests of other reporters' sequences are left alone
+func (responder *tputResponder) respond(reporter *MemcachedHotKeyReporter) {
+	item, err := responder.client.Get(TputRequestKey(reporter.exactKey()))
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Warningf("<memcached report:%s> cannot read tput request:%v\n", reporter.identity, err)
+		}
+		return
+	}
+	request := &TputRequest{}
+	rawBytes, err := DecodeValue(item, responder.client.GetMulti)
+	if err == nil {
+		err = json.Unmarshal(rawBytes, request)
+	}
+	if err != nil {
+		log.Warningf("<memcached report:%s> malformed tput request:%v\n", reporter.identity, err)
+		return
+	}
+	if _, asked := request.Sequences[reporter.identity]; !asked || request.ID == responder.lastAnswered {
+		return
+	}
+	if rawBytes, err = json.Marshal(responder.answer(request, reporter.identity)); err != nil {
+		return
+	}
+	key := TputResponseKey(reporter.exactKey(), reporter.identity)
+	if err = publishEncoded(reporter.publisher, reporter.codec, key, rawBytes, reporter.ttl); err != nil {
+		log.Warningf("<memcached report:%s> cannot answer tput request:%v\n", reporter.identity, err)
+		return
+	}
+	responder.lastAnswered = request.ID
+}
+
+// unbounded is the bound of the scores a reporter left out when nothing bounds them
+const unbounded = math.MaxUint64
+
+// unreportedBound bounds the score of any key the `report` left out, by its Space-Saving summary of the same roll,
+// a key without a counter scores no more than the floor, and a key with one no more than its count,
+// the threshold bounds the counts of the keys left out but not their scores, so without a summary nothing bounds them
+func unreportedBound(report *HotKeyReport) uint64 {
+	if report.Summary == nil {
+		return unbounded
+	}
+	bound := report.Summary.Floor
+	for key, counter := range report.Summary.Counters {
+		if _, reported := report.HotKeys[key]; !reported && counter.Count > bound {
+			bound = counter.Count
+		}
+	}
+	return bound
+}
+
+// tputScores tracks what the aggregator knows of every key's scores at every reporter through the rounds
+type tputScores struct {
+	known  map[string]map[string]uint64 // key -> identity -> exact score
+	floors map[string]uint64            // identity -> bound of any score not known
+}
+
+func (scores *tputScores) learn(key string, identity string, score uint64) {
+	if _, ok := scores.known[key]; !ok {
+		scores.known[key] = map[string]uint64{}
+	}
+	scores.known[key][identity] = score
+}
+
+// bounds gives the lower and upper bound of the global score of the key, they're the same once it's exact
+func (scores *tputScores) bounds(key string) (uint64, uint64) {
+	lower, upper := uint64(0), uint64(0)
+	for identity, floor := range scores.floors {
+		bound := floor
+		if score, ok := scores.known[key][identity]; ok {
+			lower += score
+			bound = score
+		}
+		// a single unbounded reporter leaves the key unbounded
+		if upper > unbounded-bound {
+			upper = unbounded
+		} else {
+			upper += bound
+		}
+	}
+	return lower, upper
+}
+
+// kth gives the k-th highest lower bound, or 0 when there're fewer keys
+func (scores *tputScores) kth(k int) uint64 {
+	lowers := make([]uint64, 0, len(scores.known))
+	for key := range scores.known {
+		lower, _ := scores.bounds(key)
+		lowers = append(lowers, lower)
+	}
+	if k <= 0 || len(lowers) < k {
+		return 0
+	}
+	sort.Slice(lowers, func(i, j int) bool { return lowers[i] > lowers[j] })
+	return lowers[k-1]
+}
+
+// merge learns the responses of a round, a responder bounds every key it didn't give below the round's threshold
+func (scores *tputScores) merge(request *TputRequest, responses map[string]*TputResponse) {
+	for identity, response := range responses {
+		for _, candidate := range request.Candidates {
+			scores.learn(candidate, identity, response.Scores[candidate])
+		}
+		for key, score := range response.Scores {
+			scores.learn(key, identity, score)
+		}
+		switch request.Threshold {
+		case math.MaxUint64:
+			// a resolving round gives no bound beyond its candidates
+		case 0:
+			scores.floors[identity] = 0
+		default:
+			scores.floors[identity] = request.Threshold - 1
+		}
+	}
+}
+
+// unresolved gives the keys which might make the top, but aren't exact yet
+func (scores *tputScores) unresolved(kth uint64) []string {
+	keys := []string{}
+	for key := range scores.known {
+		if lower, upper := scores.bounds(key); lower != upper && upper >= kth {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// exactTop runs the rounds of the TPUT protocol over the first phase `reports` to find the exact global top keys,
+// it tells if the result is exact, which it's not when some reporter didn't answer in time
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) exactTop(ctx context.Context, reports map[string]*HotKeyReport) (HotKeyEntries, bool) {
+	topN := memcachedHotKeyAggregator.options.TopN
+	scores := &tputScores{known: map[string]map[string]uint64{}, floors: map[string]uint64{}}
+	sequences := make(map[string]uint64, len(reports))
+	for identity, report := range reports {
+		sequences[identity] = report.Sequence
+		scores.floors[identity] = unreportedBound(report)
+		for key, score := range report.HotKeys {
+			scores.learn(key, identity, score)
+		}
+	}
+	if len(reports) == 0 {
+		return HotKeyEntries{}, true
+	}
+
+	// 2nd phase: a key of the global top scores no less than `kth / m` on at least one reporter
+	candidates := make([]string, 0, len(scores.known))
+	for key := range scores.known {
+		candidates = append(candidates, key)
+	}
+	request := &TputRequest{
+		ID:         time.Now().UnixNano(),
+		Threshold:  scores.kth(topN) / uint64(len(reports)),
+		Candidates: candidates,
+		Sequences:  sequences,
+	}
+	responses := memcachedHotKeyAggregator.tputRound(ctx, request)
+	scores.merge(request, responses)
+	exact := len(responses) == len(reports)
+
+	// 3rd phase: resolves the keys that might still make the top, if any
+	if unresolved := scores.unresolved(scores.kth(topN)); len(unresolved) > 0 {
+		request = &TputRequest{
+			ID:         time.Now().UnixNano(),
+			Threshold:  math.MaxUint64,
+			Candidates: unresolved,
+			Sequences:  sequences,
+		}
+		responses = memcachedHotKeyAggregator.tputRound(ctx, request)
+		scores.merge(request, responses)
+		exact = exact && len(responses) == len(reports)
+	}
+
+	// the aggregator only runs the rounds merging by sum
+	merger := NewHotKeyMerger(MergeSum)
+	for key, known := range scores.known {
+		for identity, score := range known {
+			if score > 0 {
+				merger.MergeScore(key, identity, score, reports[identity].Width)
+			}
+		}
+	}
+	return merger.Top(topN), exact
+}
+
+// tputRound writes the request and collects the responses till every asked reporter answers, the timeout, or the `ctx` is done,
+// expired responses are left out as if they never came
+func (memcachedHotKeyAggregator *MemcachedHotKeyAggregator) tputRound(ctx context.Context, request *TputRequest) map[string]*TputResponse {
+	responses := map[string]*TputResponse{}
+	rawBytes, err := json.Marshal(request)
+	if err == nil {
+		timeout := memcachedHotKeyAggregator.options.ExactTimeout
+		err = publishEncoded(memcachedHotKeyAggregator.publisher, memcachedHotKeyAggregator.codec, TputRequestKey(memcachedHotKeyAggregator.scopeKey()), rawBytes, ReportTTL(timeout))
+	}
+	if err != nil {
+		log.Warningf("<memcached aggregator> cannot write tput request:%v\n", err)
+		return responses
+	}
+
+	pending := map[string]string{}
+	for identity := range request.Sequences {
+		pending[TputResponseKey(memcachedHotKeyAggregator.scopeKey(), identity)] = identity
+	}
+	poll := memcachedHotKeyAggregator.options.ReportInterval / 4
+	deadline := time.Now().Add(memcachedHotKeyAggregator.options.ExactTimeout)
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return responses
+		case <-time.After(poll):
+		}
+		keys := make([]string, 0, len(pending))
+		for key := range pending {
+			keys = append(keys, key)
+		}
+		items, err := memcachedHotKeyAggregator.memcachedClient.GetMulti(keys)
+		if err != nil {
+			continue
+		}
+		for key, item := range items {
+			response := &TputResponse{}
+			rawBytes, err := DecodeValue(item, memcachedHotKeyAggregator.memcachedClient.GetMulti)
+			if err != nil || json.Unmarshal(rawBytes, response) != nil || response.ID != request.ID {
+				// an answer to an earlier request, the reporter hasn't seen this one yet
+				continue
+			}
+			identity := pending[key]
+			delete(pending, key)
+			if !response.Expired && response.Identity == identity {
+				responses[identity] = response
+			}
+		}
+	}
+	if len(pending) > 0 {
+		log.Warningf("<memcached aggregator> %d reporters didn't answer tput request:%d\n", len(pending), request.ID)
+	}
+	return responses
+}
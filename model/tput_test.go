@@ -0,0 +1,136 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/inexplicable/mc_hotkeys/internal/memcachedtest"
+)
+
+func tputScoresOf(identity string) map[string]uint64 {
+	// `everywhere` ranks 3rd on every host, and a top 2 of each host never sees it
+	return map[string]uint64{
+		identity + ":a": 100,
+		identity + ":b": 90,
+		"everywhere":    80,
+		identity + ":c": 1,
+	}
+}
+
+func newTputAggregator(fake *memcachedtest.Server, timeout time.Duration) (*MemcachedHotKeyAggregator, Publisher, *ValueCodec) {
+	publisher, err := NewResilientPublisher(&memcache.ServerList{}, time.Hour, fake.Addr())
+	if err != nil {
+		panic("publisher should be initialized with fallback")
+	}
+	codec := NewValueCodec(NoCompression, 0)
+	return &MemcachedHotKeyAggregator{
+		reportKey: "MEMCACHED_HOT_KEYS",
+		options: AggregatorOptions{
+			TopN:           1,
+			ReportInterval: 40 * time.Millisecond,
+			Exact:          true,
+			ExactTimeout:   timeout,
+		},
+		memcachedClient: memcache.New(fake.Addr()),
+		codec:           codec,
+		publisher:       publisher,
+	}, publisher, codec
+}
+
+func TestExactTop(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	aggregator, publisher, codec := newTputAggregator(fake, time.Second)
+
+	reports := map[string]*HotKeyReport{}
+	reporters := []*MemcachedHotKeyReporter{}
+	for _, identity := range []string{"host1:11211", "host2:11211", "host3:11211"} {
+		scores := tputScoresOf(identity)
+		hotKeys := map[string]uint64{identity + ":a": 100, identity + ":b": 90}
+		reporter := NewMemcachedHotKeyReporter(identity, "MEMCACHED_HOT_KEYS", 2, time.Second, codec, publisher)
+		reporter.EnableExact(memcache.New(fake.Addr()), DefaultScoresHistory)
+		metadata := WindowsMetadata{Width: 10, TopN: 2, Scores: scores}
+		reporter.Report(hotKeys, metadata)
+		reporters = append(reporters, reporter)
+		reports[identity] = NewHotKeyReport(identity, 1, hotKeys, metadata)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				for _, reporter := range reporters {
+					reporter.responder.respond(reporter)
+				}
+			}
+		}
+	}()
+
+	top, exact := aggregator.exactTop(context.Background(), reports)
+	if !exact || len(top) != 1 || top[0].Key != "everywhere" || top[0].Score != 240 {
+		panic("exact rounds should find the global top key none of the reporters reported")
+	}
+	if len(top[0].Reporters) != 3 || top[0].Reporters["host1:11211"] != 80 {
+		panic("exact top key should be attributed to its reporters")
+	}
+}
+
+func TestExactTopTimeout(t *testing.T) {
+
+	fake := memcachedtest.NewServer()
+	defer fake.Close()
+	aggregator, _, _ := newTputAggregator(fake, 100*time.Millisecond)
+
+	reports := map[string]*HotKeyReport{
+		"host1:11211": NewHotKeyReport("host1:11211", 1, map[string]uint64{"a": 100, "b": 90}, WindowsMetadata{Width: 10, TopN: 2}),
+		"host2:11211": NewHotKeyReport("host2:11211", 1, map[string]uint64{"a": 50, "c": 90}, WindowsMetadata{Width: 10, TopN: 2}),
+	}
+	top, exact := aggregator.exactTop(context.Background(), reports)
+	if exact || len(top) != 1 || top[0].Key != "a" || top[0].Score != 150 {
+		panic("without answers the first phase reports should be merged, but not exact")
+	}
+}
+
+func TestTputResponderExpired(t *testing.T) {
+
+	responder := &tputResponder{history: map[uint64]map[string]uint64{}, historySize: 2}
+	responder.remember(1, map[string]uint64{"a": 1})
+	responder.remember(2, map[string]uint64{"a": 2})
+	responder.remember(3, map[string]uint64{"a": 3})
+
+	request := &TputRequest{ID: 1, Candidates: []string{"a"}, Sequences: map[string]uint64{"host1:11211": 1}}
+	if !responder.answer(request, "host1:11211").Expired {
+		panic("scores beyond the history should be expired")
+	}
+	request.Sequences["host1:11211"] = 3
+	if response := responder.answer(request, "host1:11211"); response.Expired || response.Scores["a"] != 3 {
+		panic("scores of the requested sequence should be answered")
+	}
+}
+
+func TestUnreportedBound(t *testing.T) {
+
+	// `large` is fetched below the threshold, but its bytes score it above the lowest hot key
+	scores := map[string]uint64{"a": 100, "b": 10, "large": 60, "c": 1}
+	hotKeys := map[string]uint64{"a": 100, "b": 10}
+	report := NewHotKeyReport("host1:11211", 1, hotKeys, WindowsMetadata{Width: 10, TopN: 2, Threshold: 5, Summary: NewHotKeySummary(3, scores)})
+	if bound := unreportedBound(report); bound != 60 || bound <= SummaryOf(report).Floor {
+		panic("the summary counters of the keys left out should bound them")
+	}
+	if unreportedBound(NewHotKeyReport("host1:11211", 1, hotKeys, WindowsMetadata{Width: 10, TopN: 2, Threshold: 5})) != unbounded {
+		panic("nothing should bound the keys left out without a summary")
+	}
+
+	tput := &tputScores{known: map[string]map[string]uint64{}, floors: map[string]uint64{"host1:11211": unbounded, "host2:11211": 10}}
+	tput.learn("large", "host2:11211", 20)
+	if lower, upper := tput.bounds("large"); lower != 20 || upper != unbounded {
+		panic("an unbounded reporter should leave the key unbounded")
+	}
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"container/heap"
 	"sync"
+	"time"
 )
 
 // SimpleRollingWindows is an implementation of `RollingWindows`
@@ -10,7 +11,9 @@ type SimpleRollingWindows struct {
 	m       sync.RWMutex
 	width   int
 	windows []GetKeyCounter
-	scorer  KeyScorer
+	// the stats of the keys a proxy fetched, which roll along with the `windows` of the same index
+	stats  []*KeyStatsCounter
+	scorer KeyScorer
 	// the widnows slice looks like this:
 	// [readFrom ... readTo, current]
 	// <--     width    -->
@@ -22,14 +25,26 @@ type SimpleRollingWindows struct {
 	readTo    int
 	topN      int
 	threshold uint64
+	// total number of requests observed by the last `Roll`
+	total uint64
+	// summary of all keys' scores of the last `Roll`, only when `summaryCapacity` is positive
+	summaryCapacity int
+	summary         *HotKeySummary
+	// all keys' scores of the last `Roll`, only when `retainScores` is set
+	retainScores bool
+	scores       map[string]uint64
+	// stats of the hot keys of the last `Roll`, only when a proxy observes the fetches
+	keyStats map[string]*KeyStats
 }
 
 // NewSimpleRollingWindows initialize a `SimpleRollingWindows` struct with the writable `current` and empty `[readFrom, readTo]` windows
 func NewSimpleRollingWindows(scorer KeyScorer, keyCounterGenerator func() GetKeyCounter, rollingWidth int, topN int, threshold uint64) *SimpleRollingWindows {
 
 	rollingWindows := make([]GetKeyCounter, rollingWidth+1)
+	stats := make([]*KeyStatsCounter, rollingWidth+1)
 	for w := 0; w <= rollingWidth; w++ {
 		rollingWindows[w] = &EmptyGetKeyCounter{}
+		stats[w] = NewKeyStatsCounter()
 	}
 	// initialize the `current` window as a writable window
 	rollingWindows[rollingWidth] = keyCounterGenerator()
@@ -38,6 +53,7 @@ func NewSimpleRollingWindows(scorer KeyScorer, keyCounterGenerator func() GetKey
 		m:         sync.RWMutex{},
 		width:     rollingWidth,
 		windows:   rollingWindows,
+		stats:     stats,
 		scorer:    scorer,
 		current:   rollingWidth,
 		readFrom:  0,
@@ -58,6 +74,43 @@ func (simpleRollingWindows *SimpleRollingWindows) Increment(key string, delta ui
 	simpleRollingWindows.last().Increment(key, delta)
 }
 
+// Observe records the outcome of a fetch of the `key` in the stats of the `last()` window
+func (simpleRollingWindows *SimpleRollingWindows) Observe(key string, hit bool, bytes int, latency time.Duration) {
+	simpleRollingWindows.m.RLock()
+	stats := simpleRollingWindows.stats[simpleRollingWindows.current]
+	simpleRollingWindows.m.RUnlock()
+	stats.Observe(key, hit, bytes, latency)
+}
+
+// Metadata describes the width, topN, threshold and total requests of the last `Roll`
+func (simpleRollingWindows *SimpleRollingWindows) Metadata() WindowsMetadata {
+	simpleRollingWindows.m.RLock()
+	defer simpleRollingWindows.m.RUnlock()
+	return WindowsMetadata{
+		Width:     simpleRollingWindows.width,
+		TopN:      simpleRollingWindows.topN,
+		Threshold: simpleRollingWindows.threshold,
+		Total:     simpleRollingWindows.total,
+		Summary:   simpleRollingWindows.summary,
+		Scores:    simpleRollingWindows.scores,
+		Stats:     simpleRollingWindows.keyStats,
+	}
+}
+
+// EnableSummary makes every `Roll` summarize the scores of all keys, not only the topN, in a `HotKeySummary` of `capacity`
+func (simpleRollingWindows *SimpleRollingWindows) EnableSummary(capacity int) {
+	simpleRollingWindows.m.Lock()
+	defer simpleRollingWindows.m.Unlock()
+	simpleRollingWindows.summaryCapacity = capacity
+}
+
+// EnableScores makes every `Roll` retain the scores of all keys, so that their exact scores could be looked up later
+func (simpleRollingWindows *SimpleRollingWindows) EnableScores() {
+	simpleRollingWindows.m.Lock()
+	defer simpleRollingWindows.m.Unlock()
+	simpleRollingWindows.retainScores = true
+}
+
 // Scorer is a getter for `KeyScorer`
 func (simpleRollingWindows *SimpleRollingWindows) Scorer() KeyScorer {
 	return simpleRollingWindows.scorer
@@ -70,7 +123,7 @@ func topN(scorer KeyScorer, all map[string]uint64, n int, threshold uint64) map[
 		if c >= threshold {
 			score := scorer.GetScore(k)
 			all[k] = c * score
-			hotKeyEntries = append(hotKeyEntries, &HotKeyEntry{k, c * score})
+			hotKeyEntries = append(hotKeyEntries, &HotKeyEntry{Key: k, Score: c * score})
 		} else {
 			delete(all, k)
 		}
@@ -98,18 +151,45 @@ func (simpleRollingWindows *SimpleRollingWindows) Roll() map[string]uint64 {
 	defer simpleRollingWindows.m.Unlock()
 	// overwrite the `readFrom` with a new `current` window
 	simpleRollingWindows.windows[simpleRollingWindows.readFrom] = NewBucketGetKeyCounter(32)
+	simpleRollingWindows.stats[simpleRollingWindows.readFrom] = NewKeyStatsCounter()
 	// gather all counts from all keys in the range [`readFrom` + 1, `readTo`], inclusively
 	aggregate := map[string]uint64{}
+	total := uint64(0)
 	width := simpleRollingWindows.width + 1
 	for s := (simpleRollingWindows.readFrom + 1) % width; s != simpleRollingWindows.readFrom; s = (s + 1) % width {
 		for k, c := range simpleRollingWindows.windows[s].Snapshot() {
 			aggregate[k] += c
+			total += c
+		}
+	}
+	simpleRollingWindows.total = total
+	if simpleRollingWindows.summaryCapacity > 0 || simpleRollingWindows.retainScores {
+		// keys below the threshold are scored too, they might be hot once merged with other reporters
+		scores := make(map[string]uint64, len(aggregate))
+		for k, c := range aggregate {
+			scores[k] = c * simpleRollingWindows.scorer.GetScore(k)
+		}
+		if simpleRollingWindows.retainScores {
+			simpleRollingWindows.scores = scores
+		}
+		if simpleRollingWindows.summaryCapacity > 0 {
+			simpleRollingWindows.summary = NewHotKeySummary(simpleRollingWindows.summaryCapacity, scores)
 		}
 	}
+	// combine with the score and find the `topN`, in random order
+	tops := topN(simpleRollingWindows.Scorer(), aggregate, simpleRollingWindows.topN, simpleRollingWindows.threshold)
+	// only the hot keys' stats are gathered, of the same windows as their counts
+	keyStats := map[string]*KeyStats{}
+	for s := (simpleRollingWindows.readFrom + 1) % width; s != simpleRollingWindows.readFrom; s = (s + 1) % width {
+		simpleRollingWindows.stats[s].addTo(keyStats, tops)
+	}
+	simpleRollingWindows.keyStats = nil
+	if len(keyStats) > 0 {
+		simpleRollingWindows.keyStats = keyStats
+	}
 	// shift `readFrom, readTo, current` to the right by exactly 1 position
 	simpleRollingWindows.readTo = simpleRollingWindows.current
 	simpleRollingWindows.current = simpleRollingWindows.readFrom
 	simpleRollingWindows.readFrom = (simpleRollingWindows.readFrom + 1) % width
-	// combine with the score and find the `topN`, in random order
-	return topN(simpleRollingWindows.Scorer(), aggregate, simpleRollingWindows.topN, simpleRollingWindows.threshold)
+	return tops
 }
@@ -81,6 +81,9 @@ func TestSimpleRollingWindows(t *testing.T) {
 	}) {
 		panic("rolling snapshot incorrect")
 	}
+	if !reflect.DeepEqual(rollingWindows.Metadata(), WindowsMetadata{Width: 4, TopN: 3, Threshold: 1, Total: 3}) {
+		panic("rolling metadata incorrect")
+	}
 	if rollingWindows.readFrom != 1 || rollingWindows.readTo != 4 || rollingWindows.current != 0 {
 		panic("rolling windows state incorrect after 1st roll")
 	}
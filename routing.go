@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/inexplicable/mc_hotkeys/mcrouter"
+)
+
+// routingCommand runs `mc_hotkeys routing generate|validate [flags]`, and gives the exit code
+func routingCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: mc_hotkeys routing generate|validate [flags]")
+		return 2
+	}
+	commands := flag.NewFlagSet("routing "+args[0], flag.ContinueOnError)
+	description := commands.String("description", "", "json file of the pools, prefixes and the hot keys pool to generate the config of")
+	output := commands.String("output", "", "file to write the generated config to, default stdout")
+	config := commands.String("config", "", "mcrouter json config to validate")
+	hotKeysPool := commands.String("hotkeys_pool", "memc-hotkeys", "pool of the eavesdroppers the operations should be mirrored to")
+	operations := commands.String("operations", "", "comma separated operations which should be mirrored, default get,add,set,delete")
+	if err := commands.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	switch args[0] {
+	case "generate":
+		b, err := ioutil.ReadFile(*description)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot read the description:%v\n", err)
+			return 1
+		}
+		routing := mcrouter.RoutingDescription{}
+		if err = json.Unmarshal(b, &routing); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot parse the description:%v\n", err)
+			return 1
+		}
+		if routing.HotKeysPool == "" {
+			routing.HotKeysPool = *hotKeysPool
+		}
+		if len(routing.Operations) == 0 {
+			routing.Operations = splitServers(*operations)
+		}
+		generated, err := mcrouter.GenerateRouting(routing)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot generate the config:%v\n", err)
+			return 1
+		}
+		if *output == "" {
+			fmt.Println(string(generated))
+			return 0
+		}
+		if err = ioutil.WriteFile(*output, append(generated, '\n'), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot write the config:%v\n", err)
+			return 1
+		}
+		return 0
+	case "validate":
+		b, err := ioutil.ReadFile(*config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot read the config:%v\n", err)
+			return 1
+		}
+		findings, err := mcrouter.ValidateRouting(b, *hotKeysPool, splitServers(*operations))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot parse the config:%v\n", err)
+			return 1
+		}
+		for _, finding := range findings {
+			fmt.Println(finding)
+		}
+		if len(findings) > 0 {
+			return 1
+		}
+		fmt.Printf("every prefix mirrors its operations to %s\n", *hotKeysPool)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown routing command:%s\n", args[0])
+	return 2
+}